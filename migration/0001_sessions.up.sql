@@ -23,5 +23,21 @@ CREATE TABLE work_lock (
 INSERT INTO work_lock (id, created) VALUES(1, now() at TIME ZONE 'utc');
 
 
--- TODO - EDIT below this line to add a session_id BIGINT column to the table that is keeping track of tasks to do
+-- TODO - EDIT below this line to add the following columns to the table that is keeping track of tasks to do
+-- The task_id domain in 0013_task_id.up.sql must match the key of the table, BIGINT unless you edit it.
+
+-- ALTER TABLE task ADD COLUMN session_id BIGINT NULL;
+-- ALTER TABLE task ADD COLUMN lease_expires TIMESTAMP NULL;
+-- ALTER TABLE task ADD COLUMN not_before TIMESTAMP NULL; -- NULL means the task can run right away
+-- ALTER TABLE task ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0; -- how many times the task failed or was retried
+-- ALTER TABLE task ADD COLUMN last_error TEXT NULL; -- why the task last failed or was retried
+-- ALTER TABLE task ADD COLUMN error_history TEXT[] NOT NULL DEFAULT '{}'; -- the error of every failed attempt, kept for dead lettered tasks
+-- ALTER TABLE task ADD COLUMN dedupe_key TEXT NULL; -- makes enqueue_task idempotent
+-- CREATE UNIQUE INDEX task_dedupe_idx ON task(dedupe_key) WHERE status = 'pending';
+-- ALTER TABLE task ADD COLUMN checkpoint BYTEA NULL; -- the last state saved with lock.SaveCheckpoint
+-- ALTER TABLE task ADD COLUMN result BYTEA NULL; -- what the task produced, only needed to store results
+-- ALTER TABLE task ADD COLUMN expires_at TIMESTAMP NULL; -- NULL means the task never expires
+-- ALTER TABLE task ADD COLUMN on_parent_failure TEXT NOT NULL DEFAULT 'cancel'; -- 'cancel' or 'run', only needed for task dependencies
+-- CREATE TABLE task_dependency (task_id BIGINT NOT NULL, parent_id BIGINT NOT NULL, CONSTRAINT task_dependency_pk1 PRIMARY KEY(task_id, parent_id)); -- the type of the key of your task table
+-- CREATE INDEX task_dependency_idx1 ON task_dependency(parent_id);
 
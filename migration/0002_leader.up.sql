@@ -0,0 +1,13 @@
+---
+-- This file provides the schema for leader election on top of the session locking package
+---
+
+-- leader holds the session that currently leads each named role.
+-- Leadership is handed to another session once the leading session expires or ends.
+CREATE TABLE leader (
+    role                TEXT NOT NULL,
+    session_id          BIGINT NOT NULL,
+    elected             TIMESTAMP NOT NULL,
+
+    CONSTRAINT leader_pk1 PRIMARY KEY(role)
+);
@@ -0,0 +1,16 @@
+---
+-- This file provides the schema for cron style scheduled jobs on top of the session locking package
+---
+
+-- scheduled_fire records every fire of a scheduled job.
+-- The primary key guarantees a fire can only be claimed by one session.
+CREATE TABLE scheduled_fire (
+    job_name            TEXT NOT NULL,
+    fire_time           TIMESTAMP NOT NULL,
+    session_id          BIGINT NOT NULL,
+    claimed             TIMESTAMP NOT NULL,
+    finished            TIMESTAMP NULL,
+    error               TEXT NULL,
+
+    CONSTRAINT scheduled_fire_pk1 PRIMARY KEY(job_name, fire_time)
+);
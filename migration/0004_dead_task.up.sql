@@ -0,0 +1,20 @@
+---
+-- This file provides the dead letter schema for the session locking package
+---
+
+-- dead_task holds tasks that failed permanently or ran out of retries.
+-- task is a snapshot of the task row so it can be inspected after the task itself changes.
+CREATE TABLE dead_task (
+    id                  BIGSERIAL NOT NULL,
+    task_id             TEXT NOT NULL,
+    session_id          BIGINT NULL,
+    attempts            INTEGER NOT NULL,
+    error               TEXT NULL,
+    error_history       TEXT[] NOT NULL,
+    task                JSONB NULL,
+    died                TIMESTAMP NOT NULL,
+
+    CONSTRAINT dead_task_pk1 PRIMARY KEY(id)
+);
+CREATE INDEX dead_task_idx1 ON dead_task(task_id);
+CREATE INDEX dead_task_idx2 ON dead_task(died);
@@ -0,0 +1,17 @@
+---
+-- This file provides the type of a task id for the 1000_tasks.alwaysup.sql template.
+-- It is numbered after the generic migrations so databases that already applied them still run it.
+-- 1000_tasks.alwaysup.sql creates the domain the same way if it is missing, so a database where this was skipped still migrates.
+-- The generic task table does not need it.
+---
+
+-- task_id is the type of the primary key of the table that is keeping track of tasks to do.
+-- Every function in the template takes and returns task ids as task_id so a table keyed by UUID or TEXT needs no other SQL changes.
+-- TODO - EDIT this to match the key of your task table: BIGINT, UUID or TEXT.  Use the matching lock.IDKind in Go.
+DO $$
+BEGIN
+    IF to_regtype('task_id') IS NULL THEN
+        CREATE DOMAIN task_id AS BIGINT;
+    END IF;
+END
+$$;
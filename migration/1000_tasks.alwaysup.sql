@@ -1,21 +1,75 @@
 ---
 -- This file provides the customized functionality for the session locking package.
+-- Task ids are passed as the task_id type from 0013_task_id.up.sql so the key of your task table can be BIGINT, UUID or TEXT.
 ---
 
+-- create task_id if 0013_task_id.up.sql was skipped, such as by a migrator that only runs versions above the last one it applied
+-- TODO - EDIT this to match the domain in 0013_task_id.up.sql
+DO $$
+BEGIN
+    IF to_regtype('task_id') IS NULL THEN
+        CREATE DOMAIN task_id AS BIGINT;
+    END IF;
+END
+$$;
+
 DROP FUNCTION IF EXISTS get_work(in_session_id session.id%TYPE);
 DROP FUNCTION IF EXISTS get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER);
+DROP FUNCTION IF EXISTS get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER);
+DROP FUNCTION IF EXISTS get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_after_id session_task.id%TYPE);
+DROP FUNCTION IF EXISTS get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_after_id task_id);
 DROP FUNCTION IF EXISTS get_tasks_for_session(in_session_id user_entry.session_id%TYPE);
+DROP FUNCTION IF EXISTS get_tasks_for_session(in_session_id user_entry.session_id%TYPE, in_batch_size INTEGER, in_after_id task_id);
+DROP FUNCTION IF EXISTS enqueue_task(in_not_before TIMESTAMP);
+DROP FUNCTION IF EXISTS enqueue_task(in_not_before TIMESTAMP, in_dedupe_key TEXT, in_dedupe_window INTERVAL);
+DROP FUNCTION IF EXISTS enqueue_task(in_not_before TIMESTAMP, in_dedupe_key TEXT, in_dedupe_window INTERVAL, in_parent_ids BIGINT[], in_on_parent_failure TEXT);
+DROP FUNCTION IF EXISTS enqueue_task(in_not_before TIMESTAMP, in_dedupe_key TEXT, in_dedupe_window INTERVAL, in_parent_ids BIGINT[], in_on_parent_failure TEXT, in_expires_at TIMESTAMP);
+DROP FUNCTION IF EXISTS extend_task_lease(in_session_id session.id%TYPE, in_task_id BIGINT, in_lease_duration INTERVAL);
+DROP FUNCTION IF EXISTS save_checkpoint(in_session_id session.id%TYPE, in_task_id BIGINT, in_checkpoint BYTEA);
+DROP FUNCTION IF EXISTS finish_tasks(in_task_ids BIGINT[]);
+DROP FUNCTION IF EXISTS finish_tasks(in_task_ids BIGINT[], in_results BYTEA[]);
+DROP FUNCTION IF EXISTS get_task_result(in_task_id BIGINT);
+DROP FUNCTION IF EXISTS cancel_tasks(in_task_ids BIGINT[]);
+DROP FUNCTION IF EXISTS get_cancelled_tasks(in_session_id session.id%TYPE);
+DROP FUNCTION IF EXISTS fail_tasks(in_task_ids BIGINT[], in_errors TEXT[]);
+DROP FUNCTION IF EXISTS retry_tasks(in_task_ids BIGINT[], in_errors TEXT[], in_not_befores TIMESTAMP[]);
+DROP FUNCTION IF EXISTS retry_tasks(in_task_ids task_id[], in_errors TEXT[], in_not_befores TIMESTAMP[]);
 DROP TYPE IF EXISTS session_task;
 CREATE TYPE session_task AS (
     -- TODO - FILL in the info here that you'll need access to in order to "do" the task
+    -- Include attempts if the Task implements lock.AttemptedTask so the RetryPolicy can count attempts.
+    -- Include checkpoint if the Task implements lock.CheckpointedTask so it can resume from its last checkpoint.
+    -- Include expires_at if the Task implements lock.ExpiringTask so the Runner can give it a deadline.
+    -- Include id, the key of the task table, to page through the work with the get_work overloads that take in_batch_size.
 
+    -- id          task_id,
     -- user_id     UUID,
     -- stuff       TEXT,
+    -- attempts    INTEGER,
+    -- checkpoint  BYTEA,
+    -- expires_at  TIMESTAMP,
     -- ...
 
 );
 
 
+-- This will return true once every parent of a task is finished.
+-- A parent that died, was cancelled or expired only counts as done if the task runs anyway on parent failure.
+-- TODO - Only needed if tasks have dependencies.  Uncomment it once task_dependency exists.
+
+-- CREATE OR REPLACE FUNCTION task_parents_done(in_task_id task_id, in_on_parent_failure TEXT)
+-- RETURNS BOOLEAN
+-- AS $$
+--     SELECT NOT EXISTS (
+--         SELECT 1
+--         FROM task_dependency d
+--         JOIN task p ON p.id = d.parent_id
+--         WHERE d.task_id = in_task_id
+--         AND p.status <> 'finished'
+--         AND NOT (in_on_parent_failure = 'run' AND p.status IN ('dead', 'cancelled', 'expired'))
+--     );
+-- $$ LANGUAGE sql STABLE;
+
 -- This will count how many total tasks there are currently to do.
 CREATE OR REPLACE FUNCTION get_task_count()
 RETURNS INTEGER
@@ -23,10 +77,13 @@ AS $$
 DECLARE
     v_ret INTEGER;
 BEGIN
-    -- TODO - Fill in this function so that it returns the total count for current tasks
+    -- TODO - Fill in this function so that it returns the total count for current tasks that are due
 
     -- SELECT count(*)
     -- FROM task
+    -- WHERE (not_before IS NULL OR not_before <= now() at TIME ZONE 'utc')
+    -- AND (expires_at IS NULL OR expires_at > now() at TIME ZONE 'utc')
+    -- AND task_parents_done(id, on_parent_failure) -- only if tasks have dependencies
     -- INTO v_ret;
 
     RETURN v_ret;
@@ -45,6 +102,7 @@ BEGIN
     -- SELECT count(*)
     -- FROM task
     -- WHERE session_id = in_session_id
+    -- AND lease_expires >= now() at TIME ZONE 'utc'
     -- INTO v_ret;
 
     RETURN v_ret;
@@ -60,14 +118,19 @@ DECLARE
     v_now   TIMESTAMP = now() at TIME ZONE 'utc';
 BEGIN
     -- TODO - Fill in this function so that it updates N tasks with the session id passed in where N = in_ideal_pickup
+    -- and starts a lease on each of them.  A task whose lease has expired goes back to the pool even if its session is still alive.
 
     -- UPDATE task t
     -- SET session_id = in_session_id
+    --   , lease_expires = v_now + INTERVAL '5 minutes'
     -- WHERE t.id = ANY(
     --     SELECT tt.id
     --     FROM task tt
     --     LEFT OUTER JOIN session s on tt.session_id = s.id
-    --     WHERE (tt.session_id IS NULL OR s.expires < v_now) -- there is no session or there is an expired session working this task
+    --     WHERE (tt.session_id IS NULL OR s.expires < v_now OR tt.lease_expires < v_now) -- there is no session, an expired session or an expired lease on this task
+    --     AND (tt.not_before IS NULL OR tt.not_before <= v_now) -- the task is due
+    --     AND (tt.expires_at IS NULL OR tt.expires_at > v_now) -- the task has not expired
+    --     AND task_parents_done(tt.id, tt.on_parent_failure) -- every parent is done, only if tasks have dependencies
     --     LIMIT in_ideal_pickup
     -- );
 END;
@@ -81,21 +144,448 @@ BEGIN
     -- TODO - Fill in this function so that it returns all tasks this session needs to do
 
     RETURN QUERY(
-        -- SELECT user_id, stuff
+        -- SELECT user_id, stuff, attempts, checkpoint, expires_at
         -- FROM task
         -- WHERE session_id = in_session_id
+        -- AND lease_expires >= now() at TIME ZONE 'utc'
+        -- AND (not_before IS NULL OR not_before <= now() at TIME ZONE 'utc')
+        -- AND (expires_at IS NULL OR expires_at > now() at TIME ZONE 'utc')
+        -- ORDER BY id
     );
 END;
 $$ LANGUAGE plpgsql;
 
+-- This will fetch the first in_batch_size tasks of get_tasks_for_session with an id after in_after_id, NULL starts from the first task.
+-- TODO - Only needed to page through the work with the get_work overloads below.  Fill it in like get_tasks_for_session.
+CREATE OR REPLACE FUNCTION get_tasks_for_session(in_session_id user_entry.session_id%TYPE, in_batch_size INTEGER, in_after_id task_id)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    -- TODO - Fill in this function so that it returns the next batch of tasks this session needs to do
+
+    RETURN QUERY(
+        -- SELECT id, user_id, stuff, attempts, checkpoint, expires_at
+        -- FROM task
+        -- WHERE session_id = in_session_id
+        -- AND lease_expires >= now() at TIME ZONE 'utc'
+        -- AND (not_before IS NULL OR not_before <= now() at TIME ZONE 'utc')
+        -- AND (expires_at IS NULL OR expires_at > now() at TIME ZONE 'utc')
+        -- AND (in_after_id IS NULL OR id > in_after_id)
+        -- ORDER BY id
+        -- LIMIT in_batch_size
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will do the same as get_work but only return the first in_batch_size tasks with an id after in_after_id
+-- so a session can own many tasks and work them in smaller batches.  Pass the id of the last task of a batch to get the next one,
+-- tasks that were skipped or are still running are not returned again.  NULL starts from the first task.
+-- Only the first page balances the work and picks up tasks, the pages after it bump the session and read on through the tasks it holds.
+-- These need the id in session_task and the get_tasks_for_session overload above.
+---
+CREATE OR REPLACE FUNCTION get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_after_id task_id)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    IF in_after_id IS NULL THEN
+        PERFORM balance_work(in_session_id, in_tasks_per_session_count);
+    ELSE
+        PERFORM bump_session(in_session_id);
+    END IF;
+
+    RETURN QUERY (
+        SELECT * FROM get_tasks_for_session(in_session_id, in_batch_size, in_after_id)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT * FROM get_work(in_session_id, in_tasks_per_session_count, in_batch_size, NULL::task_id)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will extend the lease a session holds on a task
+CREATE OR REPLACE FUNCTION extend_task_lease(in_session_id session.id%TYPE
+                                             , in_task_id task_id
+                                             , in_lease_duration INTERVAL)
+RETURNS VOID
+AS $$
+DECLARE
+    v_now   TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    -- TODO - Fill in this function so that it pushes back the lease on the task if this session still holds it.
+
+    -- UPDATE task
+    -- SET lease_expires = v_now + in_lease_duration
+    -- WHERE id = in_task_id
+    -- AND session_id = in_session_id
+    -- AND lease_expires >= v_now;
+
+    IF NOT FOUND THEN
+        PERFORM throw_lease_not_found();
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will save the progress of a task the session holds so the next session to pick it up can resume from it
+CREATE OR REPLACE FUNCTION save_checkpoint(in_session_id session.id%TYPE
+                                           , in_task_id task_id
+                                           , in_checkpoint BYTEA)
+RETURNS VOID
+AS $$
+DECLARE
+    v_now   TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    -- TODO - Fill in this function so that it stores the checkpoint on the task if this session still holds it.
+
+    -- UPDATE task
+    -- SET checkpoint = in_checkpoint
+    -- WHERE id = in_task_id
+    -- AND session_id = in_session_id
+    -- AND lease_expires >= v_now;
+
+    IF NOT FOUND THEN
+        PERFORM throw_lease_not_found();
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will return when the next task that is not yet due becomes due, or NULL if there is none.
+CREATE OR REPLACE FUNCTION get_next_task_due()
+RETURNS TIMESTAMP
+AS $$
+DECLARE
+    v_ret TIMESTAMP;
+BEGIN
+    -- TODO - Fill in this function so that it returns the earliest not_before that is still in the future
+
+    -- SELECT min(not_before)
+    -- FROM task
+    -- WHERE not_before > now() at TIME ZONE 'utc'
+    -- INTO v_ret;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will add a task to the pool that can not be picked up before in_not_before.
+-- If in_dedupe_key matches a task that is pending, or finished within in_dedupe_window, that task is returned instead.
+-- The task waits for every task in in_parent_ids to finish.  in_on_parent_failure is 'cancel' or 'run'.
+-- The task expires at in_expires_at if it has not run by then.  NULL means it never expires.
+CREATE OR REPLACE FUNCTION enqueue_task(in_not_before TIMESTAMP
+                                        , in_dedupe_key TEXT
+                                        , in_dedupe_window INTERVAL
+                                        , in_parent_ids task_id[]
+                                        , in_on_parent_failure TEXT
+                                        , in_expires_at TIMESTAMP)
+RETURNS TABLE(task_id task_id, deduplicated BOOLEAN)
+AS $$
+DECLARE
+    v_ret task_id;
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    -- TODO - Fill in this function and add parameters for the info the task needs so that it inserts a new task
+    -- and returns its id.  Set every column the other functions filter on so the task can be picked up:
+    -- no session, no lease, not yet attempted and due at in_not_before.  A NULL in_not_before means the task can run right away.
+    -- Producers should always add tasks through this function so it can be called in the same transaction as their own writes.
+
+    IF in_dedupe_key IS NOT NULL THEN
+        -- serialize enqueues of the same key so two producers can not both miss each other
+        PERFORM pg_advisory_xact_lock(hashtext('enqueue_task'), hashtext(in_dedupe_key));
+
+        -- SELECT t.id
+        -- FROM task t
+        -- WHERE t.dedupe_key = in_dedupe_key
+        -- AND (t.status = 'pending' OR (t.status = 'finished' AND t.finished + COALESCE(in_dedupe_window, INTERVAL '0') > v_now))
+        -- ORDER BY t.id DESC
+        -- LIMIT 1
+        -- INTO v_ret;
+
+        IF v_ret IS NOT NULL THEN
+            RETURN QUERY SELECT v_ret, TRUE;
+            RETURN;
+        END IF;
+    END IF;
+
+    -- INSERT INTO task (user_id, stuff, status, session_id, lease_expires, not_before, attempts, dedupe_key, expires_at)
+    -- VALUES (in_user_id, in_stuff, 'pending', NULL, NULL, in_not_before, 0, in_dedupe_key, in_expires_at)
+    -- RETURNING id INTO v_ret;
+
+    -- TODO - If tasks have dependencies record in_parent_ids and cancel the task if a parent already failed.
+    -- Call throw_parent_not_found if a parent does not exist so the task does not wait forever.
+
+    -- IF (SELECT count(*) FROM task t WHERE t.id = ANY(in_parent_ids)) < (SELECT count(DISTINCT p) FROM unnest(in_parent_ids) p) THEN
+    --     PERFORM throw_parent_not_found();
+    -- END IF;
+    -- UPDATE task SET on_parent_failure = COALESCE(in_on_parent_failure, 'cancel') WHERE id = v_ret;
+    -- INSERT INTO task_dependency (task_id, parent_id) SELECT DISTINCT v_ret, p FROM unnest(in_parent_ids) p;
+    -- IF COALESCE(in_on_parent_failure, 'cancel') = 'cancel'
+    --    AND EXISTS (SELECT 1 FROM task t WHERE t.id = ANY(in_parent_ids) AND t.status IN ('dead', 'cancelled', 'expired')) THEN
+    --     UPDATE task SET status = 'cancelled' WHERE id = v_ret;
+    -- END IF;
+
+    RETURN QUERY SELECT v_ret, FALSE;
+END;
+$$ LANGUAGE plpgsql;
+
 -- This will fetch tasks for a session
-CREATE OR REPLACE FUNCTION finish_tasks(in_task_ids BIGINT[])
+CREATE OR REPLACE FUNCTION finish_tasks(in_task_ids task_id[])
 RETURNS VOID
 AS $$
 BEGIN
     -- TODO - Fill in this function so that it flags all provided task ids as finished.
 
-    -- UPDATE task SET status = 'finished' WHERE id = ANY(in_task_ids);
+    -- UPDATE task
+    -- SET status = 'finished'
+    --   , finished = now() at TIME ZONE 'utc'
+    -- WHERE id = ANY(in_task_ids)
+    -- AND status = 'pending' -- a task that was cancelled or failed stays that way
+    -- AND (expires_at IS NULL OR expires_at > now() at TIME ZONE 'utc'); -- work that finished after the task expired is not recorded
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will flag tasks as finished and store what they produced.  in_results holds the result for the task at the same index.
+CREATE OR REPLACE FUNCTION finish_tasks(in_task_ids task_id[], in_results BYTEA[])
+RETURNS VOID
+AS $$
+BEGIN
+    -- TODO - Only needed if the Database implements lock.ResultFinisher.
+    -- Fill in this function so that it flags all provided task ids as finished and stores their results.
+
+    -- UPDATE task t
+    -- SET status = 'finished'
+    --   , finished = now() at TIME ZONE 'utc'
+    --   , result = f.result
+    -- FROM unnest(in_task_ids, in_results) AS f(id, result)
+    -- WHERE t.id = f.id
+    -- AND t.status = 'pending'
+    -- AND (t.expires_at IS NULL OR t.expires_at > now() at TIME ZONE 'utc');
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will return the status of a task and what it produced
+CREATE OR REPLACE FUNCTION get_task_result(in_task_id task_id)
+RETURNS TABLE(task_status TEXT, task_result BYTEA, task_finished TIMESTAMP)
+AS $$
+BEGIN
+    -- TODO - Only needed if the Database implements lock.ResultStore.
+
+    RETURN QUERY(
+        -- SELECT t.status, t.result, t.finished
+        -- FROM task t
+        -- WHERE t.id = in_task_id
+    );
 END;
 $$ LANGUAGE plpgsql;
 
+-- This will remove the results of tasks that finished before in_finished_before and return how many were removed
+CREATE OR REPLACE FUNCTION purge_task_results(in_finished_before TIMESTAMP)
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+BEGIN
+    -- TODO - Only needed if the Database implements lock.ResultStore.
+
+    -- UPDATE task
+    -- SET result = NULL
+    -- WHERE finished < in_finished_before
+    -- AND result IS NOT NULL;
+    -- GET DIAGNOSTICS v_ret = ROW_COUNT;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will flag pending tasks past their expires_at as expired and return how many expired
+CREATE OR REPLACE FUNCTION expire_tasks()
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+BEGIN
+    -- TODO - Only needed if tasks can expire.  Fill in this function so that it flags expired tasks and releases them from their session.
+
+    -- UPDATE task
+    -- SET status = 'expired'
+    --   , session_id = NULL
+    --   , lease_expires = NULL
+    -- WHERE status = 'pending'
+    -- AND expires_at <= now() at TIME ZONE 'utc';
+    -- GET DIAGNOSTICS v_ret = ROW_COUNT;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will cancel pending tasks so they are never picked up again and return how many were cancelled.
+CREATE OR REPLACE FUNCTION cancel_tasks(in_task_ids task_id[])
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+BEGIN
+    -- TODO - Fill in this function so that it flags all provided task ids as cancelled.  Leave session_id so get_cancelled_tasks finds
+    -- tasks that are running, and notify task_cancelled for them if the Database implements lock.CancelNotifier.
+    -- pickup_tasks_for_session, get_tasks_for_session and the functions that record outcomes must skip cancelled tasks.
+
+    -- UPDATE task
+    -- SET status = 'cancelled'
+    -- WHERE id = ANY(in_task_ids)
+    -- AND status = 'pending';
+    -- GET DIAGNOSTICS v_ret = ROW_COUNT;
+
+    -- PERFORM pg_notify('task_cancelled', t.id::TEXT)
+    -- FROM task t
+    -- WHERE t.id = ANY(in_task_ids)
+    -- AND t.status = 'cancelled'
+    -- AND t.session_id IS NOT NULL;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will return the cancelled tasks a session still holds
+CREATE OR REPLACE FUNCTION get_cancelled_tasks(in_session_id session.id%TYPE)
+RETURNS SETOF task_id
+AS $$
+BEGIN
+    -- TODO - Fill in this function so that it returns the ids of the cancelled tasks this session still holds
+
+    RETURN QUERY(
+        -- SELECT id
+        -- FROM task
+        -- WHERE session_id = in_session_id
+        -- AND status = 'cancelled'
+        -- AND lease_expires >= now() at TIME ZONE 'utc'
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will move tasks to the dead letter table so they are never picked up again
+CREATE OR REPLACE FUNCTION fail_tasks(in_task_ids task_id[], in_errors TEXT[])
+RETURNS VOID
+AS $$
+BEGIN
+    -- TODO - Fill in this function so that it flags all provided task ids as dead and records them with dead_letter_task.
+    -- in_errors holds the error for the task at the same index.
+
+    -- PERFORM dead_letter_task(t.id::TEXT, t.session_id, t.attempts + 1, f.error, t.error_history || f.error, to_jsonb(t))
+    -- FROM task t
+    -- JOIN unnest(in_task_ids, in_errors) AS f(id, error) ON t.id = f.id;
+
+    -- UPDATE task t
+    -- SET status = 'dead'
+    --   , attempts = t.attempts + 1
+    --   , last_error = f.error
+    --   , error_history = t.error_history || f.error
+    -- FROM unnest(in_task_ids, in_errors) AS f(id, error)
+    -- WHERE t.id = f.id;
+
+    -- TODO - If tasks have dependencies cancel the pending descendants that cancel on parent failure.
+
+    -- WITH RECURSIVE doomed(id) AS (
+    --     SELECT unnest(in_task_ids)
+    --   UNION
+    --     SELECT d.task_id
+    --     FROM doomed p
+    --     JOIN task_dependency d ON d.parent_id = p.id
+    --     JOIN task c ON c.id = d.task_id
+    --     WHERE c.on_parent_failure = 'cancel'
+    --     AND c.status = 'pending'
+    -- )
+    -- UPDATE task t
+    -- SET status = 'cancelled'
+    -- FROM doomed
+    -- WHERE t.id = doomed.id
+    -- AND t.status = 'pending';
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will release tasks back to the pool so they are picked up again once in_not_befores has passed.
+-- A task whose attempts reach in_max_attempts at the same index is failed instead, 0 means no limit.
+CREATE OR REPLACE FUNCTION retry_tasks(in_task_ids task_id[], in_errors TEXT[], in_not_befores TIMESTAMP[], in_max_attempts INTEGER[])
+RETURNS VOID
+AS $$
+DECLARE
+    v_failed_ids    task_id[];
+    v_failed_errors TEXT[];
+BEGIN
+    -- TODO - Fill in this function so that it releases all provided task ids from their session.
+    -- in_errors and in_not_befores hold the error and the earliest retry time for the task at the same index.
+    -- Tasks out of attempts are failed with fail_tasks instead, counted from the attempts column.
+
+    -- SELECT array_agg(t.id), array_agg(format('gave up after %s attempts: %s', t.attempts + 1, r.error))
+    -- FROM task t
+    -- JOIN unnest(in_task_ids, in_errors, in_max_attempts) AS r(id, error, max_attempts) ON t.id = r.id
+    -- WHERE r.max_attempts > 0
+    -- AND t.attempts + 1 >= r.max_attempts
+    -- INTO v_failed_ids, v_failed_errors;
+
+    -- IF v_failed_ids IS NOT NULL THEN
+    --     PERFORM fail_tasks(v_failed_ids, v_failed_errors);
+    -- END IF;
+
+    -- UPDATE task t
+    -- SET session_id = NULL
+    --   , lease_expires = NULL
+    --   , not_before = r.not_before
+    --   , attempts = t.attempts + 1
+    --   , last_error = r.error
+    --   , error_history = t.error_history || r.error
+    -- FROM unnest(in_task_ids, in_errors, in_not_befores) AS r(id, error, not_before)
+    -- WHERE t.id = r.id
+    -- AND t.status = 'pending';
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will give tasks back to the pool without counting an attempt so any session can pick them up once in_not_befores has passed.
+CREATE OR REPLACE FUNCTION release_tasks(in_task_ids task_id[], in_not_befores TIMESTAMP[])
+RETURNS VOID
+AS $$
+BEGIN
+    -- TODO - Fill in this function so that it releases all provided task ids from their session without touching their attempts.
+
+    -- UPDATE task t
+    -- SET session_id = NULL
+    --   , lease_expires = NULL
+    --   , not_before = r.not_before
+    -- FROM unnest(in_task_ids, in_not_befores) AS r(id, not_before)
+    -- WHERE t.id = r.id
+    -- AND t.status = 'pending';
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will put dead lettered tasks back in the pool and return how many were requeued
+CREATE OR REPLACE FUNCTION requeue_dead_tasks(in_ids BIGINT[]
+                                              , in_task_ids TEXT[]
+                                              , in_error_contains TEXT
+                                              , in_died_after TIMESTAMP
+                                              , in_died_before TIMESTAMP
+                                              , in_limit INTEGER)
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+BEGIN
+    -- TODO - Fill in this function so that it resets every task removed from the dead letter table by take_dead_tasks.
+
+    -- UPDATE task t
+    -- SET status = 'pending'
+    --   , session_id = NULL
+    --   , lease_expires = NULL
+    --   , not_before = NULL
+    --   , attempts = 0
+    -- FROM take_dead_tasks(in_ids, in_task_ids, in_error_contains, in_died_after, in_died_before, in_limit) d
+    -- WHERE t.id = d.task_id::task_id;
+    -- GET DIAGNOSTICS v_ret = ROW_COUNT;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
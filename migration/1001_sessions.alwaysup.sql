@@ -2,6 +2,8 @@
 -- This file provides the standard functionality for the session locking package
 ---
 
+DROP FUNCTION IF EXISTS finish_scheduled_fire(in_job_name scheduled_fire.job_name%TYPE, in_fire_time scheduled_fire.fire_time%TYPE, in_error scheduled_fire.error%TYPE);
+
 ---
 CREATE OR REPLACE FUNCTION throw_session_not_found()
 RETURNS VOID
@@ -11,6 +13,24 @@ BEGIN
 END;
 $$ LANGUAGE plpgsql;
 
+---
+CREATE OR REPLACE FUNCTION throw_lease_not_found()
+RETURNS VOID
+AS $$
+BEGIN
+    RAISE EXCEPTION 'Lease not found.' USING ERRCODE = 'SL002';
+END;
+$$ LANGUAGE plpgsql;
+
+---
+CREATE OR REPLACE FUNCTION throw_parent_not_found()
+RETURNS VOID
+AS $$
+BEGIN
+    RAISE EXCEPTION 'Parent task not found.' USING ERRCODE = 'SL003';
+END;
+$$ LANGUAGE plpgsql;
+
 ---
 -- This will start a new session for a service.
 ---
@@ -65,10 +85,10 @@ $$ LANGUAGE plpgsql;
 
 ---
 -- This will balance the tasks evenly across the active sessions and
--- return work for this session to do.
+-- pick up this session's share.
 ---
-CREATE OR REPLACE FUNCTION get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER)
-RETURNS SETOF session_task
+CREATE OR REPLACE FUNCTION balance_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER)
+RETURNS VOID
 AS $$
 DECLARE
     v_now           TIMESTAMP = now() at TIME ZONE 'utc';
@@ -99,6 +119,19 @@ BEGIN
         -- pick up tasks if possible
         PERFORM pickup_tasks_for_session(in_session_id, v_ideal_count - v_session_count);
     END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will balance the tasks evenly across the active sessions and
+-- return work for this session to do.
+-- The overloads that page through the work are in 1000_tasks.alwaysup.sql since they need the id of a task.
+---
+CREATE OR REPLACE FUNCTION get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    PERFORM balance_work(in_session_id, in_tasks_per_session_count);
 
     -- return tasks that are ready to run
     RETURN QUERY (
@@ -109,3 +142,260 @@ $$ LANGUAGE plpgsql;
 
 
 
+---
+-- This will make the session the leader of a role if there is no live leader
+-- and return whether the session leads the role.
+---
+CREATE OR REPLACE FUNCTION claim_leadership(in_role leader.role%TYPE, in_session_id session.id%TYPE)
+RETURNS BOOLEAN
+AS $$
+DECLARE
+    v_now       TIMESTAMP = now() at TIME ZONE 'utc';
+    v_leader_id BIGINT;
+BEGIN
+    -- bump this session to extend its expiration time
+    PERFORM bump_session(in_session_id);
+
+    -- take over the role if nobody holds it or the session holding it is no longer active
+    INSERT INTO leader (role, session_id, elected) VALUES (in_role, in_session_id, v_now)
+    ON CONFLICT (role) DO UPDATE
+    SET session_id = EXCLUDED.session_id
+      , elected = EXCLUDED.elected
+    WHERE NOT EXISTS (
+        SELECT 1
+        FROM session s
+        WHERE s.id = leader.session_id
+        AND s.expires >= v_now
+    );
+
+    SELECT session_id FROM leader WHERE role = in_role INTO v_leader_id;
+    RETURN v_leader_id = in_session_id;
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will record a fire of a scheduled job for the session
+-- and return false if another session already claimed it.
+-- A fire whose session expired before finishing it is handed to the new session so it is run again.
+---
+CREATE OR REPLACE FUNCTION claim_scheduled_fire(in_job_name scheduled_fire.job_name%TYPE
+                                                , in_fire_time scheduled_fire.fire_time%TYPE
+                                                , in_session_id session.id%TYPE)
+RETURNS BOOLEAN
+AS $$
+DECLARE
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    -- bump this session to extend its expiration time
+    PERFORM bump_session(in_session_id);
+
+    INSERT INTO scheduled_fire (job_name, fire_time, session_id, claimed)
+    VALUES (in_job_name, in_fire_time, in_session_id, v_now)
+    ON CONFLICT (job_name, fire_time) DO UPDATE
+    SET session_id = EXCLUDED.session_id
+      , claimed = EXCLUDED.claimed
+      , error = NULL
+    WHERE scheduled_fire.finished IS NULL
+    AND NOT EXISTS (
+        SELECT 1
+        FROM session s
+        WHERE s.id = scheduled_fire.session_id
+        AND s.expires >= v_now
+    );
+
+    RETURN FOUND;
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will return the fires of a scheduled job, oldest first, that were claimed by a session that expired before finishing them
+---
+CREATE OR REPLACE FUNCTION get_orphaned_scheduled_fires(in_job_name scheduled_fire.job_name%TYPE)
+RETURNS SETOF TIMESTAMP
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT f.fire_time
+        FROM scheduled_fire f
+        WHERE f.job_name = in_job_name
+        AND f.finished IS NULL
+        AND NOT EXISTS (
+            SELECT 1
+            FROM session s
+            WHERE s.id = f.session_id
+            AND s.expires >= now() at TIME ZONE 'utc'
+        )
+        ORDER BY f.fire_time
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will flag a fire of a scheduled job as finished, with an error if it failed.
+-- It returns false if the session no longer holds the fire, because it expired and another session claimed the fire again.
+---
+CREATE OR REPLACE FUNCTION finish_scheduled_fire(in_job_name scheduled_fire.job_name%TYPE
+                                                 , in_fire_time scheduled_fire.fire_time%TYPE
+                                                 , in_session_id session.id%TYPE
+                                                 , in_error scheduled_fire.error%TYPE)
+RETURNS BOOLEAN
+AS $$
+DECLARE
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    UPDATE scheduled_fire
+    SET finished = v_now
+      , error = NULLIF(in_error, '')
+    WHERE job_name = in_job_name
+    AND fire_time = in_fire_time
+    AND session_id = in_session_id
+    AND finished IS NULL;
+
+    RETURN FOUND;
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will return the latest recorded fire time of a scheduled job or NULL if it has never fired
+---
+CREATE OR REPLACE FUNCTION get_last_scheduled_fire(in_job_name scheduled_fire.job_name%TYPE)
+RETURNS TIMESTAMP
+AS $$
+DECLARE
+    v_ret TIMESTAMP;
+BEGIN
+    SELECT max(fire_time)
+    FROM scheduled_fire
+    WHERE job_name = in_job_name
+    INTO v_ret;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will return the run history of a scheduled job, newest first
+---
+CREATE OR REPLACE FUNCTION get_scheduled_fires(in_job_name scheduled_fire.job_name%TYPE, in_limit INTEGER)
+RETURNS SETOF scheduled_fire
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT *
+        FROM scheduled_fire
+        WHERE job_name = in_job_name
+        ORDER BY fire_time DESC
+        LIMIT in_limit
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will record a task in the dead letter table
+---
+CREATE OR REPLACE FUNCTION dead_letter_task(in_task_id dead_task.task_id%TYPE
+                                            , in_session_id dead_task.session_id%TYPE
+                                            , in_attempts dead_task.attempts%TYPE
+                                            , in_error dead_task.error%TYPE
+                                            , in_error_history dead_task.error_history%TYPE
+                                            , in_task dead_task.task%TYPE)
+RETURNS BIGINT
+AS $$
+DECLARE
+    v_ret BIGINT;
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    INSERT INTO dead_task (task_id, session_id, attempts, error, error_history, task, died)
+    VALUES (in_task_id, in_session_id, in_attempts, in_error, COALESCE(in_error_history, '{}'), in_task, v_now)
+    RETURNING id INTO v_ret;
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will find dead lettered tasks matching a filter, oldest first.  A NULL argument does not filter.
+---
+CREATE OR REPLACE FUNCTION find_dead_task_ids(in_ids BIGINT[]
+                                              , in_task_ids TEXT[]
+                                              , in_error_contains TEXT
+                                              , in_died_after TIMESTAMP
+                                              , in_died_before TIMESTAMP
+                                              , in_limit INTEGER)
+RETURNS SETOF BIGINT
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT id
+        FROM dead_task
+        WHERE (in_ids IS NULL OR id = ANY(in_ids))
+        AND (in_task_ids IS NULL OR task_id = ANY(in_task_ids))
+        AND (in_error_contains IS NULL OR strpos(error, in_error_contains) > 0)
+        AND (in_died_after IS NULL OR died > in_died_after)
+        AND (in_died_before IS NULL OR died < in_died_before)
+        ORDER BY died, id
+        LIMIT in_limit
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will return dead lettered tasks matching a filter, oldest first
+---
+CREATE OR REPLACE FUNCTION get_dead_tasks(in_ids BIGINT[]
+                                          , in_task_ids TEXT[]
+                                          , in_error_contains TEXT
+                                          , in_died_after TIMESTAMP
+                                          , in_died_before TIMESTAMP
+                                          , in_limit INTEGER)
+RETURNS SETOF dead_task
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT d.*
+        FROM dead_task d
+        WHERE d.id IN (SELECT find_dead_task_ids(in_ids, in_task_ids, in_error_contains, in_died_after, in_died_before, in_limit))
+        ORDER BY d.died, d.id
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will remove dead lettered tasks matching a filter and return them so they can be requeued
+---
+CREATE OR REPLACE FUNCTION take_dead_tasks(in_ids BIGINT[]
+                                           , in_task_ids TEXT[]
+                                           , in_error_contains TEXT
+                                           , in_died_after TIMESTAMP
+                                           , in_died_before TIMESTAMP
+                                           , in_limit INTEGER)
+RETURNS SETOF dead_task
+AS $$
+BEGIN
+    RETURN QUERY
+        DELETE FROM dead_task
+        WHERE id IN (SELECT find_dead_task_ids(in_ids, in_task_ids, in_error_contains, in_died_after, in_died_before, in_limit))
+        RETURNING *;
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will delete dead lettered tasks matching a filter and return how many were deleted
+---
+CREATE OR REPLACE FUNCTION purge_dead_tasks(in_ids BIGINT[]
+                                            , in_task_ids TEXT[]
+                                            , in_error_contains TEXT
+                                            , in_died_after TIMESTAMP
+                                            , in_died_before TIMESTAMP
+                                            , in_limit INTEGER)
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+BEGIN
+    DELETE FROM dead_task
+    WHERE id IN (SELECT find_dead_task_ids(in_ids, in_task_ids, in_error_contains, in_died_after, in_died_before, in_limit));
+    GET DIAGNOSTICS v_ret = ROW_COUNT;
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
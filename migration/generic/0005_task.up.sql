@@ -0,0 +1,33 @@
+---
+-- This file provides an optional generic task table for the session locking package.
+-- Use it with generic/1000_tasks.alwaysup.sql in place of the 1000_tasks.alwaysup.sql template.
+---
+
+-- task holds every task of every queue.  The payload holds whatever the Tasker for the queue needs to do the task.
+CREATE TABLE task (
+    id                  BIGSERIAL NOT NULL,
+    queue               TEXT NOT NULL,
+    payload             JSONB NOT NULL,
+    status              TEXT NOT NULL DEFAULT 'pending', -- pending, finished or dead
+    created             TIMESTAMP NOT NULL,
+    updated             TIMESTAMP NOT NULL,
+    finished            TIMESTAMP NULL,
+    session_id          BIGINT NULL,
+    lease_expires       TIMESTAMP NULL,
+    not_before          TIMESTAMP NULL,
+    attempts            INTEGER NOT NULL DEFAULT 0,
+    last_error          TEXT NULL,
+    error_history       TEXT[] NOT NULL DEFAULT '{}',
+
+    CONSTRAINT task_pk1 PRIMARY KEY(id)
+);
+CREATE INDEX task_idx1 ON task(queue, not_before) WHERE status = 'pending';
+CREATE INDEX task_idx2 ON task(session_id) WHERE status = 'pending';
+
+-- session_queue records which queues a session works so tasks are only balanced across the sessions working the same queue
+CREATE TABLE session_queue (
+    session_id          BIGINT NOT NULL,
+    queue               TEXT NOT NULL,
+
+    CONSTRAINT session_queue_pk1 PRIMARY KEY(session_id, queue)
+);
@@ -0,0 +1,8 @@
+---
+-- This file adds dedupe keys to the generic task table so enqueueing can be idempotent
+---
+
+ALTER TABLE task ADD COLUMN dedupe_key TEXT NULL;
+
+-- only one pending task can hold a dedupe key
+CREATE UNIQUE INDEX task_dedupe_idx ON task(dedupe_key) WHERE status = 'pending';
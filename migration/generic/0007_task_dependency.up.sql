@@ -0,0 +1,16 @@
+---
+-- This file adds dependencies to the generic task table so tasks can form a graph
+---
+
+-- on_parent_failure decides what happens to a task when a parent dies or is cancelled:
+-- 'cancel' cancels the task and its descendants, 'run' runs it anyway once every other parent is done
+ALTER TABLE task ADD COLUMN on_parent_failure TEXT NOT NULL DEFAULT 'cancel';
+
+-- task_dependency holds the parents of each task.  A task is only picked up once all of its parents are finished.
+CREATE TABLE task_dependency (
+    task_id             BIGINT NOT NULL,
+    parent_id           BIGINT NOT NULL,
+
+    CONSTRAINT task_dependency_pk1 PRIMARY KEY(task_id, parent_id)
+);
+CREATE INDEX task_dependency_idx1 ON task_dependency(parent_id);
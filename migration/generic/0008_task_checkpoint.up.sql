@@ -0,0 +1,5 @@
+---
+-- This file adds checkpoints to the generic task table so a reassigned task can resume where the last session stopped
+---
+
+ALTER TABLE task ADD COLUMN checkpoint BYTEA NULL;
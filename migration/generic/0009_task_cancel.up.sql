@@ -0,0 +1,6 @@
+---
+-- This file supports cancelling tasks in the generic task table.  Cancelled tasks have the status 'cancelled'.
+---
+
+-- a session looks up the cancelled tasks it still holds while its Tasker runs
+CREATE INDEX task_idx3 ON task(session_id) WHERE status = 'cancelled';
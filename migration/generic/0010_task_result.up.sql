@@ -0,0 +1,8 @@
+---
+-- This file adds results to the generic task table so producers can read what a task produced
+---
+
+ALTER TABLE task ADD COLUMN result BYTEA NULL;
+
+-- purge_task_results looks up finished tasks that still hold a result
+CREATE INDEX task_idx4 ON task(finished) WHERE result IS NOT NULL;
@@ -0,0 +1,8 @@
+---
+-- This file adds expiry to the generic task table.  Tasks past expires_at are never picked up and get the status 'expired'.
+---
+
+ALTER TABLE task ADD COLUMN expires_at TIMESTAMP NULL; -- NULL means the task never expires
+
+-- expire_tasks looks up pending tasks that can expire
+CREATE INDEX task_idx5 ON task(expires_at) WHERE status = 'pending';
@@ -0,0 +1,5 @@
+---
+-- This file adds a type to the generic task table so a lock.Mux can work several types of task on one queue
+---
+
+ALTER TABLE task ADD COLUMN task_type TEXT NOT NULL DEFAULT '';
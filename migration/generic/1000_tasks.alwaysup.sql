@@ -0,0 +1,856 @@
+---
+-- This file provides the functionality for the generic task table in 0005_task.up.sql.
+-- Use it in place of the 1000_tasks.alwaysup.sql template.
+--
+-- Every function takes an optional in_queue.  NULL means every queue, which is what get_work uses.
+-- get_queue_work does the same as get_work for a single queue, get_queue_work_page pages through it.  The functions that take in_task_types only count, pick up
+-- and return tasks of those types, so a lock.Mux only claims the types it has a handler for.  NULL means every type.
+-- A task is only picked up once task_parents_done is true for it.
+---
+
+DROP FUNCTION IF EXISTS get_work(in_session_id session.id%TYPE);
+DROP FUNCTION IF EXISTS get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER);
+DROP FUNCTION IF EXISTS get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER);
+DROP FUNCTION IF EXISTS get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_after_id session_task.id%TYPE);
+DROP FUNCTION IF EXISTS get_queue_work(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER);
+DROP FUNCTION IF EXISTS get_queue_work(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER);
+DROP FUNCTION IF EXISTS get_tasks_for_session(in_session_id session.id%TYPE);
+DROP FUNCTION IF EXISTS get_tasks_for_session(in_session_id session.id%TYPE, in_queue task.queue%TYPE);
+DROP FUNCTION IF EXISTS get_tasks_for_session(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_task_types TEXT[]);
+DROP FUNCTION IF EXISTS get_tasks_for_session(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_task_types TEXT[], in_batch_size INTEGER, in_after_id task.id%TYPE);
+DROP FUNCTION IF EXISTS get_queue_work(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_task_types TEXT[]);
+DROP FUNCTION IF EXISTS get_queue_work(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_task_types TEXT[]);
+DROP FUNCTION IF EXISTS get_queue_work(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_task_types TEXT[], in_after_id task.id%TYPE);
+DROP FUNCTION IF EXISTS get_queue_work_page(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER);
+DROP FUNCTION IF EXISTS get_queue_work_page(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_task_types TEXT[]);
+DROP FUNCTION IF EXISTS get_queue_work_page(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_task_types TEXT[], in_after_id task.id%TYPE);
+DROP FUNCTION IF EXISTS enqueue_task(in_queue TEXT, in_payload JSONB, in_not_before TIMESTAMP);
+DROP FUNCTION IF EXISTS enqueue_task(in_queue TEXT, in_payload JSONB, in_not_before TIMESTAMP, in_dedupe_key TEXT, in_dedupe_window INTERVAL);
+DROP FUNCTION IF EXISTS enqueue_task(in_queue TEXT, in_payload JSONB, in_not_before TIMESTAMP, in_dedupe_key TEXT, in_dedupe_window INTERVAL, in_parent_ids BIGINT[], in_on_parent_failure TEXT);
+DROP FUNCTION IF EXISTS enqueue_task(in_queue TEXT, in_payload JSONB, in_not_before TIMESTAMP, in_dedupe_key TEXT, in_dedupe_window INTERVAL, in_parent_ids BIGINT[], in_on_parent_failure TEXT, in_expires_at TIMESTAMP);
+DROP FUNCTION IF EXISTS retry_tasks(in_task_ids BIGINT[], in_errors TEXT[], in_not_befores TIMESTAMP[]);
+DROP TYPE IF EXISTS session_task;
+CREATE TYPE session_task AS (
+    id          BIGINT,
+    queue       TEXT,
+    task_type   TEXT,
+    payload     JSONB,
+    attempts    INTEGER,
+    checkpoint  BYTEA,
+    expires_at  TIMESTAMP
+);
+
+
+-- This will return true once every parent of a task is finished.
+-- A parent that died, was cancelled or expired only counts as done if the task runs anyway on parent failure.
+CREATE OR REPLACE FUNCTION task_parents_done(in_task_id task.id%TYPE, in_on_parent_failure task.on_parent_failure%TYPE)
+RETURNS BOOLEAN
+AS $$
+    SELECT NOT EXISTS (
+        SELECT 1
+        FROM task_dependency d
+        JOIN task p ON p.id = d.parent_id
+        WHERE d.task_id = in_task_id
+        AND p.status <> 'finished'
+        AND NOT (in_on_parent_failure = 'run' AND p.status IN ('dead', 'cancelled', 'expired'))
+    );
+$$ LANGUAGE sql STABLE;
+
+-- This will count how many total tasks there are currently to do.
+CREATE OR REPLACE FUNCTION get_task_count(in_queue task.queue%TYPE, in_task_types TEXT[])
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+BEGIN
+    SELECT count(*)
+    FROM task
+    WHERE status = 'pending'
+    AND (in_queue IS NULL OR queue = in_queue)
+    AND (in_task_types IS NULL OR task_type = ANY(in_task_types))
+    AND (not_before IS NULL OR not_before <= now() at TIME ZONE 'utc')
+    AND (expires_at IS NULL OR expires_at > now() at TIME ZONE 'utc')
+    AND task_parents_done(id, on_parent_failure)
+    INTO v_ret;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_task_count(in_queue task.queue%TYPE)
+RETURNS INTEGER
+AS $$
+BEGIN
+    RETURN get_task_count(in_queue, NULL);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_task_count()
+RETURNS INTEGER
+AS $$
+BEGIN
+    RETURN get_task_count(NULL, NULL);
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will count how many tasks this session is currently dealing with.
+CREATE OR REPLACE FUNCTION get_task_count_for_session(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_task_types TEXT[])
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+BEGIN
+    SELECT count(*)
+    FROM task
+    WHERE session_id = in_session_id
+    AND status = 'pending'
+    AND (in_queue IS NULL OR queue = in_queue)
+    AND (in_task_types IS NULL OR task_type = ANY(in_task_types))
+    AND lease_expires >= now() at TIME ZONE 'utc'
+    INTO v_ret;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_task_count_for_session(in_session_id session.id%TYPE, in_queue task.queue%TYPE)
+RETURNS INTEGER
+AS $$
+BEGIN
+    RETURN get_task_count_for_session(in_session_id, in_queue, NULL);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_task_count_for_session(in_session_id session.id%TYPE)
+RETURNS INTEGER
+AS $$
+BEGIN
+    RETURN get_task_count_for_session(in_session_id, NULL, NULL);
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will assign up to in_ideal_pickup unowned tasks to this session and lease them.
+CREATE OR REPLACE FUNCTION pickup_tasks_for_session(in_session_id session.id%TYPE
+                                                    , in_ideal_pickup INTEGER
+                                                    , in_queue task.queue%TYPE
+                                                    , in_task_types TEXT[])
+RETURNS VOID
+AS $$
+DECLARE
+    v_now   TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    UPDATE task t
+    SET session_id = in_session_id
+      , lease_expires = v_now + INTERVAL '5 minutes'
+      , updated = v_now
+    WHERE t.id = ANY(
+        SELECT tt.id
+        FROM task tt
+        LEFT OUTER JOIN session s on tt.session_id = s.id
+        WHERE tt.status = 'pending'
+        AND (in_queue IS NULL OR tt.queue = in_queue)
+        AND (in_task_types IS NULL OR tt.task_type = ANY(in_task_types))
+        AND (tt.session_id IS NULL OR s.expires < v_now OR tt.lease_expires < v_now) -- there is no session, an expired session or an expired lease on this task
+        AND (tt.not_before IS NULL OR tt.not_before <= v_now) -- the task is due
+        AND (tt.expires_at IS NULL OR tt.expires_at > v_now) -- the task has not expired
+        AND task_parents_done(tt.id, tt.on_parent_failure) -- every parent is done
+        ORDER BY tt.id
+        LIMIT in_ideal_pickup
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION pickup_tasks_for_session(in_session_id session.id%TYPE
+                                                    , in_ideal_pickup INTEGER
+                                                    , in_queue task.queue%TYPE)
+RETURNS VOID
+AS $$
+BEGIN
+    PERFORM pickup_tasks_for_session(in_session_id, in_ideal_pickup, in_queue, NULL);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION pickup_tasks_for_session(in_session_id session.id%TYPE
+                                                    , in_ideal_pickup INTEGER)
+RETURNS VOID
+AS $$
+BEGIN
+    PERFORM pickup_tasks_for_session(in_session_id, in_ideal_pickup, NULL, NULL);
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will fetch tasks for a session
+CREATE OR REPLACE FUNCTION get_tasks_for_session(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_task_types TEXT[])
+RETURNS SETOF session_task
+AS $$
+DECLARE
+    v_now   TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    RETURN QUERY(
+        SELECT id, queue, task_type, payload, attempts, checkpoint, expires_at
+        FROM task
+        WHERE session_id = in_session_id
+        AND status = 'pending'
+        AND (in_queue IS NULL OR queue = in_queue)
+        AND (in_task_types IS NULL OR task_type = ANY(in_task_types))
+        AND lease_expires >= v_now
+        AND (not_before IS NULL OR not_before <= v_now)
+        AND (expires_at IS NULL OR expires_at > v_now)
+        ORDER BY id
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will fetch the first in_batch_size tasks of get_tasks_for_session with an id after in_after_id, NULL starts from the first task
+CREATE OR REPLACE FUNCTION get_tasks_for_session(in_session_id session.id%TYPE
+                                                 , in_queue task.queue%TYPE
+                                                 , in_task_types TEXT[]
+                                                 , in_batch_size INTEGER
+                                                 , in_after_id task.id%TYPE)
+RETURNS SETOF session_task
+AS $$
+DECLARE
+    v_now   TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    RETURN QUERY(
+        SELECT id, queue, task_type, payload, attempts, checkpoint, expires_at
+        FROM task
+        WHERE session_id = in_session_id
+        AND status = 'pending'
+        AND (in_queue IS NULL OR queue = in_queue)
+        AND (in_task_types IS NULL OR task_type = ANY(in_task_types))
+        AND lease_expires >= v_now
+        AND (not_before IS NULL OR not_before <= v_now)
+        AND (expires_at IS NULL OR expires_at > v_now)
+        AND (in_after_id IS NULL OR id > in_after_id)
+        ORDER BY id
+        LIMIT in_batch_size
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_tasks_for_session(in_session_id session.id%TYPE, in_queue task.queue%TYPE)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    RETURN QUERY(
+        SELECT * FROM get_tasks_for_session(in_session_id, in_queue, NULL)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_tasks_for_session(in_session_id session.id%TYPE)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    RETURN QUERY(
+        SELECT * FROM get_tasks_for_session(in_session_id, NULL, NULL)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will do the same as get_work but only return the first in_batch_size tasks with an id after in_after_id
+-- so a session can own many tasks and work them in smaller batches.  Pass the id of the last task of a batch to get the next one,
+-- tasks that were skipped or are still running are not returned again.  NULL starts from the first task.
+-- Only the first page balances the work and picks up tasks, the pages after it bump the session and read on through the tasks it holds.
+---
+CREATE OR REPLACE FUNCTION get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_after_id task.id%TYPE)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    IF in_after_id IS NULL THEN
+        PERFORM balance_work(in_session_id, in_tasks_per_session_count);
+    ELSE
+        PERFORM bump_session(in_session_id);
+    END IF;
+
+    RETURN QUERY (
+        SELECT * FROM get_tasks_for_session(in_session_id, NULL, NULL, in_batch_size, in_after_id)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_work(in_session_id session.id%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT * FROM get_work(in_session_id, in_tasks_per_session_count, in_batch_size, NULL::BIGINT)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will balance the tasks of a single queue evenly across the active sessions working that queue and
+-- pick up this session's share.  Only tasks of in_task_types are counted and picked up, NULL means every type.
+---
+CREATE OR REPLACE FUNCTION balance_queue_work(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_task_types TEXT[])
+RETURNS VOID
+AS $$
+DECLARE
+    v_now           TIMESTAMP = now() at TIME ZONE 'utc';
+    v_sessions      INTEGER;
+    v_task_count    INTEGER;
+    v_available_tasks_per_session_count INTEGER;
+    v_ideal_count   INTEGER;
+    v_session_count INTEGER;
+BEGIN
+    -- lock work
+    PERFORM 1 FROM work_lock WHERE id = 1 FOR UPDATE;
+
+    -- bump this session to extend its expiration time
+    PERFORM bump_session(in_session_id);
+
+    -- record that this session works the queue and forget sessions that are long gone
+    INSERT INTO session_queue (session_id, queue) VALUES (in_session_id, in_queue) ON CONFLICT DO NOTHING;
+    DELETE FROM session_queue sq
+    USING session s
+    WHERE sq.session_id = s.id
+    AND s.expires < v_now - INTERVAL '1 day';
+
+    -- count active sessions working this queue
+    SELECT count(*)
+    FROM session s
+    JOIN session_queue sq ON sq.session_id = s.id
+    WHERE s.expires >= v_now
+    AND sq.queue = in_queue
+    INTO v_sessions;
+    -- count active tasks and calculate ideal task count per session (rounded up)
+    SELECT get_task_count FROM get_task_count(in_queue, in_task_types) INTO v_task_count;
+    v_available_tasks_per_session_count := CEIL(v_task_count::NUMERIC / v_sessions::NUMERIC)::INTEGER;
+    -- limit tasks per sessions
+    v_ideal_count := LEAST(v_available_tasks_per_session_count, in_tasks_per_session_count);
+    -- count how many active tasks this session has
+    SELECT get_task_count_for_session FROM get_task_count_for_session(in_session_id, in_queue, in_task_types) INTO v_session_count;
+
+    -- distribute tasks - i.e. pickup unassociated tasks if necessary
+    IF v_session_count < v_ideal_count THEN
+        -- pick up tasks if possible
+        PERFORM pickup_tasks_for_session(in_session_id, v_ideal_count - v_session_count, in_queue, in_task_types);
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will balance the tasks of a single queue evenly across the active sessions working that queue and
+-- return work for this session to do.  Only tasks of in_task_types are counted, picked up and returned, NULL means every type.
+---
+CREATE OR REPLACE FUNCTION get_queue_work(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_task_types TEXT[])
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    PERFORM balance_queue_work(in_session_id, in_queue, in_tasks_per_session_count, in_task_types);
+
+    -- return tasks that are ready to run
+    RETURN QUERY (
+        SELECT * FROM get_tasks_for_session(in_session_id, in_queue, in_task_types)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_queue_work(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT * FROM get_queue_work(in_session_id, in_queue, in_tasks_per_session_count, NULL::TEXT[])
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+---
+-- This will do the same as get_queue_work but only return the first in_batch_size tasks with an id after in_after_id
+-- so a session can own many tasks and work them in smaller batches, see get_work.
+-- It has its own name since get_queue_work(..., INTEGER, NULL) could not tell in_task_types from in_batch_size.
+---
+CREATE OR REPLACE FUNCTION get_queue_work_page(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_task_types TEXT[], in_after_id task.id%TYPE)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    IF in_after_id IS NULL THEN
+        PERFORM balance_queue_work(in_session_id, in_queue, in_tasks_per_session_count, in_task_types);
+    ELSE
+        PERFORM bump_session(in_session_id);
+    END IF;
+
+    RETURN QUERY (
+        SELECT * FROM get_tasks_for_session(in_session_id, in_queue, in_task_types, in_batch_size, in_after_id)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_queue_work_page(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER, in_task_types TEXT[])
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT * FROM get_queue_work_page(in_session_id, in_queue, in_tasks_per_session_count, in_batch_size, in_task_types, NULL::BIGINT)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_queue_work_page(in_session_id session.id%TYPE, in_queue task.queue%TYPE, in_tasks_per_session_count INTEGER, in_batch_size INTEGER)
+RETURNS SETOF session_task
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT * FROM get_queue_work_page(in_session_id, in_queue, in_tasks_per_session_count, in_batch_size, NULL::TEXT[])
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will extend the lease a session holds on a task
+CREATE OR REPLACE FUNCTION extend_task_lease(in_session_id session.id%TYPE
+                                             , in_task_id task.id%TYPE
+                                             , in_lease_duration INTERVAL)
+RETURNS VOID
+AS $$
+DECLARE
+    v_now   TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    UPDATE task
+    SET lease_expires = v_now + in_lease_duration
+      , updated = v_now
+    WHERE id = in_task_id
+    AND session_id = in_session_id
+    AND status = 'pending'
+    AND lease_expires >= v_now;
+
+    IF NOT FOUND THEN
+        PERFORM throw_lease_not_found();
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will save the progress of a task the session holds so the next session to pick it up can resume from it
+CREATE OR REPLACE FUNCTION save_checkpoint(in_session_id session.id%TYPE
+                                           , in_task_id task.id%TYPE
+                                           , in_checkpoint task.checkpoint%TYPE)
+RETURNS VOID
+AS $$
+DECLARE
+    v_now   TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    UPDATE task
+    SET checkpoint = in_checkpoint
+      , updated = v_now
+    WHERE id = in_task_id
+    AND session_id = in_session_id
+    AND status = 'pending'
+    AND lease_expires >= v_now;
+
+    IF NOT FOUND THEN
+        PERFORM throw_lease_not_found();
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will return when the next task that is not yet due becomes due, or NULL if there is none.
+CREATE OR REPLACE FUNCTION get_next_task_due(in_queue task.queue%TYPE)
+RETURNS TIMESTAMP
+AS $$
+DECLARE
+    v_ret TIMESTAMP;
+BEGIN
+    SELECT min(not_before)
+    FROM task
+    WHERE status = 'pending'
+    AND (in_queue IS NULL OR queue = in_queue)
+    AND not_before > now() at TIME ZONE 'utc'
+    INTO v_ret;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION get_next_task_due()
+RETURNS TIMESTAMP
+AS $$
+BEGIN
+    RETURN get_next_task_due(NULL);
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will add a task to the pool that can not be picked up before in_not_before.
+-- If in_dedupe_key matches a task that is pending, or finished within in_dedupe_window, that task is returned instead.
+-- The task waits for every task in in_parent_ids to finish.  in_on_parent_failure is 'cancel' or 'run', see task.on_parent_failure.
+-- The task expires at in_expires_at if it has not run by then.  NULL means it never expires.
+-- in_task_type picks the handler for the task when a lock.Mux works the queue.
+CREATE OR REPLACE FUNCTION enqueue_task(in_queue task.queue%TYPE
+                                        , in_task_type task.task_type%TYPE
+                                        , in_payload task.payload%TYPE
+                                        , in_not_before task.not_before%TYPE
+                                        , in_dedupe_key task.dedupe_key%TYPE
+                                        , in_dedupe_window INTERVAL
+                                        , in_parent_ids BIGINT[]
+                                        , in_on_parent_failure task.on_parent_failure%TYPE
+                                        , in_expires_at task.expires_at%TYPE)
+RETURNS TABLE(task_id BIGINT, deduplicated BOOLEAN)
+AS $$
+DECLARE
+    v_ret       BIGINT;
+    v_now       TIMESTAMP = now() at TIME ZONE 'utc';
+    v_policy    TEXT = COALESCE(in_on_parent_failure, 'cancel');
+BEGIN
+    IF (SELECT count(*) FROM task t WHERE t.id = ANY(in_parent_ids)) < (SELECT count(DISTINCT p) FROM unnest(in_parent_ids) p) THEN
+        PERFORM throw_parent_not_found();
+    END IF;
+
+    IF in_dedupe_key IS NOT NULL THEN
+        -- serialize enqueues of the same key so two producers can not both miss each other
+        PERFORM pg_advisory_xact_lock(hashtext('enqueue_task'), hashtext(in_dedupe_key));
+
+        SELECT t.id
+        FROM task t
+        WHERE t.dedupe_key = in_dedupe_key
+        AND (t.status = 'pending' OR (t.status = 'finished' AND t.finished + COALESCE(in_dedupe_window, INTERVAL '0') > v_now))
+        ORDER BY t.id DESC
+        LIMIT 1
+        INTO v_ret;
+
+        IF v_ret IS NOT NULL THEN
+            RETURN QUERY SELECT v_ret, TRUE;
+            RETURN;
+        END IF;
+    END IF;
+
+    INSERT INTO task (queue, task_type, payload, status, created, updated, session_id, lease_expires, not_before, attempts, dedupe_key, on_parent_failure, expires_at)
+    VALUES (in_queue, COALESCE(in_task_type, ''), in_payload, 'pending', v_now, v_now, NULL, NULL, in_not_before, 0, in_dedupe_key, v_policy, in_expires_at)
+    RETURNING id INTO v_ret;
+
+    INSERT INTO task_dependency (task_id, parent_id)
+    SELECT DISTINCT v_ret, p
+    FROM unnest(in_parent_ids) p;
+
+    -- a parent may already have failed
+    IF v_policy = 'cancel' AND EXISTS (SELECT 1 FROM task t WHERE t.id = ANY(in_parent_ids) AND t.status IN ('dead', 'cancelled', 'expired')) THEN
+        PERFORM cancel_descendants(ARRAY[v_ret]::BIGINT[], FALSE);
+    END IF;
+
+    RETURN QUERY SELECT v_ret, FALSE;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will enqueue a batch of tasks in one call, like calling enqueue_task for each and returning their rows in order.
+-- Every array holds the argument of enqueue_task for the task at the same index, an empty dedupe key or on parent failure is NULL.
+-- The parents of the task at index n (1 based) are the in_parent_ids whose in_parent_indexes is n.
+CREATE OR REPLACE FUNCTION enqueue_tasks(in_queues TEXT[]
+                                         , in_task_types TEXT[]
+                                         , in_payloads JSONB[]
+                                         , in_not_befores TIMESTAMP[]
+                                         , in_dedupe_keys TEXT[]
+                                         , in_dedupe_windows INTERVAL[]
+                                         , in_parent_indexes INTEGER[]
+                                         , in_parent_ids BIGINT[]
+                                         , in_on_parent_failures TEXT[]
+                                         , in_expires_ats TIMESTAMP[])
+RETURNS TABLE(task_id BIGINT, deduplicated BOOLEAN)
+AS $$
+BEGIN
+    RETURN QUERY (
+        SELECT e.task_id, e.deduplicated
+        FROM unnest(in_queues, in_task_types, in_payloads, in_not_befores, in_dedupe_keys, in_dedupe_windows, in_on_parent_failures, in_expires_ats)
+            WITH ORDINALITY AS r(queue, task_type, payload, not_before, dedupe_key, dedupe_window, on_parent_failure, expires_at, n)
+        CROSS JOIN LATERAL enqueue_task(r.queue
+                                        , r.task_type
+                                        , r.payload
+                                        , r.not_before
+                                        , NULLIF(r.dedupe_key, '')
+                                        , r.dedupe_window
+                                        , ARRAY(SELECT p.parent_id FROM unnest(in_parent_indexes, in_parent_ids) AS p(n, parent_id) WHERE p.n = r.n)
+                                        , NULLIF(r.on_parent_failure, '')
+                                        , r.expires_at) e
+        ORDER BY r.n
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will flag tasks as finished
+CREATE OR REPLACE FUNCTION finish_tasks(in_task_ids BIGINT[])
+RETURNS VOID
+AS $$
+DECLARE
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    UPDATE task
+    SET status = 'finished'
+      , finished = v_now
+      , updated = v_now
+    WHERE id = ANY(in_task_ids)
+    AND status = 'pending'
+    AND (expires_at IS NULL OR expires_at > v_now); -- work that finished after the task expired is not recorded
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will flag tasks as finished and store what they produced.  in_results holds the result for the task at the same index.
+CREATE OR REPLACE FUNCTION finish_tasks(in_task_ids BIGINT[], in_results BYTEA[])
+RETURNS VOID
+AS $$
+DECLARE
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    UPDATE task t
+    SET status = 'finished'
+      , finished = v_now
+      , updated = v_now
+      , result = f.result
+    FROM unnest(in_task_ids, in_results) AS f(id, result)
+    WHERE t.id = f.id
+    AND t.status = 'pending'
+    AND (t.expires_at IS NULL OR t.expires_at > v_now);
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will return the status of a task and what it produced
+CREATE OR REPLACE FUNCTION get_task_result(in_task_id task.id%TYPE)
+RETURNS TABLE(task_status TEXT, task_result BYTEA, task_finished TIMESTAMP)
+AS $$
+BEGIN
+    RETURN QUERY(
+        SELECT t.status, t.result, t.finished
+        FROM task t
+        WHERE t.id = in_task_id
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will remove the results of tasks that finished before in_finished_before and return how many were removed
+CREATE OR REPLACE FUNCTION purge_task_results(in_finished_before TIMESTAMP)
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+BEGIN
+    UPDATE task
+    SET result = NULL
+    WHERE finished < in_finished_before
+    AND result IS NOT NULL;
+    GET DIAGNOSTICS v_ret = ROW_COUNT;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will flag pending tasks past their expires_at as expired, cancel their descendants and return how many expired
+CREATE OR REPLACE FUNCTION expire_tasks()
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ids BIGINT[];
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    WITH expired AS (
+        UPDATE task
+        SET status = 'expired'
+          , session_id = NULL
+          , lease_expires = NULL
+          , last_error = 'expired'
+          , updated = v_now
+        WHERE status = 'pending'
+        AND expires_at <= v_now
+        RETURNING id
+    )
+    SELECT array_agg(id) FROM expired INTO v_ids;
+
+    IF v_ids IS NULL THEN
+        RETURN 0;
+    END IF;
+
+    PERFORM cancel_descendants(v_ids, TRUE);
+
+    RETURN cardinality(v_ids);
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will cancel pending tasks so they are never picked up again and return how many were cancelled.
+-- Sessions running a cancelled task are told on the task_cancelled channel and find it with get_cancelled_tasks.
+CREATE OR REPLACE FUNCTION cancel_tasks(in_task_ids BIGINT[])
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    UPDATE task
+    SET status = 'cancelled'
+      , last_error = 'cancelled'
+      , updated = v_now
+    WHERE id = ANY(in_task_ids)
+    AND status = 'pending';
+    GET DIAGNOSTICS v_ret = ROW_COUNT;
+
+    PERFORM pg_notify('task_cancelled', t.id::TEXT)
+    FROM task t
+    WHERE t.id = ANY(in_task_ids)
+    AND t.status = 'cancelled'
+    AND t.session_id IS NOT NULL
+    AND t.lease_expires >= v_now;
+
+    PERFORM cancel_descendants(in_task_ids, TRUE);
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will return the cancelled tasks a session still holds
+CREATE OR REPLACE FUNCTION get_cancelled_tasks(in_session_id session.id%TYPE)
+RETURNS SETOF BIGINT
+AS $$
+BEGIN
+    RETURN QUERY(
+        SELECT id
+        FROM task
+        WHERE session_id = in_session_id
+        AND status = 'cancelled'
+        AND lease_expires >= now() at TIME ZONE 'utc'
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will move tasks to the dead letter table so they are never picked up again
+CREATE OR REPLACE FUNCTION fail_tasks(in_task_ids BIGINT[], in_errors TEXT[])
+RETURNS VOID
+AS $$
+DECLARE
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    PERFORM dead_letter_task(t.id::TEXT, t.session_id, t.attempts + 1, f.error, t.error_history || f.error, to_jsonb(t))
+    FROM task t
+    JOIN unnest(in_task_ids, in_errors) AS f(id, error) ON t.id = f.id
+    WHERE t.status = 'pending';
+
+    UPDATE task t
+    SET status = 'dead'
+      , attempts = t.attempts + 1
+      , last_error = f.error
+      , error_history = t.error_history || f.error
+      , updated = v_now
+    FROM unnest(in_task_ids, in_errors) AS f(id, error)
+    WHERE t.id = f.id
+    AND t.status = 'pending';
+
+    PERFORM cancel_descendants(in_task_ids, TRUE);
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will cancel the pending tasks that can no longer run because a parent in in_task_ids died.
+-- If in_children_only is false the tasks in in_task_ids are cancelled too.
+-- Cancelling follows the graph down through every task that cancels on parent failure.
+CREATE OR REPLACE FUNCTION cancel_descendants(in_task_ids BIGINT[], in_children_only BOOLEAN)
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    WITH RECURSIVE doomed(id, is_root) AS (
+        SELECT unnest(in_task_ids), TRUE
+      UNION
+        SELECT d.task_id, FALSE
+        FROM doomed p
+        JOIN task_dependency d ON d.parent_id = p.id
+        JOIN task c ON c.id = d.task_id
+        WHERE c.on_parent_failure = 'cancel'
+        AND c.status = 'pending'
+    )
+    UPDATE task t
+    SET status = 'cancelled'
+      , session_id = NULL
+      , lease_expires = NULL
+      , last_error = 'parent task failed'
+      , updated = v_now
+    FROM doomed
+    WHERE t.id = doomed.id
+    AND (NOT doomed.is_root OR NOT in_children_only)
+    AND t.status = 'pending';
+    GET DIAGNOSTICS v_ret = ROW_COUNT;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will release tasks back to the pool so they are picked up again once in_not_befores has passed.
+-- A task whose attempts reach in_max_attempts at the same index is failed instead, 0 means no limit.
+-- Attempts are counted from the attempts column so the limit holds whether or not the Task reports its attempts.
+CREATE OR REPLACE FUNCTION retry_tasks(in_task_ids BIGINT[], in_errors TEXT[], in_not_befores TIMESTAMP[], in_max_attempts INTEGER[])
+RETURNS VOID
+AS $$
+DECLARE
+    v_now           TIMESTAMP = now() at TIME ZONE 'utc';
+    v_failed_ids    BIGINT[];
+    v_failed_errors TEXT[];
+BEGIN
+    SELECT array_agg(t.id), array_agg(format('gave up after %s attempts: %s', t.attempts + 1, r.error))
+    FROM task t
+    JOIN unnest(in_task_ids, in_errors, in_max_attempts) AS r(id, error, max_attempts) ON t.id = r.id
+    WHERE t.status = 'pending'
+    AND r.max_attempts > 0
+    AND t.attempts + 1 >= r.max_attempts
+    INTO v_failed_ids, v_failed_errors;
+
+    IF v_failed_ids IS NOT NULL THEN
+        PERFORM fail_tasks(v_failed_ids, v_failed_errors);
+    END IF;
+
+    UPDATE task t
+    SET session_id = NULL
+      , lease_expires = NULL
+      , not_before = r.not_before
+      , attempts = t.attempts + 1
+      , last_error = r.error
+      , error_history = t.error_history || r.error
+      , updated = v_now
+    FROM unnest(in_task_ids, in_errors, in_not_befores) AS r(id, error, not_before)
+    WHERE t.id = r.id
+    AND t.status = 'pending';
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will give tasks back to the pool without counting an attempt so any session can pick them up once in_not_befores has passed.
+-- A lock.Mux releases tasks of a type it has no handler for.
+CREATE OR REPLACE FUNCTION release_tasks(in_task_ids BIGINT[], in_not_befores TIMESTAMP[])
+RETURNS VOID
+AS $$
+DECLARE
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    UPDATE task t
+    SET session_id = NULL
+      , lease_expires = NULL
+      , not_before = r.not_before
+      , updated = v_now
+    FROM unnest(in_task_ids, in_not_befores) AS r(id, not_before)
+    WHERE t.id = r.id
+    AND t.status = 'pending';
+END;
+$$ LANGUAGE plpgsql;
+
+-- This will put dead lettered tasks back in the pool and return how many were requeued
+CREATE OR REPLACE FUNCTION requeue_dead_tasks(in_ids BIGINT[]
+                                              , in_task_ids TEXT[]
+                                              , in_error_contains TEXT
+                                              , in_died_after TIMESTAMP
+                                              , in_died_before TIMESTAMP
+                                              , in_limit INTEGER)
+RETURNS INTEGER
+AS $$
+DECLARE
+    v_ret INTEGER;
+    v_now TIMESTAMP = now() at TIME ZONE 'utc';
+BEGIN
+    UPDATE task t
+    SET status = 'pending'
+      , session_id = NULL
+      , lease_expires = NULL
+      , not_before = NULL
+      , attempts = 0
+      , dedupe_key = NULL -- a task enqueued with the same key since the task died would break task_dedupe_idx
+      , updated = v_now
+    FROM take_dead_tasks(in_ids, in_task_ids, in_error_contains, in_died_after, in_died_before, in_limit) d
+    WHERE t.id = d.task_id::BIGINT;
+    GET DIAGNOSTICS v_ret = ROW_COUNT;
+
+    RETURN v_ret;
+END;
+$$ LANGUAGE plpgsql;
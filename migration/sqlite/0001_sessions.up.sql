@@ -0,0 +1,33 @@
+---
+-- This file provides the schema for the SQLite implementation of the session locking package in lock/sqlitedb.
+-- SQLite has no plpgsql so the logic of the functions in 1001_sessions.alwaysup.sql lives in Go.
+-- Every time is stored as unix milliseconds in UTC.
+---
+
+-- session holds information about services connected to the db.
+-- Each service will start a session when they connect and update the expires timestamp
+-- in a keep alive loop.  Once a session expires its work will be given to another session.
+-- There is no work_lock table, get_work takes SQLite's write lock with BEGIN IMMEDIATE instead.
+CREATE TABLE session (
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+    created             INTEGER NOT NULL,
+    expires             INTEGER NOT NULL
+);
+
+-- task holds every task of every queue.  The payload holds whatever the Tasker for the queue needs to do the task.
+CREATE TABLE task (
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+    queue               TEXT NOT NULL DEFAULT '',
+    task_type           TEXT NOT NULL DEFAULT '',
+    payload             BLOB NOT NULL,
+    status              TEXT NOT NULL DEFAULT 'pending', -- pending or finished
+    created             INTEGER NOT NULL,
+    updated             INTEGER NOT NULL,
+    finished            INTEGER NULL,
+    session_id          INTEGER NULL,
+    lease_expires       INTEGER NULL,
+    not_before          INTEGER NULL, -- NULL means the task can run right away
+    attempts            INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX task_idx1 ON task(not_before) WHERE status = 'pending';
+CREATE INDEX task_idx2 ON task(session_id) WHERE status = 'pending';
@@ -0,0 +1,103 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// pagedDB also implements PagedWorkGetter over the tasks its session holds, which are ordered by id, and records every page it reads
+type pagedDB struct {
+	baseDB
+	pages []string
+}
+
+func (d *pagedDB) GetWorkPage(ctx context.Context, sessionID int64, tasksPerSession int64, batchSize int64, afterID string, scanTask ScanTask) ([]Task, glitch.DataError) {
+	d.pages = append(d.pages, afterID)
+	var page []Task
+	for _, task := range d.tasks {
+		if task.GetID() > afterID && int64(len(page)) < batchSize {
+			page = append(page, task)
+		}
+	}
+	return page, nil
+}
+
+func newBatchTasks(n int) []Task {
+	tasks := make([]Task, n)
+	for i := range tasks {
+		tasks[i] = &testTask{id: string(rune('a' + i))}
+	}
+	return tasks
+}
+
+func TestDoWorkInBatches(t *testing.T) {
+	db := &baseDB{tasks: newBatchTasks(5)}
+	var batches []string
+	r := NewRunner(func() (Database, error) { return db, nil }, nil, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		ids := make([]string, len(tasks))
+		for i, task := range tasks {
+			ids[i] = task.GetID()
+		}
+		batches = append(batches, strings.Join(ids, ""))
+		return tasks, nil
+	}, time.Second, 10, nil, "test", noopClient{}, WithBatchSize(2))
+	r.sessionID = 1
+
+	handled, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if got := strings.Join(batches, ","); got != "ab,cd,e" {
+		t.Errorf("Worked batches %s, want ab,cd,e", got)
+	}
+	if len(handled) != 5 {
+		t.Errorf("Handled %d tasks, want 5", len(handled))
+	}
+}
+
+func TestDoWorkStopsAfterFailedBatch(t *testing.T) {
+	db := &baseDB{tasks: newBatchTasks(4)}
+	calls := 0
+	r := NewRunner(func() (Database, error) { return db, nil }, nil, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		calls++
+		return tasks, errors.New("lost the connection")
+	}, time.Second, 10, nil, "test", noopClient{}, WithBatchSize(2))
+	r.sessionID = 1
+
+	_, err := r.doWork(context.Background())
+	if err == nil || calls != 1 {
+		t.Errorf("Got error %v after %d batches, want the error of the first batch", err, calls)
+	}
+	// the outcomes of the failed batch are still recorded
+	if got := strings.Join(db.finishedIDs(), ","); got != "a,b" {
+		t.Errorf("Finished %s, want a,b", got)
+	}
+}
+
+func TestDoWorkReadsPages(t *testing.T) {
+	db := &pagedDB{baseDB: baseDB{tasks: newBatchTasks(5)}}
+	var batches []int
+	r := NewRunner(func() (Database, error) { return db, nil }, nil, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		batches = append(batches, len(tasks))
+		// the first task of each batch is skipped and stays with the session
+		return tasks[1:], nil
+	}, time.Second, 10, nil, "test", noopClient{}, WithBatchSize(2))
+	r.sessionID = 1
+
+	handled, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	// each page starts after the last task of the one before, so the skipped tasks do not hide the rest, and a short page is the last
+	if got := strings.Join(db.pages, ","); got != ",b,d" {
+		t.Errorf("Read pages after %q, want after nothing, b and d", got)
+	}
+	if len(batches) != 3 || batches[2] != 1 || len(handled) != 2 {
+		t.Errorf("Worked batches %v and handled %d tasks, want [2 2 1] and 2", batches, len(handled))
+	}
+}
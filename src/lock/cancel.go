@@ -0,0 +1,155 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// DefaultCancelPollInterval is how often a Runner checks for cancelled tasks while its Tasker runs
+const DefaultCancelPollInterval = 5 * time.Second
+
+// TaskCanceller can be implemented by a Database to cancel tasks.
+// CancelTasks should call the cancel_tasks plpgsql function, which flags pending tasks as cancelled so they are never picked up again,
+// and return how many were cancelled.  GetCancelledTasks should call the get_cancelled_tasks plpgsql function, which returns the
+// cancelled tasks a session still holds.  A Runner polls it while its Tasker runs and cancels the context of each cancelled task.
+type TaskCanceller interface {
+	CancelTasks(ctx context.Context, taskIDs []string) (int64, glitch.DataError)
+	GetCancelledTasks(ctx context.Context, sessionID int64) ([]string, glitch.DataError)
+}
+
+// CancelNotifier can be implemented by a Database along with TaskCanceller so a Runner hears about cancellations
+// sooner than its poll interval, for example by listening on the task_cancelled channel notified by cancel_tasks.
+// WaitForCancellations should block until tasks are cancelled and return their ids, or return once ctx is done.
+type CancelNotifier interface {
+	WaitForCancellations(ctx context.Context) ([]string, glitch.DataError)
+}
+
+// CancelTask will cancel the task with taskID and return true if it was still pending
+func CancelTask(ctx context.Context, db TaskCanceller, taskID string) (bool, glitch.DataError) {
+	count, dbErr := db.CancelTasks(ctx, []string{taskID})
+	return count > 0, dbErr
+}
+
+// TaskContext returns the context for task, which is cancelled if the task is cancelled while the Tasker runs.
+// ctx must be the context handed to the Tasker by the Runner.  ctx itself is returned if the Database does not implement TaskCanceller.
+func TaskContext(ctx context.Context, task Task) context.Context {
+	rc, ok := runContextFrom(ctx)
+	if !ok || rc.taskContexts == nil {
+		return ctx
+	}
+	taskCtx, ok := rc.taskContexts[task.GetID()]
+	if !ok {
+		return ctx
+	}
+	return taskCtx
+}
+
+// cancelWatch cancels the contexts of tasks that are cancelled while the Tasker runs
+type cancelWatch struct {
+	mutex     sync.Mutex
+	cancels   map[string]context.CancelFunc
+	cancelled map[string]bool
+	stopWatch context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// watchCancellations adds a context per task to rc and watches for the tasks to be cancelled until stop is called on the returned cancelWatch.
+// The context of an ExpiringTask has its expiry as the deadline.
+// It returns nil if db does not implement TaskCanceller and no task expires.
+func (r *TypedRunner[T]) watchCancellations(ctx context.Context, db Database, rc *runContext, tasks []T) *cancelWatch {
+	tc, ok := db.(TaskCanceller)
+	if len(tasks) == 0 || (!ok && !anyExpiring(tasks)) {
+		return nil
+	}
+	w := &cancelWatch{
+		cancels:   make(map[string]context.CancelFunc, len(tasks)),
+		cancelled: make(map[string]bool),
+	}
+	rc.taskContexts = make(map[string]context.Context, len(tasks))
+	for _, task := range tasks {
+		id := task.GetID()
+		exp := expiresAt(task)
+		if exp.IsZero() {
+			rc.taskContexts[id], w.cancels[id] = context.WithCancel(ctx)
+		} else {
+			rc.taskContexts[id], w.cancels[id] = context.WithDeadline(ctx, exp)
+		}
+	}
+
+	var watchCtx context.Context
+	watchCtx, w.stopWatch = context.WithCancel(ctx)
+	if !ok {
+		return w
+	}
+	if r.cancelPollInterval > 0 {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			ticker := time.NewTicker(r.cancelPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-watchCtx.Done():
+					return
+				case <-ticker.C:
+					ids, dbErr := tc.GetCancelledTasks(watchCtx, rc.sessionID)
+					if dbErr != nil {
+						if watchCtx.Err() == nil {
+							r.logger.Printf("Error getting cancelled tasks: %v", dbErr)
+						}
+						continue
+					}
+					w.cancel(ids)
+				}
+			}
+		}()
+	}
+	if cn, ok := db.(CancelNotifier); ok {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for {
+				ids, dbErr := cn.WaitForCancellations(watchCtx)
+				if watchCtx.Err() != nil {
+					return
+				}
+				if dbErr != nil {
+					// fall back to polling
+					r.logger.Printf("Error waiting for cancelled tasks: %v", dbErr)
+					return
+				}
+				w.cancel(ids)
+			}
+		}()
+	}
+	return w
+}
+
+// cancel cancels the contexts of the tasks with ids that are being worked
+func (w *cancelWatch) cancel(ids []string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, id := range ids {
+		cancel, ok := w.cancels[id]
+		if ok {
+			cancel()
+			w.cancelled[id] = true
+		}
+	}
+}
+
+// stop stops watching, releases every task context and returns the ids of the tasks that were cancelled
+func (w *cancelWatch) stop() map[string]bool {
+	if w == nil {
+		return nil
+	}
+	w.stopWatch()
+	w.wg.Wait()
+	for _, cancel := range w.cancels {
+		cancel()
+	}
+	return w.cancelled
+}
@@ -0,0 +1,112 @@
+package lock
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// cancelDB also implements TaskCanceller.  Its session holds the tasks in cancelled.
+type cancelDB struct {
+	baseDB
+	cancelled []string
+}
+
+func (d *cancelDB) CancelTasks(ctx context.Context, taskIDs []string) (int64, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.cancelled = append(d.cancelled, taskIDs...)
+	return int64(len(taskIDs)), nil
+}
+
+func (d *cancelDB) GetCancelledTasks(ctx context.Context, sessionID int64) ([]string, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.cancelled...), nil
+}
+
+// notifyDB also implements CancelNotifier and never polls
+type notifyDB struct {
+	cancelDB
+	notify chan []string
+}
+
+func (d *notifyDB) GetCancelledTasks(ctx context.Context, sessionID int64) ([]string, glitch.DataError) {
+	return nil, nil
+}
+
+func (d *notifyDB) WaitForCancellations(ctx context.Context) ([]string, glitch.DataError) {
+	select {
+	case ids := <-d.notify:
+		return ids, nil
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+// cancellingTasker cancels task 2 with cancel and waits for its TaskContext to be done.  Every task succeeds.
+func cancellingTasker(t *testing.T, cancel func()) Tasker {
+	return func(ctx context.Context, tasks []Task) ([]Task, error) {
+		for _, task := range tasks {
+			if task.GetID() != "2" {
+				continue
+			}
+			cancel()
+			select {
+			case <-TaskContext(ctx, task).Done():
+			case <-time.After(5 * time.Second):
+				t.Errorf("The context of task 2 was not cancelled")
+			}
+			if TaskContext(ctx, tasks[0]).Err() != nil {
+				t.Errorf("The context of task 1 was cancelled along with task 2")
+			}
+		}
+		return tasks, nil
+	}
+}
+
+func TestCancelPolled(t *testing.T) {
+	db := &cancelDB{baseDB: baseDB{tasks: []Task{&testTask{id: "1"}, &testTask{id: "2"}}}}
+	r := NewRunner(func() (Database, error) { return db, nil }, nil, cancellingTasker(t, func() {
+		CancelTask(context.Background(), db, "2")
+	}), time.Second, 10, nil, "test", noopClient{}, WithCancelPollInterval(time.Millisecond))
+	r.sessionID = 1
+
+	handled, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	// the cancelled task is already out of the pool so it is not finished
+	if got := strings.Join(taskIDs(handled), ","); got != "1" {
+		t.Errorf("Handled %s, want 1", got)
+	}
+	if got := strings.Join(db.finishedIDs(), ","); got != "1" {
+		t.Errorf("Finished %s, want 1", got)
+	}
+}
+
+func TestCancelNotified(t *testing.T) {
+	db := &notifyDB{cancelDB: cancelDB{baseDB: baseDB{tasks: []Task{&testTask{id: "1"}, &testTask{id: "2"}}}}, notify: make(chan []string, 1)}
+	r := NewRunner(func() (Database, error) { return db, nil }, nil, cancellingTasker(t, func() {
+		db.notify <- []string{"2"}
+	}), time.Second, 10, nil, "test", noopClient{}, WithCancelPollInterval(0))
+	r.sessionID = 1
+
+	_, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if got := strings.Join(db.finishedIDs(), ","); got != "1" {
+		t.Errorf("Finished %s, want 1", got)
+	}
+}
+
+func TestTaskContextWithoutCanceller(t *testing.T) {
+	ctx := context.Background()
+	if got := TaskContext(ctx, &testTask{id: "1"}); got != ctx {
+		t.Errorf("TaskContext outside a Tasker returned a new context, want ctx")
+	}
+}
@@ -0,0 +1,53 @@
+package lock
+
+import (
+	"context"
+	"errors"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// Checkpoint errors
+var (
+	ErrCheckpointsNotSupported = errors.New("database does not support checkpoints")
+)
+
+// Checkpointer can be implemented by a Database to save the progress of a task.
+// SaveCheckpoint should call the save_checkpoint plpgsql function, which fails with SL002 if the session no longer holds the task.
+// get_tasks_for_session should return the saved state with the task so the next session can resume from it.
+type Checkpointer interface {
+	SaveCheckpoint(ctx context.Context, sessionID int64, taskID string, state []byte) glitch.DataError
+}
+
+// CheckpointedTask can be implemented by a Task that carries the last checkpoint saved for it
+type CheckpointedTask interface {
+	GetCheckpoint() []byte
+}
+
+// SaveCheckpoint will save state as the checkpoint of task.
+// ctx must be the context handed to the Tasker by the Runner.  If the task is picked up again,
+// for example because this session expired, the Tasker gets state back from LoadCheckpoint.
+func SaveCheckpoint(ctx context.Context, task Task, state []byte) error {
+	rc, ok := runContextFrom(ctx)
+	if !ok {
+		return ErrNotInTasker
+	}
+	cp, ok := rc.db.(Checkpointer)
+	if !ok {
+		return ErrCheckpointsNotSupported
+	}
+	dbErr := cp.SaveCheckpoint(ctx, rc.sessionID, task.GetID(), state)
+	if dbErr != nil {
+		return dbErr
+	}
+	return nil
+}
+
+// LoadCheckpoint returns the last checkpoint saved for task, or nil if there is none or the task does not implement CheckpointedTask
+func LoadCheckpoint(task Task) []byte {
+	ct, ok := task.(CheckpointedTask)
+	if !ok {
+		return nil
+	}
+	return ct.GetCheckpoint()
+}
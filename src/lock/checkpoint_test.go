@@ -0,0 +1,74 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// checkpointDB also implements Checkpointer and holds every task but "lost"
+type checkpointDB struct {
+	baseDB
+	saved map[string][]byte
+}
+
+func (d *checkpointDB) SaveCheckpoint(ctx context.Context, sessionID int64, taskID string, state []byte) glitch.DataError {
+	if taskID == "lost" || sessionID != 1 {
+		return glitch.NewDataError(errors.New("Lease not found."), SQLErrorLeaseNotFound, "Error saving checkpoint")
+	}
+	d.saved[taskID] = state
+	return nil
+}
+
+func TestSaveCheckpoint(t *testing.T) {
+	db := &checkpointDB{baseDB: baseDB{tasks: []Task{&testTask{id: "1"}, &testTask{id: "lost"}}}, saved: make(map[string][]byte)}
+	var errs []error
+	r := newTestRunner(db, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		for _, task := range tasks {
+			errs = append(errs, SaveCheckpoint(ctx, task, []byte("page 2")))
+		}
+		return nil, nil
+	})
+
+	_, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if errs[0] != nil || string(db.saved["1"]) != "page 2" {
+		t.Errorf("Saving the checkpoint of task 1 returned %v and saved %q, want page 2", errs[0], db.saved["1"])
+	}
+	var dbErr glitch.DataError
+	if !errors.As(errs[1], &dbErr) || dbErr.Code() != SQLErrorLeaseNotFound {
+		t.Errorf("Saving the checkpoint of a lost task returned %v, want %s", errs[1], SQLErrorLeaseNotFound)
+	}
+}
+
+func TestSaveCheckpointErrors(t *testing.T) {
+	task := &testTask{id: "1"}
+	var err error
+	r := newTestRunner(&baseDB{tasks: []Task{task}}, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		err = SaveCheckpoint(ctx, tasks[0], nil)
+		return nil, nil
+	})
+	_, workErr := r.doWork(context.Background())
+	if workErr != nil {
+		t.Fatalf("Error doing work: %v", workErr)
+	}
+	if err != ErrCheckpointsNotSupported {
+		t.Errorf("SaveCheckpoint on a Database without checkpoints returned %v, want %v", err, ErrCheckpointsNotSupported)
+	}
+	if err := SaveCheckpoint(context.Background(), task, nil); err != ErrNotInTasker {
+		t.Errorf("SaveCheckpoint outside a Tasker returned %v, want %v", err, ErrNotInTasker)
+	}
+}
+
+func TestLoadCheckpoint(t *testing.T) {
+	if cp := LoadCheckpoint(&QueueTask{Checkpoint: []byte("page 2")}); string(cp) != "page 2" {
+		t.Errorf("Loaded %q, want page 2", cp)
+	}
+	if cp := LoadCheckpoint(&testTask{id: "1"}); cp != nil {
+		t.Errorf("Loaded %q from a task without checkpoints, want nil", cp)
+	}
+}
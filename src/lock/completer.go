@@ -0,0 +1,185 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Completion flushing defaults
+const (
+	DefaultCompletionBatchSize     = 50
+	DefaultCompletionFlushInterval = time.Second
+)
+
+// Completer lets a Tasker report each task as it finishes.  The Runner flushes completed tasks to FinishTasks in small batches
+// or on a timer while the Tasker is still running, so a crash part way through a batch does not redo the tasks already done.
+// A nil Completer does nothing, so a Tasker can use one outside a Runner.
+type Completer struct {
+	mutex     sync.Mutex
+	db        Database
+	batchSize int
+	logger    Logger
+	pending   []completion
+	flushed   map[string]Task
+	full      chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// completion is a task reported to a Completer
+type completion struct {
+	task   Task
+	result []byte
+}
+
+// CompleterFrom returns the Completer of the Runner that handed ctx to the Tasker, or nil if ctx was not provided by a Runner
+func CompleterFrom(ctx context.Context) *Completer {
+	rc, ok := runContextFrom(ctx)
+	if !ok {
+		return nil
+	}
+	return rc.completer
+}
+
+// Complete flags tasks as succeeded.  They are finished with the next flush.
+func (c *Completer) Complete(tasks ...Task) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	for _, task := range tasks {
+		c.pending = append(c.pending, completion{task: task})
+	}
+	c.signal()
+	c.mutex.Unlock()
+}
+
+// CompleteWithResult flags task as succeeded and stores result with it if the Database implements ResultFinisher
+func (c *Completer) CompleteWithResult(task Task, result []byte) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.pending = append(c.pending, completion{task: task, result: result})
+	c.signal()
+	c.mutex.Unlock()
+}
+
+// signal wakes up the flush loop once a batch is ready, the mutex must be held
+func (c *Completer) signal() {
+	if len(c.pending) < c.batchSize {
+		return
+	}
+	select {
+	case c.full <- struct{}{}:
+	default:
+	}
+}
+
+// startCompleter starts flushing completed tasks to db until stop is called on the returned Completer
+func (r *TypedRunner[T]) startCompleter(ctx context.Context, db Database) *Completer {
+	c := &Completer{
+		db:        db,
+		batchSize: r.completionBatchSize,
+		logger:    r.logger,
+		flushed:   make(map[string]Task),
+		full:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if c.batchSize < 1 {
+		c.batchSize = 1
+	}
+	interval := r.completionFlushInterval
+	if interval <= 0 {
+		interval = DefaultCompletionFlushInterval
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			case <-c.full:
+			}
+			err := c.flush(ctx)
+			if err != nil {
+				c.logger.Printf("Error flushing completed tasks: %v", err)
+			}
+		}
+	}()
+	return c
+}
+
+// flush finishes the pending completions.  They stay pending if finishing fails.
+func (c *Completer) flush(ctx context.Context) error {
+	c.mutex.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.mutex.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	finished := make([]FinishedTask, len(batch))
+	for i, comp := range batch {
+		finished[i] = FinishedTask{TaskID: comp.task.GetID(), Result: comp.result}
+	}
+	dbErr := finishTasks(ctx, c.db, finished)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if dbErr != nil {
+		c.pending = append(batch, c.pending...)
+		return dbErr
+	}
+	for _, comp := range batch {
+		c.flushed[comp.task.GetID()] = comp.task
+	}
+	return nil
+}
+
+// stop stops the flush loop, flushes what is left and returns the tasks that were finished
+// along with the completions that could not be
+func (c *Completer) stop(ctx context.Context) (map[string]Task, []completion) {
+	close(c.done)
+	c.wg.Wait()
+	err := c.flush(ctx)
+	if err != nil {
+		c.logger.Printf("Error flushing completed tasks: %v", err)
+	}
+	return c.flushed, c.pending
+}
+
+// mergeCompletions drops the results of tasks that were already finished by the Completer and adds a succeeded result
+// for tasks it could not finish so they are finished with the rest.  It returns the merged results and the finished tasks.
+func mergeCompletions[T Task](results []TypedTaskResult[T], flushed map[string]Task, unflushed []completion) ([]TypedTaskResult[T], []T) {
+	finished := make([]T, 0, len(flushed))
+	ids := make(map[string]bool, len(flushed)+len(unflushed))
+	for id, task := range flushed {
+		ids[id] = true
+		if t, ok := task.(T); ok {
+			finished = append(finished, t)
+		}
+	}
+	merged := withoutTasks(results, ids)
+	if len(unflushed) == 0 {
+		return merged, finished
+	}
+
+	// a completion wins over whatever the Tasker returned for the same task
+	for _, comp := range unflushed {
+		ids[comp.task.GetID()] = true
+	}
+	merged = withoutTasks(merged, ids)
+	for _, comp := range unflushed {
+		if t, ok := comp.task.(T); ok {
+			merged = append(merged, TypedTaskResult[T]{Task: t, Status: TaskSucceeded, Result: comp.result})
+		}
+	}
+	return merged, finished
+}
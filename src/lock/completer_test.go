@@ -0,0 +1,118 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// flakyDB fails the first fails calls to FinishTasks
+type flakyDB struct {
+	baseDB
+	fails int
+}
+
+func (d *flakyDB) FinishTasks(ctx context.Context, taskIDs []string) glitch.DataError {
+	d.mutex.Lock()
+	if d.fails > 0 {
+		d.fails--
+		d.mutex.Unlock()
+		return glitch.NewDataError(errors.New("connection reset"), "ERROR", "Error finishing tasks")
+	}
+	d.mutex.Unlock()
+	return d.baseDB.FinishTasks(ctx, taskIDs)
+}
+
+// waitFinished waits for db to have finished want
+func waitFinished(t *testing.T, db *baseDB, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		db.mutex.Lock()
+		got := strings.Join(db.finished, ",")
+		db.mutex.Unlock()
+		if got == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Task %s was not finished while the Tasker ran", want)
+}
+
+func TestCompleterFlushesWhileRunning(t *testing.T) {
+	db := &baseDB{tasks: []Task{&testTask{id: "1"}, &testTask{id: "2"}}}
+	r := NewRunner(func() (Database, error) { return db, nil }, nil, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		CompleterFrom(ctx).Complete(tasks[0])
+		waitFinished(t, db, "1")
+		return tasks, nil
+	}, time.Second, 10, nil, "test", noopClient{}, WithCompletionFlush(1, time.Hour))
+	r.sessionID = 1
+
+	handled, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	// task 1 was returned by the Tasker as well but is only finished once
+	if got := strings.Join(db.finishedIDs(), ","); got != "1,2" {
+		t.Errorf("Finished %s, want 1,2", got)
+	}
+	if got := strings.Join(taskIDs(handled), ","); got != "1,2" {
+		t.Errorf("Handled %s, want 1,2", got)
+	}
+}
+
+func TestCompleterKeepsFailedFlushes(t *testing.T) {
+	db := &flakyDB{baseDB: baseDB{tasks: []Task{&testTask{id: "1"}, &testTask{id: "2"}}}, fails: 1}
+	r := NewRunner(func() (Database, error) { return db, nil }, nil, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		// the Tasker forgets to return task 1, the completion still finishes it
+		CompleterFrom(ctx).Complete(tasks[0])
+		return tasks[1:], nil
+	}, time.Second, 10, nil, "test", noopClient{}, WithCompletionFlush(10, time.Hour))
+	r.sessionID = 1
+
+	_, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if got := strings.Join(db.finishedIDs(), ","); got != "1,2" {
+		t.Errorf("Finished %s, want the completion that failed to flush finished with the rest", got)
+	}
+}
+
+func TestNilCompleter(t *testing.T) {
+	c := CompleterFrom(context.Background())
+	if c != nil {
+		t.Fatalf("Got a Completer outside a Runner")
+	}
+	c.Complete(&testTask{id: "1"})
+	c.CompleteWithResult(&testTask{id: "1"}, nil)
+}
+
+func TestMergeCompletions(t *testing.T) {
+	flushedTask := &testTask{id: "flushed"}
+	unflushedTask := &testTask{id: "unflushed"}
+	results := []TaskResult{
+		{Task: flushedTask, Status: TaskRetry},
+		{Task: unflushedTask, Status: TaskFailed},
+		{Task: &testTask{id: "returned"}, Status: TaskRetry},
+	}
+
+	merged, finished := mergeCompletions(results, map[string]Task{"flushed": flushedTask}, []completion{{task: unflushedTask, result: []byte(`1`)}})
+
+	if got := strings.Join(taskIDs(finished), ","); got != "flushed" {
+		t.Errorf("Finished %s, want flushed", got)
+	}
+	if len(merged) != 2 {
+		t.Fatalf("Merged %+v, want returned and unflushed", merged)
+	}
+	if merged[0].Task.GetID() != "returned" || merged[0].Status != TaskRetry {
+		t.Errorf("Merged %+v first, want the Tasker's result for returned", merged[0])
+	}
+	if merged[1].Task.GetID() != "unflushed" || merged[1].Status != TaskSucceeded || string(merged[1].Result) != `1` {
+		t.Errorf("Merged %+v second, want unflushed succeeded with the completion's result", merged[1])
+	}
+}
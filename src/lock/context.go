@@ -0,0 +1,43 @@
+package lock
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	runContextKey contextKey = iota
+	taskTypesKey
+)
+
+// runContext is attached to the context handed to a Tasker so helpers called from inside the Tasker
+// can reach the session that owns the tasks.
+type runContext struct {
+	db        Database
+	sessionID int64
+	// taskContexts holds a context per task that is cancelled when the task is cancelled, nil if cancellation is not supported
+	taskContexts map[string]context.Context
+	// completer collects tasks the Tasker reports as they finish
+	completer *Completer
+}
+
+func withRunContext(ctx context.Context, rc *runContext) context.Context {
+	return context.WithValue(ctx, runContextKey, rc)
+}
+
+func runContextFrom(ctx context.Context) (*runContext, bool) {
+	rc, ok := ctx.Value(runContextKey).(*runContext)
+	return rc, ok
+}
+
+func withTaskTypes(ctx context.Context, types []string) context.Context {
+	return context.WithValue(ctx, taskTypesKey, types)
+}
+
+// TaskTypesFrom returns the task types a Runner with WithTaskTypes can work, nil if it works every type.
+// A Database reads it from the context handed to GetWork and passes it to get_queue_work as in_task_types.
+func TaskTypesFrom(ctx context.Context) []string {
+	types, _ := ctx.Value(taskTypesKey).([]string)
+	return types
+}
@@ -0,0 +1,74 @@
+package lock
+
+import (
+	"testing"
+	"time"
+
+	_ "time/tzdata"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("Error loading location %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestCronNext(t *testing.T) {
+	utc := time.UTC
+	newYork := mustLoad(t, "America/New_York")
+	kolkata := mustLoad(t, "Asia/Kolkata")
+	lordHowe := mustLoad(t, "Australia/Lord_Howe")
+
+	tests := []struct {
+		name string
+		expr string
+		loc  *time.Location
+		from time.Time
+		want time.Time
+	}{
+		{"every 15 minutes", "*/15 * * * *", utc, time.Date(2024, 1, 1, 10, 7, 30, 0, utc), time.Date(2024, 1, 1, 10, 15, 0, 0, utc)},
+		{"strictly after", "*/15 * * * *", utc, time.Date(2024, 1, 1, 10, 15, 0, 0, utc), time.Date(2024, 1, 1, 10, 30, 0, 0, utc)},
+		{"hourly", "@hourly", utc, time.Date(2024, 1, 1, 10, 0, 1, 0, utc), time.Date(2024, 1, 1, 11, 0, 0, 0, utc)},
+		{"day of week", "0 9 * * mon", utc, time.Date(2024, 1, 7, 12, 0, 0, 0, utc), time.Date(2024, 1, 8, 9, 0, 0, 0, utc)},
+		{"sunday as 7", "0 0 * * 7", utc, time.Date(2024, 1, 6, 12, 0, 0, 0, utc), time.Date(2024, 1, 7, 0, 0, 0, 0, utc)},
+		{"yearly", "@yearly", utc, time.Date(2024, 6, 1, 0, 0, 0, 0, utc), time.Date(2025, 1, 1, 0, 0, 0, 0, utc)},
+		{"day of month or day of week", "0 0 13 * fri", utc, time.Date(2024, 9, 1, 0, 0, 0, 0, utc), time.Date(2024, 9, 6, 0, 0, 0, 0, utc)},
+		{"ranges and lists", "0 8-10,14 * * *", utc, time.Date(2024, 1, 1, 10, 30, 0, 0, utc), time.Date(2024, 1, 1, 14, 0, 0, 0, utc)},
+		{"leap day", "0 0 29 2 *", utc, time.Date(2024, 3, 1, 0, 0, 0, 0, utc), time.Date(2028, 2, 29, 0, 0, 0, 0, utc)},
+		{"never", "0 0 30 2 *", utc, time.Date(2024, 1, 1, 0, 0, 0, 0, utc), time.Time{}},
+		{"evaluated in location", "0 9 * * *", newYork, time.Date(2024, 1, 1, 15, 0, 0, 0, utc), time.Date(2024, 1, 2, 9, 0, 0, 0, newYork)},
+		{"skipped by spring forward", "30 2 * * *", newYork, time.Date(2024, 3, 10, 0, 0, 0, 0, newYork), time.Date(2024, 3, 11, 2, 30, 0, 0, newYork)},
+		{"across spring forward", "0 * * * *", newYork, time.Date(2024, 3, 10, 1, 30, 0, 0, newYork), time.Date(2024, 3, 10, 7, 0, 0, 0, utc)},
+		{"across fall back", "0 3 * * *", newYork, time.Date(2024, 11, 3, 0, 30, 0, 0, newYork), time.Date(2024, 11, 3, 8, 0, 0, 0, utc)},
+		{"half hour offset", "0 * * * *", kolkata, time.Date(2024, 1, 1, 10, 15, 0, 0, kolkata), time.Date(2024, 1, 1, 11, 0, 0, 0, kolkata)},
+		{"half hour offset hours", "0 9,17 * * *", kolkata, time.Date(2024, 1, 1, 9, 30, 0, 0, kolkata), time.Date(2024, 1, 1, 17, 0, 0, 0, kolkata)},
+		{"half hour fall back", "0 5 * * *", lordHowe, time.Date(2024, 4, 7, 1, 0, 0, 0, lordHowe), time.Date(2024, 4, 7, 5, 0, 0, 0, lordHowe)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr, tt.loc)
+			if err != nil {
+				t.Fatalf("Error parsing %q: %v", tt.expr, err)
+			}
+			got := s.Next(tt.from)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+			if got.Second() != 0 || got.Nanosecond() != 0 {
+				t.Errorf("Next(%v) = %v is not on a minute", tt.from, got)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "@often"} {
+		_, err := parseCron(expr, nil)
+		if err == nil {
+			t.Errorf("parseCron(%q) did not return an error", expr)
+		}
+	}
+}
@@ -11,6 +11,14 @@ import (
 // SQL errors
 const (
 	SQLErrorSessionNotFound = "SL001"
+	SQLErrorLeaseNotFound   = "SL002"
+	SQLErrorParentNotFound  = "SL003"
+)
+
+// Error codes
+const (
+	ErrorScanningTask  = "ERROR_SCANNING_TASK"
+	ErrorInvalidTaskID = "ERROR_INVALID_TASK_ID"
 )
 
 // Database can make the PG calls necessary to use a session locked runner
@@ -22,6 +30,13 @@ type Database interface {
 	FinishTasks(ctx context.Context, taskIDs []string) glitch.DataError
 }
 
+// PagedWorkGetter can be implemented by a Database so a Runner with a batch size only reads one batch of its session's tasks at a time.
+// GetWorkPage should call the get_work plpgsql function that takes in_batch_size and in_after_id, and return the first batchSize tasks
+// ordered by id that come after the task with afterID.  An empty afterID starts from the first task and is the only page that picks up tasks.
+type PagedWorkGetter interface {
+	GetWorkPage(ctx context.Context, sessionID int64, tasksPerSession int64, batchSize int64, afterID string, scanTask ScanTask) ([]Task, glitch.DataError)
+}
+
 // Task is an interface that can GetID - This is meant to be implemented as a struct that holds all task info that
 // The Tasker needs to do the work associated with the task.
 type Task interface {
@@ -38,4 +53,7 @@ type Scanner interface {
 }
 
 // ScanTask can scan the data from Get work and store it in a struct.  That struct should be returned and will be added to the GetWork array.
-type ScanTask func(row Scanner) (Task, glitch.DataError)
+type ScanTask = TypedScanTask[Task]
+
+// TypedScanTask is a ScanTask that returns tasks of type T for a TypedRunner
+type TypedScanTask[T Task] func(row Scanner) (T, glitch.DataError)
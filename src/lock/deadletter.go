@@ -0,0 +1,68 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// DeadTask is a task that failed permanently or ran out of retries
+type DeadTask struct {
+	ID        int64
+	TaskID    string
+	SessionID int64
+	Attempts  int
+	// Error is the error of the final attempt
+	Error string
+	// ErrorHistory holds the error of every failed attempt, oldest first
+	ErrorHistory []string
+	// Task is a snapshot of the task row when it died
+	Task json.RawMessage
+	Died time.Time
+}
+
+// DeadTaskFilter selects dead lettered tasks.  Empty fields do not filter.
+type DeadTaskFilter struct {
+	IDs           []int64
+	TaskIDs       []string
+	ErrorContains string
+	DiedAfter     time.Time
+	DiedBefore    time.Time
+	// Limit caps how many tasks are selected, oldest first.  0 means no limit.
+	Limit int64
+}
+
+// DeadTaskByID returns a filter selecting a single dead lettered task
+func DeadTaskByID(id int64) DeadTaskFilter {
+	return DeadTaskFilter{IDs: []int64{id}}
+}
+
+// DeadLetterDatabase can be implemented by a Database to manage dead lettered tasks.
+// Each method calls the plpgsql function of the same name, passing NULL for empty filter fields.
+type DeadLetterDatabase interface {
+	GetDeadTasks(ctx context.Context, filter DeadTaskFilter) ([]DeadTask, glitch.DataError)
+	// RequeueDeadTasks puts matching tasks back in the pool with their attempts reset and returns how many were requeued
+	RequeueDeadTasks(ctx context.Context, filter DeadTaskFilter) (int64, glitch.DataError)
+	// PurgeDeadTasks deletes matching tasks from the dead letter table and returns how many were deleted
+	PurgeDeadTasks(ctx context.Context, filter DeadTaskFilter) (int64, glitch.DataError)
+}
+
+// GetDeadTask returns a single dead lettered task or nil if it does not exist
+func GetDeadTask(ctx context.Context, db DeadLetterDatabase, id int64) (*DeadTask, glitch.DataError) {
+	tasks, dbErr := db.GetDeadTasks(ctx, DeadTaskByID(id))
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+	return &tasks[0], nil
+}
+
+// RequeueDeadTask puts a single dead lettered task back in the pool
+func RequeueDeadTask(ctx context.Context, db DeadLetterDatabase, id int64) (bool, glitch.DataError) {
+	count, dbErr := db.RequeueDeadTasks(ctx, DeadTaskByID(id))
+	return count > 0, dbErr
+}
@@ -0,0 +1,72 @@
+package lock
+
+import (
+	"context"
+	"testing"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// deadLetterDB implements DeadLetterDatabase over a slice and records the last filter
+type deadLetterDB struct {
+	dead   []DeadTask
+	filter DeadTaskFilter
+}
+
+func (d *deadLetterDB) find(filter DeadTaskFilter) []DeadTask {
+	d.filter = filter
+	var found []DeadTask
+	for _, dead := range d.dead {
+		for _, id := range filter.IDs {
+			if dead.ID == id {
+				found = append(found, dead)
+			}
+		}
+	}
+	return found
+}
+
+func (d *deadLetterDB) GetDeadTasks(ctx context.Context, filter DeadTaskFilter) ([]DeadTask, glitch.DataError) {
+	return d.find(filter), nil
+}
+
+func (d *deadLetterDB) RequeueDeadTasks(ctx context.Context, filter DeadTaskFilter) (int64, glitch.DataError) {
+	return int64(len(d.find(filter))), nil
+}
+
+func (d *deadLetterDB) PurgeDeadTasks(ctx context.Context, filter DeadTaskFilter) (int64, glitch.DataError) {
+	return int64(len(d.find(filter))), nil
+}
+
+func TestGetDeadTask(t *testing.T) {
+	db := &deadLetterDB{dead: []DeadTask{{ID: 7, TaskID: "42", Error: "boom"}}}
+
+	dead, dbErr := GetDeadTask(context.Background(), db, 7)
+	if dbErr != nil {
+		t.Fatalf("Error getting dead task: %v", dbErr)
+	}
+	if dead == nil || dead.TaskID != "42" {
+		t.Errorf("Got dead task %+v, want task 42", dead)
+	}
+	if len(db.filter.IDs) != 1 || db.filter.TaskIDs != nil || db.filter.Limit != 0 {
+		t.Errorf("Filtered with %+v, want only the id", db.filter)
+	}
+
+	dead, dbErr = GetDeadTask(context.Background(), db, 8)
+	if dbErr != nil || dead != nil {
+		t.Errorf("Getting a dead task that does not exist returned %+v, %v, want nil", dead, dbErr)
+	}
+}
+
+func TestRequeueDeadTask(t *testing.T) {
+	db := &deadLetterDB{dead: []DeadTask{{ID: 7, TaskID: "42"}}}
+
+	requeued, dbErr := RequeueDeadTask(context.Background(), db, 7)
+	if dbErr != nil || !requeued {
+		t.Errorf("Requeueing dead task 7 returned %v, %v, want true", requeued, dbErr)
+	}
+	requeued, dbErr = RequeueDeadTask(context.Background(), db, 8)
+	if dbErr != nil || requeued {
+		t.Errorf("Requeueing a dead task that does not exist returned %v, %v, want false", requeued, dbErr)
+	}
+}
@@ -0,0 +1,348 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-metric-client/metrics"
+
+	otext "github.com/opentracing/opentracing-go/ext"
+)
+
+// DefaultLeaderTTL is how long an Elector leads after its last successful claim unless SetLeaderTTL is called.
+// It is well under the 2 minute session expiry so a stalled leader steps down before another session can take over.
+const DefaultLeaderTTL = time.Minute
+
+// LeaderDatabase can be implemented by a Database to support leader election.
+// ClaimLeadership should call the claim_leadership plpgsql function and return whether sessionID leads role.
+type LeaderDatabase interface {
+	ClaimLeadership(ctx context.Context, role string, sessionID int64) (bool, glitch.DataError)
+}
+
+// Elector will elect a single live session as the leader of a named role
+type Elector struct {
+	stop         chan bool
+	stopGroup    *sync.WaitGroup
+	sessionMutex sync.RWMutex
+	sessionID    int64
+	dbFinder     DBFinder
+	client       metrics.Client
+	loopTick     time.Duration
+	logger       Logger
+	role         string
+
+	leaderMutex sync.Mutex
+	leader      bool
+	leaderTTL   time.Duration
+	leaderCtx   *leaderContext
+	expired     chan *leaderContext // hands leader contexts that passed their deadline to the run loop
+	onElected   func(ctx context.Context)
+	onRevoked   func()
+}
+
+// NewElector will create a new Elector for a role
+// dbFinder can get an instance of the Database interface on demand, it must also implement LeaderDatabase
+// role is the name of the thing exactly one instance should do
+// looptick defines how often to claim leadership, it must be well under the session expiration
+// client is a go-metrics-client that will also start spans for us
+// logger is optional and will log errors if provided
+func NewElector(dbFinder DBFinder, role string, loopTick time.Duration, logger Logger, client metrics.Client) *Elector {
+	if client == nil {
+		return nil
+	}
+	if logger == nil {
+		logger = &noopLogger{}
+	}
+	var sg sync.WaitGroup
+	return &Elector{
+		stop:      make(chan bool),
+		dbFinder:  dbFinder,
+		client:    client,
+		loopTick:  loopTick,
+		logger:    logger,
+		role:      role,
+		leaderTTL: DefaultLeaderTTL,
+		expired:   make(chan *leaderContext),
+		stopGroup: &sg,
+	}
+}
+
+// OnElected sets a callback that is called in its own goroutine when this Elector becomes the leader.
+// ctx is cancelled when leadership is revoked.  Its deadline is the leader TTL after the last successful claim
+// and moves forward with every claim, so a leader that can not reach the DB stops before another session takes over.
+// Call this before Run.
+func (e *Elector) OnElected(f func(ctx context.Context)) {
+	e.onElected = f
+}
+
+// OnRevoked sets a callback that is called when this Elector stops being the leader.
+// It is called from the loop that claims leadership, so it never runs at the same time as a claim or another change of leader.
+// Call this before Run.
+func (e *Elector) OnRevoked(f func()) {
+	e.onRevoked = f
+}
+
+// SetLeaderTTL sets how long this Elector leads after its last successful claim, DefaultLeaderTTL is used otherwise.
+// It must be longer than the loop tick and shorter than the 2 minute session expiry.
+// Call this before Run.
+func (e *Elector) SetLeaderTTL(ttl time.Duration) {
+	e.leaderTTL = ttl
+}
+
+// IsLeader returns true while this Elector leads its role
+func (e *Elector) IsLeader() bool {
+	e.leaderMutex.Lock()
+	defer e.leaderMutex.Unlock()
+	return e.leader
+}
+
+// Run will start a session and begin claiming leadership on every tick
+// dont call this more than once.
+func (e *Elector) Run() error {
+	db, err := e.dbFinder()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	e.sessionMutex.Lock()
+	e.sessionID, err = db.StartSession(ctx)
+	e.sessionMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	e.stopGroup.Add(1)
+	go func() {
+		defer e.stopGroup.Done()
+		tick := time.NewTicker(e.loopTick)
+		defer tick.Stop()
+		e.claim(context.Background())
+		for {
+			select {
+			case <-e.stop: // if Stop() was called, step down and exit
+				e.setLeader(false, time.Time{})
+				err := e.endSession(context.Background())
+				if err != nil {
+					e.logger.Printf("Error ending session: %v", err)
+				}
+				return
+			case <-tick.C:
+				e.claim(context.Background())
+			case ctx := <-e.expired:
+				e.expire(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the elector from claiming leadership and ends its session so another session can take over
+// Stop returns a WaitGroup which you can wait on to ensure the OnElected callback has returned
+func (e *Elector) Stop() *sync.WaitGroup {
+	close(e.stop)
+	return e.stopGroup
+}
+
+func (e *Elector) claim(ctx context.Context) {
+	span, spanCtx := e.client.StartSpanWithContext(ctx, "elector claim leadership")
+	var err error
+	defer func() {
+		if err != nil {
+			otext.Error.Set(span, true)
+			span.SetTag("inner-error", err)
+		}
+		span.Finish()
+	}()
+
+	e.sessionMutex.RLock()
+	sessionID := e.sessionID
+	e.sessionMutex.RUnlock()
+	params := map[string]string{"role": e.role}
+	sid := strconv.FormatInt(sessionID, 10)
+
+	// the session is bumped by the claim, so the lead is measured from before it was sent
+	until := time.Now().Add(e.leaderTTL)
+	isLeader, err := e.claimLeadership(spanCtx, sessionID)
+	if err != nil {
+		// without a confirmed claim another session may take over, so step down
+		e.setLeader(false, time.Time{})
+		e.logger.Printf("Error claiming leadership: %v", err)
+		e.client.BackgroundError(sid, e.role, params, "Failed claiming leadership", err.Error(), 1)
+		return
+	}
+	e.setLeader(isLeader, until)
+}
+
+func (e *Elector) claimLeadership(ctx context.Context, sessionID int64) (bool, error) {
+	db, err := e.dbFinder()
+	if err != nil {
+		return false, fmt.Errorf("Error finding DB: %v", err)
+	}
+	ldb, ok := db.(LeaderDatabase)
+	if !ok {
+		return false, fmt.Errorf("Database does not implement LeaderDatabase")
+	}
+
+	isLeader, dbErr := ldb.ClaimLeadership(ctx, e.role, sessionID)
+	if dbErr != nil {
+		if dbErr.Code() != SQLErrorSessionNotFound {
+			return false, fmt.Errorf("Error claiming leadership: %v", dbErr)
+		}
+		e.logger.Printf("Session expired. Getting new one")
+		e.setLeader(false, time.Time{})
+		newSessionID, dbErr := db.StartSession(ctx)
+		if dbErr != nil {
+			return false, fmt.Errorf("Error starting new session: %v", dbErr)
+		}
+		e.sessionMutex.Lock()
+		e.sessionID = newSessionID
+		e.sessionMutex.Unlock()
+		isLeader, dbErr = ldb.ClaimLeadership(ctx, e.role, newSessionID)
+		if dbErr != nil {
+			return false, fmt.Errorf("Error claiming leadership: %v", dbErr)
+		}
+	}
+	return isLeader, nil
+}
+
+// setLeader moves between leader and follower and fires the callbacks on a change.  Only the run loop calls it.
+// A leader leads until until, a claim that confirms the lead pushes the deadline of the leader context back to it.
+func (e *Elector) setLeader(isLeader bool, until time.Time) {
+	e.leaderMutex.Lock()
+	if e.leader == isLeader {
+		if isLeader {
+			e.leaderCtx.extend(until)
+		}
+		e.leaderMutex.Unlock()
+		return
+	}
+	e.leader = isLeader
+
+	if isLeader {
+		ctx := newLeaderContext(until, e.expiredLater)
+		e.leaderCtx = ctx
+		e.leaderMutex.Unlock()
+		if e.onElected != nil {
+			e.stopGroup.Add(1)
+			go func() {
+				defer e.stopGroup.Done()
+				e.onElected(ctx)
+			}()
+		}
+		return
+	}
+
+	ctx := e.leaderCtx
+	e.leaderCtx = nil
+	e.leaderMutex.Unlock()
+	if ctx != nil {
+		ctx.revoke()
+	}
+	if e.onRevoked != nil {
+		e.onRevoked()
+	}
+}
+
+// expiredLater hands ctx to the run loop once it passed its deadline, so the loop steps down and not the timer
+func (e *Elector) expiredLater(ctx *leaderContext) {
+	select {
+	case e.expired <- ctx:
+	case <-e.stop:
+	}
+}
+
+// expire steps down when ctx, the leader context of the current lead, passed its deadline without a successful claim
+func (e *Elector) expire(ctx *leaderContext) {
+	e.leaderMutex.Lock()
+	current := e.leaderCtx == ctx
+	e.leaderMutex.Unlock()
+	if current {
+		e.logger.Printf("Leadership of %s expired without a successful claim", e.role)
+		e.setLeader(false, time.Time{})
+	}
+}
+
+// leaderContext is the context handed to OnElected.  It is cancelled when leadership is revoked
+// and passes its deadline if no claim extends it in time.
+type leaderContext struct {
+	context.Context
+	cancel context.CancelCauseFunc
+
+	mutex    sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// newLeaderContext will create a leaderContext that is handed to expired once deadline passes
+func newLeaderContext(deadline time.Time, expired func(ctx *leaderContext)) *leaderContext {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	lc := &leaderContext{Context: ctx, cancel: cancel, deadline: deadline}
+	lc.timer = time.AfterFunc(time.Until(deadline), func() {
+		cancel(context.DeadlineExceeded)
+		expired(lc)
+	})
+	return lc
+}
+
+// Deadline returns the current deadline, which moves forward every time the lead is confirmed
+func (c *leaderContext) Deadline() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.deadline, true
+}
+
+// Err returns context.DeadlineExceeded once the deadline passed and context.Canceled if leadership was revoked
+func (c *leaderContext) Err() error {
+	err := c.Context.Err()
+	if err != nil && errors.Is(context.Cause(c.Context), context.DeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// extend moves the deadline to deadline unless it already passed
+func (c *leaderContext) extend(deadline time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.timer.Stop() {
+		c.deadline = deadline
+		c.timer.Reset(time.Until(deadline))
+	}
+}
+
+// revoke cancels the context
+func (c *leaderContext) revoke() {
+	c.timer.Stop()
+	c.cancel(context.Canceled)
+}
+
+func (e *Elector) endSession(ctx context.Context) (err error) {
+	span, spanCtx := e.client.StartSpanWithContext(ctx, "elector end session")
+	defer func() {
+		if err != nil {
+			otext.Error.Set(span, true)
+			span.SetTag("inner-error", err)
+		}
+		span.Finish()
+	}()
+
+	db, err := e.dbFinder()
+	if err != nil {
+		return err
+	}
+
+	e.sessionMutex.Lock()
+	err = db.EndSession(spanCtx, e.sessionID)
+	e.sessionMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("Error ending session: %v", err)
+	}
+	return
+}
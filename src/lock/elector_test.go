@@ -0,0 +1,204 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// leaderDB also implements LeaderDatabase.  The session in leader leads every role and expired sessions get SL001.
+type leaderDB struct {
+	baseDB
+	lastSessionID int64
+	leader        int64
+	expired       map[int64]bool
+	err           glitch.DataError
+}
+
+func (d *leaderDB) StartSession(ctx context.Context) (int64, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.lastSessionID++
+	return d.lastSessionID, nil
+}
+
+func (d *leaderDB) ClaimLeadership(ctx context.Context, role string, sessionID int64) (bool, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.err != nil {
+		return false, d.err
+	}
+	if d.expired[sessionID] {
+		return false, glitch.NewDataError(errors.New("Session not found."), SQLErrorSessionNotFound, "Error claiming leadership")
+	}
+	if d.leader == 0 {
+		d.leader = sessionID
+	}
+	return d.leader == sessionID, nil
+}
+
+func (d *leaderDB) setLeader(sessionID int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.leader = sessionID
+}
+
+// electorEvents records the callbacks of an Elector
+type electorEvents struct {
+	mutex   sync.Mutex
+	events  []string
+	elected chan context.Context
+}
+
+func newTestElector(db Database) (*Elector, *electorEvents) {
+	ev := &electorEvents{elected: make(chan context.Context, 10)}
+	e := NewElector(func() (Database, error) { return db, nil }, "test", time.Hour, nil, noopClient{})
+	e.OnElected(func(ctx context.Context) {
+		ev.add("elected")
+		ev.elected <- ctx
+	})
+	e.OnRevoked(func() { ev.add("revoked") })
+	return e, ev
+}
+
+func (ev *electorEvents) add(event string) {
+	ev.mutex.Lock()
+	defer ev.mutex.Unlock()
+	ev.events = append(ev.events, event)
+}
+
+func (ev *electorEvents) get() []string {
+	ev.mutex.Lock()
+	defer ev.mutex.Unlock()
+	return append([]string(nil), ev.events...)
+}
+
+func (ev *electorEvents) waitElected(t *testing.T) context.Context {
+	t.Helper()
+	select {
+	case ctx := <-ev.elected:
+		return ctx
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OnElected was not called")
+		return nil
+	}
+}
+
+func TestElectorClaim(t *testing.T) {
+	db := &leaderDB{lastSessionID: 1}
+	e, ev := newTestElector(db)
+	e.sessionID = 1
+
+	e.claim(context.Background())
+	if !e.IsLeader() {
+		t.Fatalf("The only session is not the leader")
+	}
+	leaderCtx := ev.waitElected(t)
+
+	// a second claim keeps leadership without calling OnElected again
+	e.claim(context.Background())
+	if !e.IsLeader() || len(ev.elected) != 0 {
+		t.Fatalf("A repeated claim changed leadership")
+	}
+
+	db.setLeader(2)
+	e.claim(context.Background())
+	if e.IsLeader() {
+		t.Errorf("Still the leader after another session took over")
+	}
+	if leaderCtx.Err() != context.Canceled {
+		t.Errorf("The OnElected context ended with %v after leadership was revoked, want %v", leaderCtx.Err(), context.Canceled)
+	}
+	if got := ev.events; len(got) != 2 || got[1] != "revoked" {
+		t.Errorf("Got events %v, want elected then revoked", got)
+	}
+}
+
+func TestElectorStepsDownOnError(t *testing.T) {
+	db := &leaderDB{lastSessionID: 1}
+	e, ev := newTestElector(db)
+	e.sessionID = 1
+	e.claim(context.Background())
+	leaderCtx := ev.waitElected(t)
+
+	db.err = glitch.NewDataError(errors.New("connection refused"), "ERROR", "Error claiming leadership")
+	e.claim(context.Background())
+	if e.IsLeader() {
+		t.Errorf("Still the leader after a claim failed")
+	}
+	if leaderCtx.Err() == nil {
+		t.Errorf("The OnElected context is still live after a claim failed")
+	}
+}
+
+func TestElectorRestartsExpiredSession(t *testing.T) {
+	db := &leaderDB{lastSessionID: 1, expired: map[int64]bool{1: true}}
+	e, ev := newTestElector(db)
+	e.sessionID = 1
+
+	e.claim(context.Background())
+	if !e.IsLeader() {
+		t.Fatalf("Not the leader after replacing the expired session")
+	}
+	ev.waitElected(t)
+	if e.sessionID != 2 || db.leader != 2 {
+		t.Errorf("Claimed with session %d and the leader is %d, want the new session 2", e.sessionID, db.leader)
+	}
+}
+
+func TestElectorExpiryWaitsForRunLoop(t *testing.T) {
+	db := &leaderDB{lastSessionID: 1}
+	e, ev := newTestElector(db)
+	e.SetLeaderTTL(10 * time.Millisecond)
+	e.sessionID = 1
+	e.claim(context.Background())
+	leaderCtx := ev.waitElected(t)
+
+	// the timer only cancels the context, stepping down and OnRevoked are left to the run loop
+	<-leaderCtx.Done()
+	if leaderCtx.Err() != context.DeadlineExceeded {
+		t.Errorf("The OnElected context ended with %v, want %v", leaderCtx.Err(), context.DeadlineExceeded)
+	}
+	var expired *leaderContext
+	select {
+	case expired = <-e.expired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The expired lead was not handed to the run loop")
+	}
+	if got := ev.get(); len(got) != 1 {
+		t.Fatalf("Got events %v before the run loop stepped down, want only elected", got)
+	}
+
+	e.expire(expired)
+	if e.IsLeader() {
+		t.Errorf("Still the leader after the lead expired")
+	}
+	if got := ev.get(); len(got) != 2 || got[1] != "revoked" {
+		t.Errorf("Got events %v, want elected then revoked", got)
+	}
+}
+
+func TestElectorRunStepsDownOnExpiry(t *testing.T) {
+	db := &leaderDB{}
+	e, ev := newTestElector(db)
+	e.SetLeaderTTL(10 * time.Millisecond)
+	err := e.Run()
+	if err != nil {
+		t.Fatalf("Error running elector: %v", err)
+	}
+	ev.waitElected(t)
+
+	// the loop tick is an hour, so no claim confirms the lead before it expires
+	deadline := time.Now().Add(5 * time.Second)
+	for e.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	e.Stop().Wait()
+	if got := ev.get(); len(got) != 2 || got[0] != "elected" || got[1] != "revoked" {
+		t.Errorf("Got events %v, want elected then revoked once", got)
+	}
+}
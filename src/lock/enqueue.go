@@ -0,0 +1,121 @@
+package lock
+
+import (
+	"context"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// EnqueueRequest is a task to add to the pool
+type EnqueueRequest struct {
+	// Task holds the info needed to do the task.  Its ID may be empty if the DB assigns one.
+	Task Task
+	// NotBefore is the earliest time the task can be picked up.  The zero time means right away.
+	NotBefore time.Time
+	// DedupeKey makes enqueueing idempotent.  While a task with the same key is pending, or finished within DedupeWindow,
+	// the request is collapsed into that task instead of creating a new one.  Empty means no deduplication.
+	DedupeKey string
+	// DedupeWindow is how long after a task finishes its DedupeKey keeps deduplicating.  0 means only while it is pending.
+	DedupeWindow time.Duration
+	// Parents are the IDs of tasks that must finish before this task can be picked up
+	Parents []string
+	// ParentRefs are parents enqueued in the same call, given by their index in the requests.
+	// A ref must point at an earlier request.  Only the producer package resolves them, the DB only sees Parents.
+	ParentRefs []int
+	// OnParentFailure decides what happens to the task when a parent dies or is cancelled.  Empty means CancelOnParentFailure.
+	OnParentFailure ParentFailurePolicy
+	// ExpiresAt is when the task becomes worthless.  It is never picked up after this.  The zero time means it never expires.
+	ExpiresAt time.Time
+}
+
+// ParentFailurePolicy decides what happens to a task when one of its parents dies or is cancelled
+type ParentFailurePolicy string
+
+// Parent failure policies
+const (
+	// CancelOnParentFailure cancels the task and every descendant that also cancels on parent failure
+	CancelOnParentFailure ParentFailurePolicy = "cancel"
+	// RunOnParentFailure runs the task anyway once every other parent is done
+	RunOnParentFailure ParentFailurePolicy = "run"
+)
+
+// EnqueueResult is the outcome of a single EnqueueRequest
+type EnqueueResult struct {
+	// ID is the new task, or the existing task the request collapsed into if Deduplicated
+	ID           string
+	Deduplicated bool
+}
+
+// Dedupe returns a copy of the request that is deduplicated by key for window after the task finishes
+func (r EnqueueRequest) Dedupe(key string, window time.Duration) EnqueueRequest {
+	r.DedupeKey = key
+	r.DedupeWindow = window
+	return r
+}
+
+// After returns a copy of the request that waits for the tasks with parentIDs to finish
+func (r EnqueueRequest) After(parentIDs ...string) EnqueueRequest {
+	r.Parents = append(append([]string(nil), r.Parents...), parentIDs...)
+	return r
+}
+
+// AfterRefs returns a copy of the request that waits for the earlier requests at refs in the same call to finish
+func (r EnqueueRequest) AfterRefs(refs ...int) EnqueueRequest {
+	r.ParentRefs = append(append([]int(nil), r.ParentRefs...), refs...)
+	return r
+}
+
+// OnFailure returns a copy of the request that uses policy when a parent dies or is cancelled
+func (r EnqueueRequest) OnFailure(policy ParentFailurePolicy) EnqueueRequest {
+	r.OnParentFailure = policy
+	return r
+}
+
+// ExpireAt returns a copy of the request that expires at at if it has not run by then
+func (r EnqueueRequest) ExpireAt(at time.Time) EnqueueRequest {
+	r.ExpiresAt = at
+	return r
+}
+
+// ExpireAfter returns a copy of the request that expires once ttl has passed if it has not run by then
+func (r EnqueueRequest) ExpireAfter(ttl time.Duration) EnqueueRequest {
+	r.ExpiresAt = time.Now().Add(ttl)
+	return r
+}
+
+// RunNow will create an EnqueueRequest for a task that can be picked up right away
+func RunNow(task Task) EnqueueRequest {
+	return EnqueueRequest{Task: task}
+}
+
+// RunAt will create an EnqueueRequest for a task that can not be picked up before at
+func RunAt(task Task, at time.Time) EnqueueRequest {
+	return EnqueueRequest{Task: task, NotBefore: at}
+}
+
+// RunAfter will create an EnqueueRequest for a task that can not be picked up until delay has passed
+func RunAfter(task Task, delay time.Duration) EnqueueRequest {
+	return EnqueueRequest{Task: task, NotBefore: time.Now().Add(delay)}
+}
+
+// Enqueuer can be implemented by a Database to add tasks to the pool.
+// EnqueueTasks should call the enqueue_tasks plpgsql function with every request, or enqueue_task for each, and return the results in order.
+// A request's Parents are passed as in_parent_ids, its OnParentFailure as in_on_parent_failure and its ExpiresAt as in_expires_at.
+type Enqueuer interface {
+	EnqueueTasks(ctx context.Context, tasks []EnqueueRequest) ([]EnqueueResult, glitch.DataError)
+}
+
+// TxEnqueuer can be implemented by a Database to add tasks to the pool inside a caller's transaction
+// so the tasks are only created if the caller's own writes commit.
+// EnqueueTasksTx should call the enqueue_task plpgsql function on tx for each request and return its results in the same order.
+// Wrap a *sql.Tx with SQLQuerier or a pgx.Tx with pgxdb.Querier.
+type TxEnqueuer interface {
+	EnqueueTasksTx(ctx context.Context, tx Querier, tasks []EnqueueRequest) ([]EnqueueResult, glitch.DataError)
+}
+
+// NextDueFinder can be implemented by a Database so a Runner can wake up for delayed tasks sooner than its loop tick.
+// GetNextTaskDue should call the get_next_task_due plpgsql function and return the zero time if no task is waiting.
+type NextDueFinder interface {
+	GetNextTaskDue(ctx context.Context) (time.Time, glitch.DataError)
+}
@@ -0,0 +1,61 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// dueDB also implements NextDueFinder
+type dueDB struct {
+	baseDB
+	due time.Time
+}
+
+func (d *dueDB) GetNextTaskDue(ctx context.Context) (time.Time, glitch.DataError) {
+	return d.due, nil
+}
+
+func TestEnqueueRequests(t *testing.T) {
+	task := &testTask{id: "1"}
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if req := RunNow(task); req.Task != task || !req.NotBefore.IsZero() {
+		t.Errorf("RunNow returned %+v, want the task with no NotBefore", req)
+	}
+	if req := RunAt(task, at); !req.NotBefore.Equal(at) {
+		t.Errorf("RunAt returned NotBefore %v, want %v", req.NotBefore, at)
+	}
+	before := time.Now()
+	if req := RunAfter(task, time.Hour); req.NotBefore.Before(before.Add(time.Hour)) || req.NotBefore.After(time.Now().Add(time.Hour)) {
+		t.Errorf("RunAfter returned NotBefore %v, want an hour from now", req.NotBefore)
+	}
+}
+
+func TestNextWait(t *testing.T) {
+	tests := []struct {
+		name string
+		db   Database
+		max  time.Duration
+		min  time.Duration
+	}{
+		{"without NextDueFinder", &baseDB{}, time.Hour, time.Hour},
+		{"no delayed tasks", &dueDB{}, time.Hour, time.Hour},
+		{"task due before the tick", &dueDB{due: time.Now().Add(time.Minute)}, time.Minute, time.Minute - 10*time.Second},
+		{"task already due", &dueDB{due: time.Now().Add(-time.Minute)}, 0, 0},
+		{"task due after the tick", &dueDB{due: time.Now().Add(2 * time.Hour)}, time.Hour, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRunner(tt.db, nil)
+			r.loopTick = time.Hour
+
+			got := r.nextWait(context.Background())
+			if got < tt.min || got > tt.max {
+				t.Errorf("nextWait returned %v, want between %v and %v", got, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package lock
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// ExpiringTask can be implemented by a Task that is worthless after a point.
+// GetExpiresAt returns when the task expires, the zero time if it never does.
+// A Runner does not start a task that has expired, cancels its TaskContext when it expires and drops its result if it finished late.
+type ExpiringTask interface {
+	GetExpiresAt() time.Time
+}
+
+// TaskExpirer can be implemented by a Database to expire tasks.
+// ExpireTasks should call the expire_tasks plpgsql function, which flags pending tasks past their expires_at as expired,
+// and return how many were expired.  A Runner calls it every loop.
+type TaskExpirer interface {
+	ExpireTasks(ctx context.Context) (int64, glitch.DataError)
+}
+
+// expiresAt returns when task expires or the zero time if it never does
+func expiresAt(task Task) time.Time {
+	et, ok := task.(ExpiringTask)
+	if !ok {
+		return time.Time{}
+	}
+	return et.GetExpiresAt()
+}
+
+// expired returns true if task has an expiry that has passed
+func expired(task Task, now time.Time) bool {
+	exp := expiresAt(task)
+	return !exp.IsZero() && !now.Before(exp)
+}
+
+// anyExpiring returns true if any of tasks has an expiry
+func anyExpiring[T Task](tasks []T) bool {
+	for _, task := range tasks {
+		if !expiresAt(task).IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// splitExpired returns the tasks that have not expired and the ids of those that have
+func splitExpired[T Task](tasks []T) ([]T, map[string]bool) {
+	now := time.Now()
+	var live []T
+	var dead map[string]bool
+	for _, task := range tasks {
+		if expired(task, now) {
+			if dead == nil {
+				dead = make(map[string]bool)
+			}
+			dead[task.GetID()] = true
+			continue
+		}
+		live = append(live, task)
+	}
+	return live, dead
+}
+
+// expiredResults returns the ids of the tasks in results that expired before their result came back
+func expiredResults[T Task](results []TypedTaskResult[T]) map[string]bool {
+	now := time.Now()
+	var ids map[string]bool
+	for _, result := range results {
+		if expired(result.Task, now) {
+			if ids == nil {
+				ids = make(map[string]bool)
+			}
+			ids[result.Task.GetID()] = true
+		}
+	}
+	return ids
+}
+
+// expireTasks flags tasks that are past their expiry as expired if db supports it
+func (r *TypedRunner[T]) expireTasks(ctx context.Context) {
+	db, err := r.dbFinder()
+	if err != nil {
+		r.logger.Printf("Error finding DB: %v", err)
+		return
+	}
+	te, ok := db.(TaskExpirer)
+	if !ok {
+		return
+	}
+	count, dbErr := te.ExpireTasks(ctx)
+	if dbErr != nil {
+		r.logger.Printf("Error expiring tasks: %v", dbErr)
+		return
+	}
+	if count == 0 {
+		return
+	}
+	r.sessionMutex.RLock()
+	sessionID := r.sessionID
+	r.sessionMutex.RUnlock()
+	r.client.BackgroundCustom(strconv.FormatInt(sessionID, 10), r.name, "expired_tasks", map[string]string{}, nil, count)
+}
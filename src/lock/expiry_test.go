@@ -0,0 +1,91 @@
+package lock
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// expiringTask is a testTask with an expiry
+type expiringTask struct {
+	testTask
+	expires time.Time
+}
+
+func (t *expiringTask) GetExpiresAt() time.Time {
+	return t.expires
+}
+
+// expirerDB also implements TaskExpirer
+type expirerDB struct {
+	baseDB
+	expireCalls int
+}
+
+func (d *expirerDB) ExpireTasks(ctx context.Context) (int64, glitch.DataError) {
+	d.expireCalls++
+	return 2, nil
+}
+
+func TestDoWorkSkipsExpiredTasks(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	db := &baseDB{tasks: []Task{
+		&testTask{id: "1"},
+		&expiringTask{testTask: testTask{id: "2"}, expires: time.Now().Add(-time.Minute)},
+		&expiringTask{testTask: testTask{id: "3"}, expires: expires},
+	}}
+	var started []Task
+	var deadline time.Time
+	r := newTestRunner(db, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		started = tasks
+		deadline, _ = TaskContext(ctx, tasks[1]).Deadline()
+		return tasks, nil
+	})
+
+	_, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if got := strings.Join(taskIDs(started), ","); got != "1,3" {
+		t.Errorf("Started %s, want the tasks that have not expired", got)
+	}
+	if !deadline.Equal(expires) {
+		t.Errorf("The context of task 3 has deadline %v, want its expiry", deadline)
+	}
+	if got := strings.Join(db.finishedIDs(), ","); got != "1,3" {
+		t.Errorf("Finished %s, want 1,3", got)
+	}
+}
+
+func TestDoWorkDropsLateResults(t *testing.T) {
+	db := &baseDB{tasks: []Task{
+		&testTask{id: "1"},
+		&expiringTask{testTask: testTask{id: "2"}, expires: time.Now().Add(50 * time.Millisecond)},
+	}}
+	r := newTestRunner(db, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		<-TaskContext(ctx, tasks[1]).Done()
+		return tasks, nil
+	})
+
+	handled, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if got := strings.Join(taskIDs(handled), ","); got != "1" {
+		t.Errorf("Handled %s, want only the task that did not expire while running", got)
+	}
+}
+
+func TestExpireTasks(t *testing.T) {
+	db := &expirerDB{}
+	r := newTestRunner(db, nil)
+	r.expireTasks(context.Background())
+	if db.expireCalls != 1 {
+		t.Errorf("Called ExpireTasks %d times, want once", db.expireCalls)
+	}
+	// a Database without TaskExpirer is left alone
+	newTestRunner(&baseDB{}, nil).expireTasks(context.Background())
+}
@@ -0,0 +1,92 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/promoboxx/go-metric-client/metrics"
+)
+
+// DefaultConcurrency is how many tasks a handler Runner works at once when no concurrency is given
+const DefaultConcurrency = 10
+
+// TaskHandler does the work of a single task.  A task succeeds if it returns nil and is retried if it returns an error,
+// unless the error is wrapped with Permanent.  Wrap an error with RetryAfter to pick when it is retried.
+type TaskHandler = TypedTaskHandler[Task]
+
+// TypedTaskHandler is a TaskHandler for tasks of type T
+type TypedTaskHandler[T Task] func(ctx context.Context, task T) error
+
+// NewHandlerRunner will create a new Runner that calls handler once per task, working up to WithConcurrency tasks at once.
+// Each call gets the task's TaskContext, limited by WithTaskTimeout, and a panic only fails the task that caused it.
+// Tasks that succeed are reported to the Completer right away.
+// The other arguments are the same as NewRunner
+func NewHandlerRunner(dbFinder DBFinder, scanTask ScanTask, handler TaskHandler, loopTick time.Duration, tasksPerSession int64, logger Logger, name string, client metrics.Client, opts ...RunnerOption) *Runner {
+	return NewTypedHandlerRunner(dbFinder, scanTask, handler, loopTick, tasksPerSession, logger, name, client, opts...)
+}
+
+// NewTypedHandlerRunner will create a new TypedRunner for tasks of type T that calls handler once per task
+// The arguments are the same as NewHandlerRunner
+func NewTypedHandlerRunner[T Task](dbFinder DBFinder, scanTask TypedScanTask[T], handler TypedTaskHandler[T], loopTick time.Duration, tasksPerSession int64, logger Logger, name string, client metrics.Client, opts ...RunnerOption) *TypedRunner[T] {
+	r := NewTypedResultRunner[T](dbFinder, scanTask, nil, loopTick, tasksPerSession, logger, name, client, opts...)
+	if r == nil {
+		return nil
+	}
+	r.tasker = handler.results(r.concurrency, r.taskTimeout, r.logger)
+	return r
+}
+
+// results converts the handler into a ResultTasker that works up to concurrency tasks at once
+func (h TypedTaskHandler[T]) results(concurrency int, timeout time.Duration, logger Logger) TypedResultTasker[T] {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return func(ctx context.Context, tasks []T) ([]TypedTaskResult[T], error) {
+		results := make([]TypedTaskResult[T], len(tasks))
+		work := make(chan int)
+		var wg sync.WaitGroup
+		workers := concurrency
+		if workers > len(tasks) {
+			workers = len(tasks)
+		}
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range work {
+					err := h.handle(ctx, tasks[i], timeout, logger)
+					results[i] = TypedTaskResult[T]{Task: tasks[i], Status: statusFor(err), Err: err}
+					if err == nil {
+						CompleterFrom(ctx).Complete(tasks[i])
+					}
+				}
+			}()
+		}
+		for i := range tasks {
+			work <- i
+		}
+		close(work)
+		wg.Wait()
+		return results, nil
+	}
+}
+
+// handle calls the handler for a single task, turning a panic into an error
+func (h TypedTaskHandler[T]) handle(ctx context.Context, task T, timeout time.Duration, logger Logger) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Printf("Panic handling task %s: %v\n%s", task.GetID(), p, debug.Stack())
+			err = fmt.Errorf("panic handling task %s: %v", task.GetID(), p)
+		}
+	}()
+	taskCtx := TaskContext(ctx, task)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		taskCtx, cancel = context.WithTimeout(taskCtx, timeout)
+		defer cancel()
+	}
+	return h(taskCtx, task)
+}
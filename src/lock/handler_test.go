@@ -0,0 +1,86 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandlerRunner(t *testing.T) {
+	db := &outcomeDB{baseDB: baseDB{tasks: []Task{&testTask{id: "ok"}, &testTask{id: "retry"}, &testTask{id: "fail"}, &testTask{id: "panic"}}}}
+	r := NewHandlerRunner(func() (Database, error) { return db, nil }, nil, func(ctx context.Context, task Task) error {
+		switch task.GetID() {
+		case "retry":
+			return errors.New("timeout")
+		case "fail":
+			return Permanent(errors.New("bad input"))
+		case "panic":
+			panic("nil map")
+		}
+		return nil
+	}, time.Second, 10, nil, "test", noopClient{})
+	r.sessionID = 1
+
+	_, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if got := strings.Join(db.finishedIDs(), ","); got != "ok" {
+		t.Errorf("Finished %s, want ok", got)
+	}
+	if len(db.failures) != 1 || db.failures[0].TaskID != "fail" {
+		t.Errorf("Failed %+v, want fail", db.failures)
+	}
+	// a panic only retries the task that caused it
+	if len(db.retries) != 2 || !strings.Contains(db.retries[0].Error+db.retries[1].Error, "panic handling task panic: nil map") {
+		t.Errorf("Retried %+v, want retry and panic", db.retries)
+	}
+}
+
+func TestHandlerConcurrency(t *testing.T) {
+	var mutex sync.Mutex
+	running, most := 0, 0
+	handler := TaskHandler(func(ctx context.Context, task Task) error {
+		mutex.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return nil
+	})
+	tasks := make([]Task, 10)
+	for i := range tasks {
+		tasks[i] = &testTask{id: "task"}
+	}
+
+	results, err := handler.results(3, 0, &noopLogger{})(context.Background(), tasks)
+	if err != nil {
+		t.Fatalf("Error running tasks: %v", err)
+	}
+	if len(results) != 10 {
+		t.Errorf("Got %d results, want 10", len(results))
+	}
+	if most != 3 {
+		t.Errorf("Ran %d tasks at once, want 3", most)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	handler := TaskHandler(func(ctx context.Context, task Task) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	results, _ := handler.results(1, time.Millisecond, &noopLogger{})(context.Background(), []Task{&testTask{id: "1"}})
+	if results[0].Status != TaskRetry || results[0].Err != context.DeadlineExceeded {
+		t.Errorf("Got %s %v, want a retry after the timeout", results[0].Status, results[0].Err)
+	}
+}
@@ -0,0 +1,102 @@
+package lock
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// IDKind is the type of the key of a task table, the task_id domain in 0013_task_id.up.sql
+type IDKind int
+
+// ID kinds
+const (
+	// BigintID is a BIGINT or BIGSERIAL key
+	BigintID IDKind = iota
+	// UUIDID is a UUID key
+	UUIDID
+	// TextID is a TEXT key
+	TextID
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// String returns the SQL type of the kind
+func (k IDKind) String() string {
+	switch k {
+	case BigintID:
+		return "BIGINT"
+	case UUIDID:
+		return "UUID"
+	case TextID:
+		return "TEXT"
+	}
+	return "unknown"
+}
+
+// Validate returns an error if id is not a valid id of this kind
+func (k IDKind) Validate(id string) glitch.DataError {
+	switch k {
+	case BigintID:
+		_, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return glitch.NewDataError(err, ErrorInvalidTaskID, fmt.Sprintf("Task id %q is not a BIGINT", id))
+		}
+	case UUIDID:
+		if !uuidPattern.MatchString(id) {
+			msg := fmt.Sprintf("Task id %q is not a UUID", id)
+			return glitch.NewDataError(errors.New(msg), ErrorInvalidTaskID, msg)
+		}
+	case TextID:
+	default:
+		msg := fmt.Sprintf("Unknown id kind %d", int(k))
+		return glitch.NewDataError(errors.New(msg), ErrorInvalidTaskID, msg)
+	}
+	return nil
+}
+
+// ArrayLiteral validates ids and returns them as a Postgres array literal such as {1,2,3}
+// that can be bound to a task_id[] parameter like in_task_ids.
+func (k IDKind) ArrayLiteral(ids []string) (string, glitch.DataError) {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, id := range ids {
+		dbErr := k.Validate(id)
+		if dbErr != nil {
+			return "", dbErr
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if k == TextID {
+			// quote every text id so commas, braces, spaces and NULL are taken literally
+			b.WriteByte('"')
+			b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(id))
+			b.WriteByte('"')
+			continue
+		}
+		b.WriteString(id)
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+// IDArray binds task ids of a kind to a task_id[] parameter.  It implements driver.Valuer.
+type IDArray struct {
+	Kind IDKind
+	IDs  []string
+}
+
+// Value returns the ids as a Postgres array literal
+func (a IDArray) Value() (driver.Value, error) {
+	literal, dbErr := a.Kind.ArrayLiteral(a.IDs)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return literal, nil
+}
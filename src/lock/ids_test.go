@@ -0,0 +1,67 @@
+package lock
+
+import (
+	"testing"
+)
+
+func TestIDKindValidate(t *testing.T) {
+	tests := []struct {
+		kind  IDKind
+		id    string
+		valid bool
+	}{
+		{BigintID, "42", true},
+		{BigintID, "-7", true},
+		{BigintID, "4x", false},
+		{BigintID, "", false},
+		{UUIDID, "3f2504e0-4f89-11d3-9a0c-0305e82c3301", true},
+		{UUIDID, "3F2504E0-4F89-11D3-9A0C-0305E82C3301", true},
+		{UUIDID, "3f2504e04f8911d39a0c0305e82c3301", false},
+		{TextID, "anything, at all", true},
+		{IDKind(9), "1", false},
+	}
+	for _, test := range tests {
+		dbErr := test.kind.Validate(test.id)
+		if (dbErr == nil) != test.valid {
+			t.Errorf("%s.Validate(%q) returned %v, want valid %v", test.kind, test.id, dbErr, test.valid)
+		}
+		if dbErr != nil && dbErr.Code() != ErrorInvalidTaskID {
+			t.Errorf("%s.Validate(%q) returned code %s, want %s", test.kind, test.id, dbErr.Code(), ErrorInvalidTaskID)
+		}
+	}
+}
+
+func TestIDKindArrayLiteral(t *testing.T) {
+	tests := []struct {
+		kind IDKind
+		ids  []string
+		want string
+	}{
+		{BigintID, nil, "{}"},
+		{BigintID, []string{"1", "2", "3"}, "{1,2,3}"},
+		{UUIDID, []string{"3f2504e0-4f89-11d3-9a0c-0305e82c3301"}, "{3f2504e0-4f89-11d3-9a0c-0305e82c3301}"},
+		{TextID, []string{"a,b", `say "hi"`, `back\slash`, "NULL", "{x}"}, `{"a,b","say \"hi\"","back\\slash","NULL","{x}"}`},
+	}
+	for _, test := range tests {
+		got, dbErr := test.kind.ArrayLiteral(test.ids)
+		if dbErr != nil || got != test.want {
+			t.Errorf("%s.ArrayLiteral(%q) = %s, %v, want %s", test.kind, test.ids, got, dbErr, test.want)
+		}
+	}
+
+	_, dbErr := BigintID.ArrayLiteral([]string{"1", "two"})
+	if dbErr == nil {
+		t.Errorf("An array with an invalid id did not return an error")
+	}
+}
+
+func TestIDArrayValue(t *testing.T) {
+	v, err := IDArray{Kind: BigintID, IDs: []string{"1", "2"}}.Value()
+	if err != nil || v != "{1,2}" {
+		t.Errorf("Got %v, %v, want {1,2}", v, err)
+	}
+	_, err = IDArray{Kind: UUIDID, IDs: []string{"1"}}.Value()
+	if err == nil {
+		t.Errorf("An IDArray with an invalid UUID did not return an error")
+	}
+}
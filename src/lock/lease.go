@@ -0,0 +1,45 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// Lease errors
+var (
+	ErrNotInTasker          = errors.New("context was not provided by a Runner")
+	ErrLeasesNotSupported   = errors.New("database does not support task leases")
+	ErrInvalidLeaseDuration = errors.New("lease duration must be positive")
+)
+
+// LeaseExtender can be implemented by a Database to support extending per-task leases.
+// Tasks are leased by pickup_tasks_for_session and go back to the pool when the lease expires,
+// even if the session that picked them up is still alive.
+type LeaseExtender interface {
+	ExtendLease(ctx context.Context, sessionID int64, taskID string, duration time.Duration) glitch.DataError
+}
+
+// ExtendLease will extend the lease on task so it expires duration from now.
+// ctx must be the context handed to the Tasker by the Runner.  A Tasker working on a task for longer
+// than the lease set at pickup should call this periodically or the task will be given to another session.
+func ExtendLease(ctx context.Context, task Task, duration time.Duration) error {
+	if duration <= 0 {
+		return ErrInvalidLeaseDuration
+	}
+	rc, ok := runContextFrom(ctx)
+	if !ok {
+		return ErrNotInTasker
+	}
+	le, ok := rc.db.(LeaseExtender)
+	if !ok {
+		return ErrLeasesNotSupported
+	}
+	dbErr := le.ExtendLease(ctx, rc.sessionID, task.GetID(), duration)
+	if dbErr != nil {
+		return dbErr
+	}
+	return nil
+}
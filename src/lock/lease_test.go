@@ -0,0 +1,70 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// leaseDB also implements LeaseExtender and holds the lease of every task but "lost"
+type leaseDB struct {
+	baseDB
+	extended map[string]time.Duration
+}
+
+func (d *leaseDB) ExtendLease(ctx context.Context, sessionID int64, taskID string, duration time.Duration) glitch.DataError {
+	if taskID == "lost" || sessionID != 1 {
+		return glitch.NewDataError(errors.New("Lease not found."), SQLErrorLeaseNotFound, "Error extending lease")
+	}
+	d.extended[taskID] = duration
+	return nil
+}
+
+func TestExtendLease(t *testing.T) {
+	db := &leaseDB{baseDB: baseDB{tasks: []Task{&testTask{id: "1"}, &testTask{id: "lost"}}}, extended: make(map[string]time.Duration)}
+	var errs []error
+	r := newTestRunner(db, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		for _, task := range tasks {
+			errs = append(errs, ExtendLease(ctx, task, time.Hour))
+		}
+		return nil, nil
+	})
+
+	_, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if errs[0] != nil || db.extended["1"] != time.Hour {
+		t.Errorf("Extending the lease of task 1 returned %v and extended it by %v, want an hour", errs[0], db.extended["1"])
+	}
+	var dbErr glitch.DataError
+	if !errors.As(errs[1], &dbErr) || dbErr.Code() != SQLErrorLeaseNotFound {
+		t.Errorf("Extending a lost lease returned %v, want %s", errs[1], SQLErrorLeaseNotFound)
+	}
+}
+
+func TestExtendLeaseErrors(t *testing.T) {
+	task := &testTask{id: "1"}
+	var err error
+	r := newTestRunner(&baseDB{tasks: []Task{task}}, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		err = ExtendLease(ctx, tasks[0], time.Hour)
+		return nil, nil
+	})
+	_, workErr := r.doWork(context.Background())
+	if workErr != nil {
+		t.Fatalf("Error doing work: %v", workErr)
+	}
+	if err != ErrLeasesNotSupported {
+		t.Errorf("ExtendLease on a Database without leases returned %v, want %v", err, ErrLeasesNotSupported)
+	}
+
+	if err := ExtendLease(context.Background(), task, time.Hour); err != ErrNotInTasker {
+		t.Errorf("ExtendLease outside a Tasker returned %v, want %v", err, ErrNotInTasker)
+	}
+	if err := ExtendLease(context.Background(), task, 0); err != ErrInvalidLeaseDuration {
+		t.Errorf("ExtendLease by 0 returned %v, want %v", err, ErrInvalidLeaseDuration)
+	}
+}
@@ -0,0 +1,113 @@
+package memdb
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// GetDeadTasks returns the dead lettered tasks matching filter, oldest first
+func (d *DB) GetDeadTasks(ctx context.Context, filter lock.DeadTaskFilter) ([]lock.DeadTask, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var tasks []lock.DeadTask
+	for _, dead := range d.findDeadTasks(filter) {
+		tasks = append(tasks, *dead)
+	}
+	return tasks, nil
+}
+
+// RequeueDeadTasks removes the tasks matching filter from the dead letter table, puts them back in the pool with their attempts reset
+// and their dedupe keys cleared, and returns how many were requeued
+func (d *DB) RequeueDeadTasks(ctx context.Context, filter lock.DeadTaskFilter) (int64, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var count int64
+	for _, dead := range d.takeDeadTasks(filter) {
+		t, ok := d.byID[dead.TaskID]
+		if !ok {
+			continue
+		}
+		t.state = lock.TaskPending
+		t.attempts = 0
+		t.dedupeKey = ""
+		t.release(time.Time{})
+		count++
+	}
+	return count, nil
+}
+
+// PurgeDeadTasks deletes the tasks matching filter from the dead letter table and returns how many were deleted
+func (d *DB) PurgeDeadTasks(ctx context.Context, filter lock.DeadTaskFilter) (int64, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return int64(len(d.takeDeadTasks(filter))), nil
+}
+
+// takeDeadTasks removes the tasks matching filter from the dead letter table and returns them, the caller must hold the lock
+func (d *DB) takeDeadTasks(filter lock.DeadTaskFilter) []*lock.DeadTask {
+	taken := d.findDeadTasks(filter)
+	isTaken := make(map[*lock.DeadTask]bool, len(taken))
+	for _, dead := range taken {
+		isTaken[dead] = true
+	}
+	kept := d.deadTasks[:0]
+	for _, dead := range d.deadTasks {
+		if !isTaken[dead] {
+			kept = append(kept, dead)
+		}
+	}
+	d.deadTasks = kept
+	return taken
+}
+
+// findDeadTasks is find_dead_task_ids: it returns the tasks matching filter, oldest first.  The caller must hold the lock.
+func (d *DB) findDeadTasks(filter lock.DeadTaskFilter) []*lock.DeadTask {
+	var found []*lock.DeadTask
+	for _, dead := range d.deadTasks {
+		if filter.Limit > 0 && int64(len(found)) >= filter.Limit {
+			break
+		}
+		if len(filter.IDs) > 0 && !containsID(filter.IDs, dead.ID) {
+			continue
+		}
+		if len(filter.TaskIDs) > 0 && !containsTaskID(filter.TaskIDs, dead.TaskID) {
+			continue
+		}
+		if filter.ErrorContains != "" && !strings.Contains(dead.Error, filter.ErrorContains) {
+			continue
+		}
+		if !filter.DiedAfter.IsZero() && !dead.Died.After(filter.DiedAfter) {
+			continue
+		}
+		if !filter.DiedBefore.IsZero() && !dead.Died.Before(filter.DiedBefore) {
+			continue
+		}
+		found = append(found, dead)
+	}
+	return found
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTaskID(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
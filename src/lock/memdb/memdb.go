@@ -0,0 +1,470 @@
+// Package memdb implements lock.Database in memory with the same session semantics as the plpgsql functions in migration.
+// It is meant for local development and for tests that run one or more Runners in a single process.
+package memdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// Defaults match start_session, bump_session and pickup_tasks_for_session
+const (
+	DefaultSessionTTL    = 2 * time.Minute
+	DefaultLeaseDuration = 5 * time.Minute
+)
+
+// DB implements lock.Database, lock.PagedWorkGetter and every optional interface of the lock package in memory,
+// except lock.TxEnqueuer and lock.CancelNotifier.  It is safe to share between Runners.
+type DB struct {
+	mu            sync.Mutex
+	now           func() time.Time
+	sessionTTL    time.Duration
+	leaseDuration time.Duration
+
+	lastSessionID int64
+	// sessions holds when each session expires, ended sessions expire at the zero time
+	sessions map[int64]time.Time
+	// tasks are in the order they were added, which is the order they are picked up
+	tasks      []*task
+	byID       map[string]*task
+	lastTaskID int64
+
+	lastDeadID int64
+	deadTasks  []*lock.DeadTask
+	// leaders holds the session leading each role
+	leaders map[string]int64
+	// fires holds the scheduled fires of each job in the order they were claimed
+	fires map[string][]*lock.ScheduledFire
+}
+
+// task is a row of the task table
+type task struct {
+	task            lock.Task
+	state           lock.TaskState
+	notBefore       time.Time
+	expiresAt       time.Time
+	sessionID       int64
+	leaseExpires    time.Time
+	finished        time.Time
+	attempts        int
+	errorHistory    []string
+	checkpoint      []byte
+	result          []byte
+	dedupeKey       string
+	parents         []*task
+	onParentFailure lock.ParentFailurePolicy
+}
+
+func (t *task) pending() bool {
+	return t.state == lock.TaskPending
+}
+
+func (t *task) due(now time.Time) bool {
+	return t.notBefore.IsZero() || !t.notBefore.After(now)
+}
+
+// live reports whether the task has not expired
+func (t *task) live(now time.Time) bool {
+	return t.expiresAt.IsZero() || t.expiresAt.After(now)
+}
+
+// parentsDone is task_parents_done: every parent finished, or failed if the task runs anyway on parent failure
+func (t *task) parentsDone() bool {
+	for _, p := range t.parents {
+		if p.state == lock.TaskFinished {
+			continue
+		}
+		if t.onParentFailure == lock.RunOnParentFailure && p.failed() {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// failed reports whether the task died, was cancelled or expired
+func (t *task) failed() bool {
+	return t.state == lock.TaskDead || t.state == lock.TaskCancelled || t.state == lock.TaskExpired
+}
+
+// ready reports whether the task can be worked: it is pending, due, not expired and its parents are done
+func (t *task) ready(now time.Time) bool {
+	return t.pending() && t.due(now) && t.live(now) && t.parentsDone()
+}
+
+// heldBy reports whether the session holds an unexpired lease on the task
+func (t *task) heldBy(sessionID int64, now time.Time) bool {
+	return t.sessionID == sessionID && !t.leaseExpires.Before(now)
+}
+
+// scan returns the lock.Task handed to a ScanTask.  A *lock.QueueTask is copied with the attempts, checkpoint and expiry of the row.
+func (t *task) scan() lock.Task {
+	qt, ok := t.task.(*lock.QueueTask)
+	if !ok {
+		return t.task
+	}
+	scanned := *qt
+	scanned.Attempts = t.attempts
+	scanned.Checkpoint = t.checkpoint
+	scanned.ExpiresAt = t.expiresAt
+	return &scanned
+}
+
+// Option changes optional behavior of a DB
+type Option func(d *DB)
+
+// WithClock makes the DB read the time from now, so tests can expire sessions and leases without waiting
+func WithClock(now func() time.Time) Option {
+	return func(d *DB) {
+		d.now = now
+	}
+}
+
+// WithSessionTTL sets how long a session lives after it is started or bumped.  The default is DefaultSessionTTL.
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(d *DB) {
+		d.sessionTTL = ttl
+	}
+}
+
+// WithLeaseDuration sets how long a session holds a task it picks up.  The default is DefaultLeaseDuration.
+func WithLeaseDuration(lease time.Duration) Option {
+	return func(d *DB) {
+		d.leaseDuration = lease
+	}
+}
+
+// New will create a new, empty DB
+func New(opts ...Option) *DB {
+	d := &DB{
+		now:           time.Now,
+		sessionTTL:    DefaultSessionTTL,
+		leaseDuration: DefaultLeaseDuration,
+		sessions:      make(map[int64]time.Time),
+		byID:          make(map[string]*task),
+		leaders:       make(map[string]int64),
+		fires:         make(map[string][]*lock.ScheduledFire),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// StartSession starts a new session that expires after the session TTL unless it is bumped
+func (d *DB) StartSession(ctx context.Context) (int64, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastSessionID++
+	d.sessions[d.lastSessionID] = d.now().Add(d.sessionTTL)
+	return d.lastSessionID, nil
+}
+
+// BumpSession extends the session.  It returns lock.SQLErrorSessionNotFound if the session is unknown or expired.
+func (d *DB) BumpSession(ctx context.Context, sessionID int64) glitch.DataError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.bump(sessionID, d.now())
+}
+
+// EndSession expires the session so its tasks go back to the pool
+func (d *DB) EndSession(ctx context.Context, sessionID int64) glitch.DataError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.sessions[sessionID]; ok {
+		d.sessions[sessionID] = time.Time{}
+	}
+	return nil
+}
+
+// GetWork bumps the session, balances the pending tasks across the active sessions and returns the tasks this session holds.
+// Each task is handed to scanTask as a row holding the lock.Task it was added with, see ScanTask.
+func (d *DB) GetWork(ctx context.Context, sessionID int64, tasksPerSession int64, scanTask lock.ScanTask) ([]lock.Task, glitch.DataError) {
+	return d.GetWorkPage(ctx, sessionID, tasksPerSession, 0, "", scanTask)
+}
+
+// GetWorkPage does the same as GetWork but only returns the first batchSize tasks that were added after the task with afterID.
+// A batchSize of 0 returns every task and an empty afterID starts from the first task.
+func (d *DB) GetWorkPage(ctx context.Context, sessionID int64, tasksPerSession int64, batchSize int64, afterID string, scanTask lock.ScanTask) ([]lock.Task, glitch.DataError) {
+	owned, dbErr := d.getWork(sessionID, tasksPerSession, afterID)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	if batchSize > 0 && int64(len(owned)) > batchSize {
+		owned = owned[:batchSize]
+	}
+
+	tasks := make([]lock.Task, 0, len(owned))
+	for _, t := range owned {
+		scanned, dbErr := scanTask(row{task: t})
+		if dbErr != nil {
+			return nil, dbErr
+		}
+		tasks = append(tasks, scanned)
+	}
+	return tasks, nil
+}
+
+// getWork is get_work: it picks up tasks for the session while holding the lock and returns the tasks ready to run after afterID.
+// Only the first page picks up tasks, the pages after it read on through the tasks the session already holds.
+func (d *DB) getWork(sessionID int64, tasksPerSession int64, afterID string) ([]lock.Task, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	dbErr := d.bump(sessionID, now)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	if afterID == "" {
+		d.balance(sessionID, tasksPerSession, now)
+	}
+
+	// tasks are ordered by when they were added, the page starts after the task with afterID
+	_, after := d.byID[afterID]
+	var owned []lock.Task
+	for _, t := range d.tasks {
+		if after {
+			after = t.task.GetID() != afterID
+			continue
+		}
+		if t.pending() && t.due(now) && t.live(now) && t.heldBy(sessionID, now) {
+			owned = append(owned, t.scan())
+		}
+	}
+	return owned, nil
+}
+
+// balance picks up the session's share of the pending tasks, the caller must hold the lock
+func (d *DB) balance(sessionID int64, tasksPerSession int64, now time.Time) {
+	var sessions int64
+	for _, expires := range d.sessions {
+		if !expires.Before(now) {
+			sessions++
+		}
+	}
+	var taskCount, sessionCount int64
+	for _, t := range d.tasks {
+		if t.ready(now) {
+			taskCount++
+		}
+		if t.pending() && t.heldBy(sessionID, now) {
+			sessionCount++
+		}
+	}
+
+	// the ideal count is the pending tasks split across the sessions, rounded up, and capped at tasksPerSession
+	idealCount := (taskCount + sessions - 1) / sessions
+	if tasksPerSession < idealCount {
+		idealCount = tasksPerSession
+	}
+
+	for _, t := range d.tasks {
+		if sessionCount >= idealCount {
+			break
+		}
+		if t.ready(now) && d.available(t, now) {
+			t.sessionID = sessionID
+			t.leaseExpires = now.Add(d.leaseDuration)
+			sessionCount++
+		}
+	}
+}
+
+// FinishTasks flags the pending tasks with taskIDs as finished so they are never picked up again.
+// Tasks that expired before they finished are not recorded, like finish_tasks.
+func (d *DB) FinishTasks(ctx context.Context, taskIDs []string) glitch.DataError {
+	finished := make([]lock.FinishedTask, len(taskIDs))
+	for i, id := range taskIDs {
+		finished[i] = lock.FinishedTask{TaskID: id}
+	}
+	return d.FinishTasksWithResults(ctx, finished)
+}
+
+// AddTasks adds tasks to the pool that can be picked up right away.  Tasks with an ID already in the DB are ignored.
+func (d *DB) AddTasks(tasks ...lock.Task) {
+	d.AddTasksAt(time.Time{}, tasks...)
+}
+
+// AddTasksAt adds tasks to the pool that can not be picked up before at.  Tasks with an ID already in the DB are ignored.
+func (d *DB) AddTasksAt(at time.Time, tasks ...lock.Task) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, t := range tasks {
+		id := t.GetID()
+		if _, ok := d.byID[id]; ok {
+			continue
+		}
+		d.add(&task{task: t, notBefore: at})
+	}
+}
+
+// add adds t to the pool as a pending task, the caller must hold the lock
+func (d *DB) add(t *task) {
+	t.state = lock.TaskPending
+	if et, ok := t.task.(lock.ExpiringTask); ok {
+		t.expiresAt = et.GetExpiresAt()
+	}
+	if t.onParentFailure == "" {
+		t.onParentFailure = lock.CancelOnParentFailure
+	}
+	d.tasks = append(d.tasks, t)
+	d.byID[t.task.GetID()] = t
+}
+
+// Owner returns the active session holding the task with id, or false if the task is unknown, finished or not held
+func (d *DB) Owner(id string) (int64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.byID[id]
+	if !ok || !t.pending() || d.available(t, d.now()) {
+		return 0, false
+	}
+	return t.sessionID, true
+}
+
+// Owned returns the IDs of the pending tasks the session holds in the order they were added
+func (d *DB) Owned(sessionID int64) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	var ids []string
+	for _, t := range d.tasks {
+		if t.pending() && t.sessionID == sessionID && !d.available(t, now) {
+			ids = append(ids, t.task.GetID())
+		}
+	}
+	return ids
+}
+
+// Pending returns the IDs of the tasks that are not finished in the order they were added
+func (d *DB) Pending() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ids []string
+	for _, t := range d.tasks {
+		if t.pending() {
+			ids = append(ids, t.task.GetID())
+		}
+	}
+	return ids
+}
+
+// State returns the state of the task with id, or false if the task is unknown
+func (d *DB) State(id string) (lock.TaskState, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.byID[id]
+	if !ok {
+		return "", false
+	}
+	return t.state, true
+}
+
+// Finished reports whether the task with id has been finished
+func (d *DB) Finished(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.byID[id]
+	return ok && t.state == lock.TaskFinished
+}
+
+// Sessions returns the IDs of the active sessions in ascending order
+func (d *DB) Sessions() []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	var ids []int64
+	for id, expires := range d.sessions {
+		if !expires.Before(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// ExpireSession expires the session as if its Runner had stopped bumping it, without ending it cleanly
+func (d *DB) ExpireSession(sessionID int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.sessions[sessionID]; ok {
+		d.sessions[sessionID] = d.now().Add(-time.Nanosecond)
+	}
+}
+
+// bump is bump_session, the caller must hold the lock
+func (d *DB) bump(sessionID int64, now time.Time) glitch.DataError {
+	expires, ok := d.sessions[sessionID]
+	if !ok || expires.Before(now) {
+		return glitch.NewDataError(errors.New("Session not found."), lock.SQLErrorSessionNotFound, "Error bumping session")
+	}
+	d.sessions[sessionID] = now.Add(d.sessionTTL)
+	return nil
+}
+
+// available reports whether the task can be picked up: it has no session, an expired session or an expired lease.
+// The caller must hold the lock.
+func (d *DB) available(t *task, now time.Time) bool {
+	if t.sessionID == 0 || t.leaseExpires.Before(now) {
+		return true
+	}
+	expires, ok := d.sessions[t.sessionID]
+	return ok && expires.Before(now)
+}
+
+// row is the Scanner handed to a ScanTask, it holds the lock.Task a task was added with
+type row struct {
+	task lock.Task
+}
+
+// Scan sets the single dest, which must be a pointer to a type the task is assignable to, such as *lock.Task
+func (r row) Scan(dest ...interface{}) error {
+	if len(dest) != 1 {
+		return fmt.Errorf("memdb rows scan into 1 destination, got %d", len(dest))
+	}
+	v := reflect.ValueOf(dest[0])
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("memdb rows scan into a non nil pointer, got %T", dest[0])
+	}
+	t := reflect.ValueOf(r.task)
+	if !t.Type().AssignableTo(v.Elem().Type()) {
+		return fmt.Errorf("memdb task %T can not be scanned into %T", r.task, dest[0])
+	}
+	v.Elem().Set(t)
+	return nil
+}
+
+// ScanTask scans the task handed to it by a DB.  Use it as the ScanTask of a Runner.
+func ScanTask(row lock.Scanner) (lock.Task, glitch.DataError) {
+	return ScanTyped[lock.Task](row)
+}
+
+// ScanTyped scans the task handed to it by a DB as a T.  Use it as the TypedScanTask of a TypedRunner.
+func ScanTyped[T lock.Task](row lock.Scanner) (T, glitch.DataError) {
+	var t T
+	err := row.Scan(&t)
+	if err != nil {
+		return t, glitch.NewDataError(err, lock.ErrorScanningTask, "Error scanning task")
+	}
+	return t, nil
+}
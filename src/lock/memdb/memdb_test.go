@@ -0,0 +1,394 @@
+package memdb
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+type testTask struct {
+	ID string
+}
+
+func (t *testTask) GetID() string {
+	return t.ID
+}
+
+// clock is a time source tests move forward by hand
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newTestDB(t *testing.T, tasks int, opts ...Option) (*DB, *clock) {
+	t.Helper()
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	db := New(append([]Option{WithClock(c.Now)}, opts...)...)
+	for i := 1; i <= tasks; i++ {
+		db.AddTasks(&testTask{ID: strconv.Itoa(i)})
+	}
+	return db, c
+}
+
+func mustStart(t *testing.T, db *DB) int64 {
+	t.Helper()
+	sessionID, dbErr := db.StartSession(context.Background())
+	if dbErr != nil {
+		t.Fatalf("Error starting session: %v", dbErr)
+	}
+	return sessionID
+}
+
+func mustGetWork(t *testing.T, db *DB, sessionID int64, tasksPerSession int64) []string {
+	t.Helper()
+	tasks, dbErr := db.GetWork(context.Background(), sessionID, tasksPerSession, ScanTask)
+	if dbErr != nil {
+		t.Fatalf("Error getting work for session %d: %v", sessionID, dbErr)
+	}
+	ids := make([]string, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.GetID()
+	}
+	return ids
+}
+
+func TestGetWorkBalancesSessions(t *testing.T) {
+	db, _ := newTestDB(t, 10)
+	first := mustStart(t, db)
+	second := mustStart(t, db)
+	third := mustStart(t, db)
+
+	// 10 tasks split across 3 sessions rounds up to 4 each, the last session gets what is left
+	for _, tt := range []struct {
+		sessionID int64
+		want      int
+	}{{first, 4}, {second, 4}, {third, 2}} {
+		got := mustGetWork(t, db, tt.sessionID, 100)
+		if len(got) != tt.want {
+			t.Errorf("Session %d got %d tasks %v, want %d", tt.sessionID, len(got), got, tt.want)
+		}
+	}
+
+	seen := make(map[string]int64)
+	for _, sessionID := range []int64{first, second, third} {
+		for _, id := range db.Owned(sessionID) {
+			if other, ok := seen[id]; ok {
+				t.Errorf("Task %s is held by sessions %d and %d", id, other, sessionID)
+			}
+			seen[id] = sessionID
+		}
+	}
+	if len(seen) != 10 {
+		t.Errorf("%d tasks are held, want 10", len(seen))
+	}
+}
+
+func TestGetWorkCapsAtTasksPerSession(t *testing.T) {
+	db, _ := newTestDB(t, 10)
+	sessionID := mustStart(t, db)
+
+	got := mustGetWork(t, db, sessionID, 3)
+	if len(got) != 3 {
+		t.Errorf("Got %d tasks %v, want 3", len(got), got)
+	}
+}
+
+func TestGetWorkRebalancesExpiredSession(t *testing.T) {
+	db, c := newTestDB(t, 4)
+	first := mustStart(t, db)
+	mustGetWork(t, db, first, 100)
+
+	// the first session stops bumping, so the second takes over its tasks
+	c.now = c.now.Add(DefaultSessionTTL / 2)
+	second := mustStart(t, db)
+	c.now = c.now.Add(DefaultSessionTTL/2 + time.Second)
+
+	got := mustGetWork(t, db, second, 100)
+	if len(got) != 4 {
+		t.Errorf("Got %d tasks %v, want the 4 tasks of the expired session", len(got), got)
+	}
+}
+
+func TestGetWorkExpiredSession(t *testing.T) {
+	db, c := newTestDB(t, 1)
+	sessionID := mustStart(t, db)
+	c.now = c.now.Add(DefaultSessionTTL + time.Second)
+
+	_, dbErr := db.GetWork(context.Background(), sessionID, 100, ScanTask)
+	if dbErr == nil || dbErr.Code() != lock.SQLErrorSessionNotFound {
+		t.Fatalf("GetWork on an expired session returned %v, want %s", dbErr, lock.SQLErrorSessionNotFound)
+	}
+	dbErr = db.BumpSession(context.Background(), sessionID)
+	if dbErr == nil || dbErr.Code() != lock.SQLErrorSessionNotFound {
+		t.Fatalf("BumpSession on an expired session returned %v, want %s", dbErr, lock.SQLErrorSessionNotFound)
+	}
+}
+
+func TestGetWorkEndedSession(t *testing.T) {
+	db, _ := newTestDB(t, 1)
+	sessionID := mustStart(t, db)
+	mustGetWork(t, db, sessionID, 100)
+
+	dbErr := db.EndSession(context.Background(), sessionID)
+	if dbErr != nil {
+		t.Fatalf("Error ending session: %v", dbErr)
+	}
+	_, dbErr = db.GetWork(context.Background(), sessionID, 100, ScanTask)
+	if dbErr == nil || dbErr.Code() != lock.SQLErrorSessionNotFound {
+		t.Fatalf("GetWork on an ended session returned %v, want %s", dbErr, lock.SQLErrorSessionNotFound)
+	}
+	if _, ok := db.Owner("1"); ok {
+		t.Errorf("Task 1 is still held after its session ended")
+	}
+}
+
+func TestGetWorkPage(t *testing.T) {
+	db, _ := newTestDB(t, 5)
+	sessionID := mustStart(t, db)
+
+	var pages [][]string
+	afterID := ""
+	for {
+		tasks, dbErr := db.GetWorkPage(context.Background(), sessionID, 100, 2, afterID, ScanTask)
+		if dbErr != nil {
+			t.Fatalf("Error getting page after %q: %v", afterID, dbErr)
+		}
+		if len(tasks) == 0 {
+			break
+		}
+		page := make([]string, len(tasks))
+		for i, task := range tasks {
+			page[i] = task.GetID()
+		}
+		pages = append(pages, page)
+		afterID = page[len(page)-1]
+	}
+	if len(pages) != 3 || pages[0][0] != "1" || pages[1][0] != "3" || pages[2][0] != "5" {
+		t.Errorf("Got pages %v, want [[1 2] [3 4] [5]]", pages)
+	}
+}
+
+func TestGetWorkPageOnlyFirstPagePicksUp(t *testing.T) {
+	db, _ := newTestDB(t, 5)
+	sessionID := mustStart(t, db)
+	ctx := context.Background()
+
+	first, dbErr := db.GetWorkPage(ctx, sessionID, 2, 2, "", ScanTask)
+	if dbErr != nil {
+		t.Fatalf("Error getting the first page: %v", dbErr)
+	}
+	if len(first) != 2 || first[0].GetID() != "1" || first[1].GetID() != "2" {
+		t.Fatalf("Got first page %v, want tasks 1 and 2", first)
+	}
+	dbErr = db.FinishTasks(ctx, []string{"1", "2"})
+	if dbErr != nil {
+		t.Fatalf("Error finishing tasks: %v", dbErr)
+	}
+
+	// the session has room for more tasks but only the first page picks them up
+	next, dbErr := db.GetWorkPage(ctx, sessionID, 2, 2, "2", ScanTask)
+	if dbErr != nil {
+		t.Fatalf("Error getting the next page: %v", dbErr)
+	}
+	if len(next) != 0 {
+		t.Errorf("Got next page %v, want no tasks picked up after the first page", next)
+	}
+	again, dbErr := db.GetWorkPage(ctx, sessionID, 2, 2, "", ScanTask)
+	if dbErr != nil {
+		t.Fatalf("Error getting the first page again: %v", dbErr)
+	}
+	if len(again) != 2 || again[0].GetID() != "3" || again[1].GetID() != "4" {
+		t.Errorf("Got first page %v, want tasks 3 and 4", again)
+	}
+}
+
+func TestFinishTasks(t *testing.T) {
+	db, c := newTestDB(t, 2, WithSessionTTL(24*time.Hour))
+	db.AddTasksAt(c.now.Add(time.Hour), &testTask{ID: "later"})
+	sessionID := mustStart(t, db)
+
+	if got := mustGetWork(t, db, sessionID, 100); len(got) != 2 {
+		t.Errorf("Got tasks %v, want the 2 that are due", got)
+	}
+	dbErr := db.FinishTasks(context.Background(), []string{"1"})
+	if dbErr != nil {
+		t.Fatalf("Error finishing tasks: %v", dbErr)
+	}
+	if !db.Finished("1") || db.Finished("2") {
+		t.Errorf("Finished 1 %v and 2 %v, want only 1", db.Finished("1"), db.Finished("2"))
+	}
+
+	c.now = c.now.Add(time.Hour)
+	got := mustGetWork(t, db, sessionID, 100)
+	if len(got) != 2 || got[0] != "2" || got[1] != "later" {
+		t.Errorf("Got tasks %v, want 2 and the task that became due", got)
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	db, c := newTestDB(t, 1, WithSessionTTL(24*time.Hour))
+	ctx := context.Background()
+	sessionID := mustStart(t, db)
+	mustGetWork(t, db, sessionID, 100)
+
+	c.now = c.now.Add(DefaultLeaseDuration - time.Second)
+	dbErr := db.ExtendLease(ctx, sessionID, "1", time.Hour)
+	if dbErr != nil {
+		t.Fatalf("Error extending lease: %v", dbErr)
+	}
+	c.now = c.now.Add(time.Minute)
+	if owner, ok := db.Owner("1"); !ok || owner != sessionID {
+		t.Errorf("Task 1 is held by %d %v after its lease was extended, want %d", owner, ok, sessionID)
+	}
+
+	dbErr = db.ExtendLease(ctx, sessionID+1, "1", time.Hour)
+	if dbErr == nil || dbErr.Code() != lock.SQLErrorLeaseNotFound {
+		t.Errorf("ExtendLease by another session returned %v, want %s", dbErr, lock.SQLErrorLeaseNotFound)
+	}
+}
+
+func TestRetryTasksFailsAtMaxAttempts(t *testing.T) {
+	db, _ := newTestDB(t, 1)
+	ctx := context.Background()
+	sessionID := mustStart(t, db)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		got := mustGetWork(t, db, sessionID, 100)
+		if len(got) != 1 {
+			t.Fatalf("Attempt %d got tasks %v, want [1]", attempt, got)
+		}
+		dbErr := db.RetryTasks(ctx, []lock.TaskFailure{{TaskID: "1", Error: "boom", MaxAttempts: 3}})
+		if dbErr != nil {
+			t.Fatalf("Error retrying task: %v", dbErr)
+		}
+	}
+
+	if state, _ := db.State("1"); state != lock.TaskDead {
+		t.Fatalf("Task 1 is %s after 3 attempts, want %s", state, lock.TaskDead)
+	}
+	dead, dbErr := db.GetDeadTasks(ctx, lock.DeadTaskFilter{TaskIDs: []string{"1"}})
+	if dbErr != nil {
+		t.Fatalf("Error getting dead tasks: %v", dbErr)
+	}
+	if len(dead) != 1 || dead[0].Attempts != 3 || len(dead[0].ErrorHistory) != 3 {
+		t.Fatalf("Got dead tasks %+v, want task 1 with 3 attempts", dead)
+	}
+
+	count, dbErr := db.RequeueDeadTasks(ctx, lock.DeadTaskByID(dead[0].ID))
+	if dbErr != nil || count != 1 {
+		t.Fatalf("RequeueDeadTasks returned %d, %v, want 1", count, dbErr)
+	}
+	if got := mustGetWork(t, db, sessionID, 100); len(got) != 1 {
+		t.Errorf("Got tasks %v after requeueing, want [1]", got)
+	}
+}
+
+func TestRequeueDeadTasksClearsDedupeKey(t *testing.T) {
+	db, _ := newTestDB(t, 0)
+	ctx := context.Background()
+	results, dbErr := db.EnqueueTasks(ctx, []lock.EnqueueRequest{lock.RunNow(&lock.QueueTask{Queue: "q"}).Dedupe("key", 0)})
+	if dbErr != nil {
+		t.Fatalf("Error enqueueing task: %v", dbErr)
+	}
+	dbErr = db.FailTasks(ctx, []lock.TaskFailure{{TaskID: results[0].ID, Error: "boom"}})
+	if dbErr != nil {
+		t.Fatalf("Error failing task: %v", dbErr)
+	}
+	count, dbErr := db.RequeueDeadTasks(ctx, lock.DeadTaskFilter{TaskIDs: []string{results[0].ID}})
+	if dbErr != nil || count != 1 {
+		t.Fatalf("RequeueDeadTasks returned %d, %v, want 1", count, dbErr)
+	}
+
+	// the requeued task no longer holds the key, like requeue_dead_tasks
+	again, dbErr := db.EnqueueTasks(ctx, []lock.EnqueueRequest{lock.RunNow(&lock.QueueTask{Queue: "q"}).Dedupe("key", 0)})
+	if dbErr != nil {
+		t.Fatalf("Error enqueueing task: %v", dbErr)
+	}
+	if again[0].Deduplicated || again[0].ID == results[0].ID {
+		t.Errorf("Got %+v, want a new task", again[0])
+	}
+}
+
+func TestEnqueueTasksWaitsOnParents(t *testing.T) {
+	db, _ := newTestDB(t, 0)
+	ctx := context.Background()
+	parent := &lock.QueueTask{Queue: "q"}
+	results, dbErr := db.EnqueueTasks(ctx, []lock.EnqueueRequest{lock.RunNow(parent)})
+	if dbErr != nil {
+		t.Fatalf("Error enqueueing parent: %v", dbErr)
+	}
+	parentID := results[0].ID
+	if parent.ID != 0 {
+		t.Errorf("EnqueueTasks set the ID of the caller's task to %d", parent.ID)
+	}
+	results, dbErr = db.EnqueueTasks(ctx, []lock.EnqueueRequest{
+		lock.RunNow(&lock.QueueTask{Queue: "q"}).After(parentID),
+		lock.RunNow(&lock.QueueTask{Queue: "q"}).Dedupe("key", 0),
+		lock.RunNow(&lock.QueueTask{Queue: "q"}).Dedupe("key", 0),
+	})
+	if dbErr != nil {
+		t.Fatalf("Error enqueueing children: %v", dbErr)
+	}
+	childID := results[0].ID
+	if !results[2].Deduplicated || results[2].ID != results[1].ID {
+		t.Errorf("Got results %+v, want the last request deduplicated into the one before it", results)
+	}
+
+	sessionID := mustStart(t, db)
+	got := mustGetWork(t, db, sessionID, 100)
+	for _, id := range got {
+		if id == childID {
+			t.Fatalf("Child %s was picked up before its parent %s finished", childID, parentID)
+		}
+	}
+
+	dbErr = db.FailTasks(ctx, []lock.TaskFailure{{TaskID: parentID, Error: "boom"}})
+	if dbErr != nil {
+		t.Fatalf("Error failing parent: %v", dbErr)
+	}
+	if state, _ := db.State(childID); state != lock.TaskCancelled {
+		t.Errorf("Child is %s after its parent died, want %s", state, lock.TaskCancelled)
+	}
+
+	_, dbErr = db.EnqueueTasks(ctx, []lock.EnqueueRequest{lock.RunNow(&lock.QueueTask{Queue: "q"}).After("404")})
+	if dbErr == nil || dbErr.Code() != lock.SQLErrorParentNotFound {
+		t.Errorf("Enqueueing with an unknown parent returned %v, want %s", dbErr, lock.SQLErrorParentNotFound)
+	}
+}
+
+func TestFinishScheduledFireReclaimed(t *testing.T) {
+	db, c := newTestDB(t, 0)
+	ctx := context.Background()
+	fireTime := c.now
+	first := mustStart(t, db)
+	if claimed, _ := db.ClaimScheduledFire(ctx, "job", fireTime, first); !claimed {
+		t.Fatalf("The first session could not claim the fire")
+	}
+
+	// the first session expires while running the fire and the second claims it again
+	c.now = c.now.Add(DefaultSessionTTL / 2)
+	second := mustStart(t, db)
+	c.now = c.now.Add(DefaultSessionTTL/2 + time.Second)
+	if claimed, _ := db.ClaimScheduledFire(ctx, "job", fireTime, second); !claimed {
+		t.Fatalf("The second session could not claim the orphaned fire")
+	}
+
+	for _, tt := range []struct {
+		sessionID int64
+		want      bool
+	}{{first, false}, {second, true}, {second, false}} {
+		finished, dbErr := db.FinishScheduledFire(ctx, "job", fireTime, tt.sessionID, "")
+		if dbErr != nil {
+			t.Fatalf("Error finishing the fire: %v", dbErr)
+		}
+		if finished != tt.want {
+			t.Errorf("Session %d finished the fire %v, want %v", tt.sessionID, finished, tt.want)
+		}
+	}
+}
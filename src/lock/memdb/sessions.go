@@ -0,0 +1,130 @@
+package memdb
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// ClaimLeadership bumps the session, makes it the leader of role if there is no live leader and returns whether it leads role
+func (d *DB) ClaimLeadership(ctx context.Context, role string, sessionID int64) (bool, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	dbErr := d.bump(sessionID, now)
+	if dbErr != nil {
+		return false, dbErr
+	}
+	leaderID, ok := d.leaders[role]
+	if !ok || !d.active(leaderID, now) {
+		d.leaders[role] = sessionID
+		leaderID = sessionID
+	}
+	return leaderID == sessionID, nil
+}
+
+// ClaimScheduledFire bumps the session and records the fire for it.  It returns false if another session already claimed the fire.
+// A fire whose session expired before finishing it is handed to the new session so it is run again.
+func (d *DB) ClaimScheduledFire(ctx context.Context, jobName string, fireTime time.Time, sessionID int64) (bool, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	dbErr := d.bump(sessionID, now)
+	if dbErr != nil {
+		return false, dbErr
+	}
+	fire := d.fire(jobName, fireTime)
+	if fire == nil {
+		d.fires[jobName] = append(d.fires[jobName], &lock.ScheduledFire{JobName: jobName, FireTime: fireTime, SessionID: sessionID, Claimed: now})
+		return true, nil
+	}
+	if !fire.Finished.IsZero() || d.active(fire.SessionID, now) {
+		return false, nil
+	}
+	fire.SessionID = sessionID
+	fire.Claimed = now
+	fire.Error = ""
+	return true, nil
+}
+
+// FinishScheduledFire flags the fire as finished, with errMessage if it failed.
+// It returns false if the session no longer holds the fire because another session claimed it again.
+func (d *DB) FinishScheduledFire(ctx context.Context, jobName string, fireTime time.Time, sessionID int64, errMessage string) (bool, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fire := d.fire(jobName, fireTime)
+	if fire == nil || fire.SessionID != sessionID || !fire.Finished.IsZero() {
+		return false, nil
+	}
+	fire.Finished = d.now()
+	fire.Error = errMessage
+	return true, nil
+}
+
+// GetLastScheduledFire returns the latest recorded fire time of the job or the zero time if it has never fired
+func (d *DB) GetLastScheduledFire(ctx context.Context, jobName string) (time.Time, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var last time.Time
+	for _, fire := range d.fires[jobName] {
+		if fire.FireTime.After(last) {
+			last = fire.FireTime
+		}
+	}
+	return last, nil
+}
+
+// GetScheduledFires returns up to limit of the fires of the job, newest first
+func (d *DB) GetScheduledFires(ctx context.Context, jobName string, limit int64) ([]lock.ScheduledFire, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fires := make([]lock.ScheduledFire, 0, len(d.fires[jobName]))
+	for _, fire := range d.fires[jobName] {
+		fires = append(fires, *fire)
+	}
+	sort.Slice(fires, func(i, j int) bool { return fires[i].FireTime.After(fires[j].FireTime) })
+	if limit >= 0 && int64(len(fires)) > limit {
+		fires = fires[:limit]
+	}
+	return fires, nil
+}
+
+// GetOrphanedScheduledFires returns the fire times of the job, oldest first, that were claimed by a session that expired before finishing them
+func (d *DB) GetOrphanedScheduledFires(ctx context.Context, jobName string) ([]time.Time, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	var orphaned []time.Time
+	for _, fire := range d.fires[jobName] {
+		if fire.Finished.IsZero() && !d.active(fire.SessionID, now) {
+			orphaned = append(orphaned, fire.FireTime)
+		}
+	}
+	sort.Slice(orphaned, func(i, j int) bool { return orphaned[i].Before(orphaned[j]) })
+	return orphaned, nil
+}
+
+// fire returns the fire of the job at fireTime or nil if it was never claimed, the caller must hold the lock
+func (d *DB) fire(jobName string, fireTime time.Time) *lock.ScheduledFire {
+	for _, fire := range d.fires[jobName] {
+		if fire.FireTime.Equal(fireTime) {
+			return fire
+		}
+	}
+	return nil
+}
+
+// active reports whether the session has not ended or expired, the caller must hold the lock
+func (d *DB) active(sessionID int64, now time.Time) bool {
+	expires, ok := d.sessions[sessionID]
+	return ok && !expires.Before(now)
+}
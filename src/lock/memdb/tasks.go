@@ -0,0 +1,370 @@
+package memdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// ExtendLease extends the lease the session holds on the task.  It returns lock.SQLErrorLeaseNotFound if the session no longer holds it.
+func (d *DB) ExtendLease(ctx context.Context, sessionID int64, taskID string, duration time.Duration) glitch.DataError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	t, dbErr := d.held(sessionID, taskID, now, "Error extending lease")
+	if dbErr != nil {
+		return dbErr
+	}
+	t.leaseExpires = now.Add(duration)
+	return nil
+}
+
+// SaveCheckpoint saves state with the task so the next session to pick it up resumes from it.
+// It returns lock.SQLErrorLeaseNotFound if the session no longer holds the task.
+func (d *DB) SaveCheckpoint(ctx context.Context, sessionID int64, taskID string, state []byte) glitch.DataError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, dbErr := d.held(sessionID, taskID, d.now(), "Error saving checkpoint")
+	if dbErr != nil {
+		return dbErr
+	}
+	t.checkpoint = append([]byte(nil), state...)
+	return nil
+}
+
+// held returns the pending task the session holds an unexpired lease on, the caller must hold the lock
+func (d *DB) held(sessionID int64, taskID string, now time.Time, msg string) (*task, glitch.DataError) {
+	t, ok := d.byID[taskID]
+	if !ok || !t.pending() || !t.heldBy(sessionID, now) {
+		return nil, glitch.NewDataError(errors.New("Lease not found."), lock.SQLErrorLeaseNotFound, msg)
+	}
+	return t, nil
+}
+
+// GetNextTaskDue returns when the next pending task that is not yet due becomes due, or the zero time if there is none
+func (d *DB) GetNextTaskDue(ctx context.Context) (time.Time, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	var next time.Time
+	for _, t := range d.tasks {
+		if t.pending() && t.notBefore.After(now) && (next.IsZero() || t.notBefore.Before(next)) {
+			next = t.notBefore
+		}
+	}
+	return next, nil
+}
+
+// EnqueueTasks adds tasks to the pool like enqueue_task, deduplicating them by DedupeKey and waiting on their Parents.
+// A *lock.QueueTask with an ID of 0 is copied and given the next free ID.  Any other task must have an ID that is not in the DB yet.
+func (d *DB) EnqueueTasks(ctx context.Context, tasks []lock.EnqueueRequest) ([]lock.EnqueueResult, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	results := make([]lock.EnqueueResult, len(tasks))
+	for i, req := range tasks {
+		parents := make([]*task, 0, len(req.Parents))
+		for _, id := range req.Parents {
+			p, ok := d.byID[id]
+			if !ok {
+				return nil, glitch.NewDataError(errors.New("Parent task not found."), lock.SQLErrorParentNotFound, "Error enqueueing task")
+			}
+			parents = append(parents, p)
+		}
+
+		if req.DedupeKey != "" {
+			if t := d.deduplicate(req.DedupeKey, req.DedupeWindow, now); t != nil {
+				results[i] = lock.EnqueueResult{ID: t.task.GetID(), Deduplicated: true}
+				continue
+			}
+		}
+
+		queued, dbErr := d.newTask(req.Task)
+		if dbErr != nil {
+			return nil, dbErr
+		}
+		t := &task{task: queued, notBefore: req.NotBefore, dedupeKey: req.DedupeKey, parents: parents, onParentFailure: req.OnParentFailure}
+		d.add(t)
+		if !req.ExpiresAt.IsZero() {
+			t.expiresAt = req.ExpiresAt
+		}
+
+		// a parent may already have failed
+		if t.onParentFailure == lock.CancelOnParentFailure {
+			for _, p := range parents {
+				if p.failed() {
+					d.cancelDescendants([]*task{t}, false)
+					break
+				}
+			}
+		}
+		results[i] = lock.EnqueueResult{ID: queued.GetID()}
+	}
+	return results, nil
+}
+
+// deduplicate returns the latest task with key that is pending or finished within window, the caller must hold the lock
+func (d *DB) deduplicate(key string, window time.Duration, now time.Time) *task {
+	for i := len(d.tasks) - 1; i >= 0; i-- {
+		t := d.tasks[i]
+		if t.dedupeKey != key {
+			continue
+		}
+		if t.pending() || (t.state == lock.TaskFinished && t.finished.Add(window).After(now)) {
+			return t
+		}
+	}
+	return nil
+}
+
+// newTask returns the task to add for queued, giving a *lock.QueueTask without an ID the next free one.  The caller must hold the lock.
+func (d *DB) newTask(queued lock.Task) (lock.Task, glitch.DataError) {
+	if qt, ok := queued.(*lock.QueueTask); ok && qt.ID == 0 {
+		copied := *qt
+		for {
+			d.lastTaskID++
+			if _, ok := d.byID[strconv.FormatInt(d.lastTaskID, 10)]; !ok {
+				break
+			}
+		}
+		copied.ID = d.lastTaskID
+		return &copied, nil
+	}
+	id := queued.GetID()
+	if _, ok := d.byID[id]; ok || id == "" {
+		msg := fmt.Sprintf("Task %q is empty or already in the DB", id)
+		return nil, glitch.NewDataError(errors.New(msg), lock.ErrorInvalidTaskID, msg)
+	}
+	return queued, nil
+}
+
+// FinishTasksWithResults flags the pending tasks as finished and stores their results, like finish_tasks
+func (d *DB) FinishTasksWithResults(ctx context.Context, tasks []lock.FinishedTask) glitch.DataError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	for _, f := range tasks {
+		t, ok := d.byID[f.TaskID]
+		if !ok || !t.pending() || !t.live(now) {
+			continue
+		}
+		t.state = lock.TaskFinished
+		t.finished = now
+		t.result = f.Result
+	}
+	return nil
+}
+
+// GetTaskResult returns the state of the task and what it produced, or nil if there is no such task
+func (d *DB) GetTaskResult(ctx context.Context, taskID string) (*lock.StoredResult, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.byID[taskID]
+	if !ok {
+		return nil, nil
+	}
+	return &lock.StoredResult{TaskID: taskID, State: t.state, Result: t.result, Finished: t.finished}, nil
+}
+
+// PurgeTaskResults removes the results of tasks that finished before finishedBefore and returns how many were removed
+func (d *DB) PurgeTaskResults(ctx context.Context, finishedBefore time.Time) (int64, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var count int64
+	for _, t := range d.tasks {
+		if t.result != nil && t.finished.Before(finishedBefore) {
+			t.result = nil
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ExpireTasks flags pending tasks past their expiry as expired, cancels their descendants and returns how many expired
+func (d *DB) ExpireTasks(ctx context.Context) (int64, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	var expired []*task
+	for _, t := range d.tasks {
+		if t.pending() && !t.live(now) {
+			t.state = lock.TaskExpired
+			t.sessionID = 0
+			t.leaseExpires = time.Time{}
+			expired = append(expired, t)
+		}
+	}
+	d.cancelDescendants(expired, true)
+	return int64(len(expired)), nil
+}
+
+// CancelTasks cancels the pending tasks and their descendants and returns how many of taskIDs were cancelled.
+// The session holding a cancelled task keeps it so GetCancelledTasks finds it.
+func (d *DB) CancelTasks(ctx context.Context, taskIDs []string) (int64, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var cancelled []*task
+	for _, id := range taskIDs {
+		t, ok := d.byID[id]
+		if ok && t.pending() {
+			t.state = lock.TaskCancelled
+			cancelled = append(cancelled, t)
+		}
+	}
+	d.cancelDescendants(cancelled, true)
+	return int64(len(cancelled)), nil
+}
+
+// GetCancelledTasks returns the ids of the cancelled tasks the session still holds
+func (d *DB) GetCancelledTasks(ctx context.Context, sessionID int64) ([]string, glitch.DataError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	var ids []string
+	for _, t := range d.tasks {
+		if t.state == lock.TaskCancelled && t.heldBy(sessionID, now) {
+			ids = append(ids, t.task.GetID())
+		}
+	}
+	return ids, nil
+}
+
+// FailTasks dead letters the pending tasks and cancels their descendants, like fail_tasks
+func (d *DB) FailTasks(ctx context.Context, failures []lock.TaskFailure) glitch.DataError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	for _, f := range failures {
+		t, ok := d.byID[f.TaskID]
+		if ok && t.pending() {
+			d.fail(t, f.Error, now)
+		}
+	}
+	return nil
+}
+
+// RetryTasks gives the pending tasks back to the pool once NotBefore has passed, counting an attempt.
+// A task whose attempts reach MaxAttempts is failed instead, like retry_tasks.
+func (d *DB) RetryTasks(ctx context.Context, retries []lock.TaskFailure) glitch.DataError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	for _, r := range retries {
+		t, ok := d.byID[r.TaskID]
+		if !ok || !t.pending() {
+			continue
+		}
+		if r.MaxAttempts > 0 && t.attempts+1 >= r.MaxAttempts {
+			d.fail(t, fmt.Sprintf("gave up after %d attempts: %s", t.attempts+1, r.Error), now)
+			continue
+		}
+		t.attempts++
+		t.errorHistory = append(t.errorHistory, r.Error)
+		t.release(r.NotBefore)
+	}
+	return nil
+}
+
+// ReleaseTasks gives the pending tasks back to the pool once NotBefore has passed without counting an attempt
+func (d *DB) ReleaseTasks(ctx context.Context, releases []lock.ReleasedTask) glitch.DataError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, r := range releases {
+		t, ok := d.byID[r.TaskID]
+		if ok && t.pending() {
+			t.release(r.NotBefore)
+		}
+	}
+	return nil
+}
+
+// release takes the task from its session so it is picked up again once notBefore has passed
+func (t *task) release(notBefore time.Time) {
+	t.sessionID = 0
+	t.leaseExpires = time.Time{}
+	t.notBefore = notBefore
+}
+
+// fail is fail_tasks for a single task, the caller must hold the lock
+func (d *DB) fail(t *task, errMessage string, now time.Time) {
+	t.attempts++
+	t.errorHistory = append(t.errorHistory, errMessage)
+	t.state = lock.TaskDead
+
+	// the snapshot is best effort, a task that does not marshal is dead lettered without one
+	snapshot, _ := json.Marshal(t.task)
+	d.lastDeadID++
+	d.deadTasks = append(d.deadTasks, &lock.DeadTask{
+		ID:           d.lastDeadID,
+		TaskID:       t.task.GetID(),
+		SessionID:    t.sessionID,
+		Attempts:     t.attempts,
+		Error:        errMessage,
+		ErrorHistory: append([]string(nil), t.errorHistory...),
+		Task:         snapshot,
+		Died:         now,
+	})
+	d.cancelDescendants([]*task{t}, true)
+}
+
+// cancelDescendants is cancel_descendants: it cancels the pending tasks that can no longer run because a parent in roots failed,
+// following the graph down through every task that cancels on parent failure.  The roots are cancelled too unless childrenOnly.
+// The caller must hold the lock.
+func (d *DB) cancelDescendants(roots []*task, childrenOnly bool) {
+	isRoot := make(map[*task]bool, len(roots))
+	doomed := make(map[*task]bool, len(roots))
+	queue := append([]*task(nil), roots...)
+	for _, t := range roots {
+		isRoot[t] = true
+		doomed[t] = true
+	}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, t := range d.tasks {
+			if doomed[t] || !t.pending() || t.onParentFailure != lock.CancelOnParentFailure || !t.hasParent(parent) {
+				continue
+			}
+			doomed[t] = true
+			queue = append(queue, t)
+		}
+	}
+
+	for t := range doomed {
+		if !t.pending() || (isRoot[t] && childrenOnly) {
+			continue
+		}
+		t.state = lock.TaskCancelled
+		t.sessionID = 0
+		t.leaseExpires = time.Time{}
+	}
+}
+
+// hasParent reports whether parent is a parent of the task
+func (t *task) hasParent(parent *task) bool {
+	for _, p := range t.parents {
+		if p == parent {
+			return true
+		}
+	}
+	return false
+}
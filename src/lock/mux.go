@@ -0,0 +1,185 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/promoboxx/go-metric-client/metrics"
+)
+
+// UnknownTypeRetryAfter is how long a task whose type has no handler waits after a Mux releases it,
+// which happens while a new task type is rolled out.  Releasing does not count an attempt.
+const UnknownTypeRetryAfter = time.Minute
+
+// Mux dispatches tasks from the generic task table to a handler registered for their type,
+// so one Runner and session can work every type of task on a queue.
+// Use Mux.Tasker with NewResultRunner and ScanQueueTask.
+type Mux struct {
+	name   string
+	client metrics.Client
+	logger Logger
+
+	mutex  sync.RWMutex
+	routes map[string]*muxRoute
+}
+
+// muxRoute is the handler registered for a task type
+type muxRoute struct {
+	taskType    string
+	handler     TaskHandler
+	concurrency int
+	timeout     time.Duration
+}
+
+// RouteOption changes how a Mux works the tasks of a type
+type RouteOption func(r *muxRoute)
+
+// RouteConcurrency sets how many tasks of the type are worked at once.  DefaultConcurrency is used otherwise.
+func RouteConcurrency(n int) RouteOption {
+	return func(r *muxRoute) {
+		r.concurrency = n
+	}
+}
+
+// RouteTimeout limits how long each task of the type is given.  0 means no limit, which is the default.
+func RouteTimeout(timeout time.Duration) RouteOption {
+	return func(r *muxRoute) {
+		r.timeout = timeout
+	}
+}
+
+// NewMux will create a new Mux
+// name is used as the job name of the per type metrics
+// client is a go-metrics-client
+// logger is optional and will log errors if provided
+func NewMux(name string, client metrics.Client, logger Logger) *Mux {
+	if client == nil {
+		return nil
+	}
+	if logger == nil {
+		logger = &noopLogger{}
+	}
+	return &Mux{
+		name:   name,
+		client: client,
+		logger: logger,
+		routes: make(map[string]*muxRoute),
+	}
+}
+
+// HandleTask registers handler for tasks of taskType, replacing any handler registered before
+func (m *Mux) HandleTask(taskType string, handler func(ctx context.Context, task *QueueTask) error, opts ...RouteOption) {
+	route := &muxRoute{
+		taskType:    taskType,
+		concurrency: DefaultConcurrency,
+		handler: func(ctx context.Context, task Task) error {
+			return handler(ctx, task.(*QueueTask))
+		},
+	}
+	for _, opt := range opts {
+		opt(route)
+	}
+	m.mutex.Lock()
+	m.routes[taskType] = route
+	m.mutex.Unlock()
+}
+
+// HandleDecoded registers handler for tasks of taskType whose payloads are decoded with decode.
+// Tasks whose payload can not be decoded are failed.
+func HandleDecoded[P any](m *Mux, taskType string, decode func(payload []byte) (P, error), handler func(ctx context.Context, task *QueueTask, payload P) error, opts ...RouteOption) {
+	m.HandleTask(taskType, func(ctx context.Context, task *QueueTask) error {
+		payload, err := decode(task.Payload)
+		if err != nil {
+			return Permanent(fmt.Errorf("Error decoding payload: %v", err))
+		}
+		return handler(ctx, task, payload)
+	}, opts...)
+}
+
+// Handle registers handler for tasks of taskType whose JSON payloads decode into P
+func Handle[P any](m *Mux, taskType string, handler func(ctx context.Context, task *QueueTask, payload P) error, opts ...RouteOption) {
+	HandleDecoded(m, taskType, func(payload []byte) (P, error) {
+		var p P
+		err := json.Unmarshal(payload, &p)
+		return p, err
+	}, handler, opts...)
+}
+
+// Types returns the task types with a registered handler
+func (m *Mux) Types() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	types := make([]string, 0, len(m.routes))
+	for t := range m.routes {
+		types = append(types, t)
+	}
+	return types
+}
+
+// Tasker returns a ResultTasker that works each type of task with its own handler and concurrency, every type at once
+func (m *Mux) Tasker() ResultTasker {
+	return func(ctx context.Context, tasks []Task) ([]TaskResult, error) {
+		results := make([]TaskResult, 0, len(tasks))
+		groups := make(map[*muxRoute][]Task)
+		m.mutex.RLock()
+		for _, task := range tasks {
+			qt, ok := task.(*QueueTask)
+			if !ok {
+				results = append(results, TaskResult{Task: task, Status: TaskFailed, Err: fmt.Errorf("Task %s is a %T not a *QueueTask", task.GetID(), task)})
+				continue
+			}
+			route, ok := m.routes[qt.Type]
+			if !ok {
+				results = append(results, TaskResult{Task: task, Status: TaskRelease, Err: fmt.Errorf("No handler registered for task type %q", qt.Type), RetryAfter: UnknownTypeRetryAfter})
+				continue
+			}
+			groups[route] = append(groups[route], task)
+		}
+		m.mutex.RUnlock()
+
+		var resultMutex sync.Mutex
+		var wg sync.WaitGroup
+		for route, group := range groups {
+			wg.Add(1)
+			go func(route *muxRoute, group []Task) {
+				defer wg.Done()
+				groupResults := m.work(ctx, route, group)
+				resultMutex.Lock()
+				results = append(results, groupResults...)
+				resultMutex.Unlock()
+			}(route, group)
+		}
+		wg.Wait()
+		return results, nil
+	}
+}
+
+// work runs the tasks of a single type and records the metrics for the type
+func (m *Mux) work(ctx context.Context, route *muxRoute, tasks []Task) []TaskResult {
+	start := time.Now()
+	sessionID := ""
+	rc, ok := runContextFrom(ctx)
+	if ok {
+		sessionID = strconv.FormatInt(rc.sessionID, 10)
+	}
+	params := map[string]string{"task_type": route.taskType}
+	m.client.BackgroundRate(sessionID, m.name, params, int64(len(tasks)))
+
+	results, _ := route.handler.results(route.concurrency, route.timeout, m.logger)(ctx, tasks)
+
+	var failed int64
+	for _, result := range results {
+		if result.Status != TaskSucceeded {
+			failed++
+		}
+	}
+	if failed > 0 {
+		m.client.BackgroundError(sessionID, m.name, params, "Task errors", fmt.Sprintf("%d of %d %s tasks did not succeed", failed, len(tasks), route.taskType), failed)
+	}
+	m.client.BackgroundDuration(sessionID, m.name, params, time.Since(start))
+	return results
+}
@@ -0,0 +1,100 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMuxDispatchesByType(t *testing.T) {
+	m := NewMux("test", noopClient{}, nil)
+	var mutex sync.Mutex
+	var worked []string
+	Handle(m, "email", func(ctx context.Context, task *QueueTask, p struct{ To string }) error {
+		mutex.Lock()
+		worked = append(worked, "email "+p.To)
+		mutex.Unlock()
+		return nil
+	})
+	m.HandleTask("sms", func(ctx context.Context, task *QueueTask) error {
+		return errors.New("gateway down")
+	})
+
+	results, err := m.Tasker()(context.Background(), []Task{
+		&QueueTask{ID: 1, Type: "email", Payload: []byte(`{"To":"a@b.c"}`)},
+		&QueueTask{ID: 2, Type: "sms", Payload: []byte(`{}`)},
+		&QueueTask{ID: 3, Type: "email", Payload: []byte(`not json`)},
+		&QueueTask{ID: 4, Type: "push", Payload: []byte(`{}`)},
+		&testTask{id: "5"},
+	})
+	if err != nil {
+		t.Fatalf("Error running tasks: %v", err)
+	}
+	status := make(map[string]TaskStatus)
+	for _, result := range results {
+		status[result.Task.GetID()] = result.Status
+	}
+	want := map[string]TaskStatus{"1": TaskSucceeded, "2": TaskRetry, "3": TaskFailed, "4": TaskRelease, "5": TaskFailed}
+	for id, s := range want {
+		if status[id] != s {
+			t.Errorf("Task %s is %s, want %s", id, status[id], s)
+		}
+	}
+	if strings.Join(worked, ",") != "email a@b.c" {
+		t.Errorf("Worked %v, want only the email that decoded", worked)
+	}
+	for _, result := range results {
+		if result.Task.GetID() == "4" && result.RetryAfter != UnknownTypeRetryAfter {
+			t.Errorf("Releasing a task without a handler for %v, want %v", result.RetryAfter, UnknownTypeRetryAfter)
+		}
+	}
+}
+
+func TestMuxRouteConcurrency(t *testing.T) {
+	m := NewMux("test", noopClient{}, nil)
+	var mutex sync.Mutex
+	running, most := 0, 0
+	m.HandleTask("report", func(ctx context.Context, task *QueueTask) error {
+		mutex.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return nil
+	}, RouteConcurrency(2))
+
+	tasks := make([]Task, 6)
+	for i := range tasks {
+		tasks[i] = &QueueTask{ID: int64(i), Type: "report"}
+	}
+	_, err := m.Tasker()(context.Background(), tasks)
+	if err != nil {
+		t.Fatalf("Error running tasks: %v", err)
+	}
+	if most != 2 {
+		t.Errorf("Ran %d report tasks at once, want 2", most)
+	}
+}
+
+func TestMuxTypes(t *testing.T) {
+	m := NewMux("test", noopClient{}, nil)
+	m.HandleTask("email", nil)
+	m.HandleTask("sms", nil)
+	types := m.Types()
+	sort.Strings(types)
+	if strings.Join(types, ",") != "email,sms" {
+		t.Errorf("Got types %v, want email and sms", types)
+	}
+	if NewMux("test", nil, nil) != nil {
+		t.Errorf("Created a Mux without a metrics client")
+	}
+}
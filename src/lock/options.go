@@ -0,0 +1,98 @@
+package lock
+
+import (
+	"time"
+)
+
+// RunnerOption changes optional behavior of a Runner
+type RunnerOption func(o *runnerOptions)
+
+// runnerOptions holds the optional behavior shared by every TypedRunner
+type runnerOptions struct {
+	retryPolicy        RetryPolicy
+	cancelPollInterval time.Duration
+	resultRetention    time.Duration
+	concurrency        int
+	taskTimeout        time.Duration
+	batchSize          int64
+	taskTypes          func() []string
+
+	completionBatchSize     int
+	completionFlushInterval time.Duration
+}
+
+func defaultRunnerOptions() runnerOptions {
+	return runnerOptions{
+		retryPolicy:        DefaultRetryPolicy,
+		cancelPollInterval: DefaultCancelPollInterval,
+		concurrency:        DefaultConcurrency,
+
+		completionBatchSize:     DefaultCompletionBatchSize,
+		completionFlushInterval: DefaultCompletionFlushInterval,
+	}
+}
+
+// WithRetryPolicy sets how a Runner backs off and gives up on tasks that need to be retried.
+// DefaultRetryPolicy is used otherwise.
+func WithRetryPolicy(policy RetryPolicy) RunnerOption {
+	return func(o *runnerOptions) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithCancelPollInterval sets how often a Runner checks for cancelled tasks while its Tasker runs.
+// This bounds how long a cancelled task keeps running when the Database does not implement CancelNotifier.
+// 0 turns polling off.  DefaultCancelPollInterval is used otherwise.
+func WithCancelPollInterval(interval time.Duration) RunnerOption {
+	return func(o *runnerOptions) {
+		o.cancelPollInterval = interval
+	}
+}
+
+// WithResultRetention makes a Runner purge the results of tasks that finished more than retention ago.
+// The Database must implement ResultStore.  Results are kept forever otherwise.
+func WithResultRetention(retention time.Duration) RunnerOption {
+	return func(o *runnerOptions) {
+		o.resultRetention = retention
+	}
+}
+
+// WithConcurrency sets how many tasks a handler Runner works at once.  DefaultConcurrency is used otherwise.
+func WithConcurrency(n int) RunnerOption {
+	return func(o *runnerOptions) {
+		o.concurrency = n
+	}
+}
+
+// WithTaskTimeout limits how long a handler Runner gives each task.  0 means no limit, which is the default.
+func WithTaskTimeout(timeout time.Duration) RunnerOption {
+	return func(o *runnerOptions) {
+		o.taskTimeout = timeout
+	}
+}
+
+// WithCompletionFlush sets how a Runner flushes tasks reported to its Completer: once batchSize tasks are waiting or every interval.
+// DefaultCompletionBatchSize and DefaultCompletionFlushInterval are used otherwise.
+func WithCompletionFlush(batchSize int, interval time.Duration) RunnerOption {
+	return func(o *runnerOptions) {
+		o.completionBatchSize = batchSize
+		o.completionFlushInterval = interval
+	}
+}
+
+// WithTaskTypes makes a Runner only claim tasks of the types returned by types, such as Mux.Types.
+// types is called before every GetWork and the Database reads the result with TaskTypesFrom.
+func WithTaskTypes(types func() []string) RunnerOption {
+	return func(o *runnerOptions) {
+		o.taskTypes = types
+	}
+}
+
+// WithBatchSize caps how many tasks a Runner hands to its Tasker at once, separate from how many tasks its session owns.
+// The tasks are worked in batches and the outcomes of each batch are recorded before the next one starts.
+// If the Database implements PagedWorkGetter only one batch is read at a time.  0 hands over every task, which is the default.
+func WithBatchSize(n int64) RunnerOption {
+	return func(o *runnerOptions) {
+		o.batchSize = n
+	}
+}
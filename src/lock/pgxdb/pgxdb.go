@@ -0,0 +1,240 @@
+// Package pgxdb implements lock.Database over a pgxpool.Pool with the plpgsql functions in migration.
+package pgxdb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+	"github.com/promoboxx/go-session-lock/src/lock/sqldb"
+)
+
+// Error codes
+const (
+	ErrorQueryingDB = sqldb.ErrorQueryingDB
+)
+
+// Config names the schema and plpgsql functions a DB calls.  It is the same as sqldb.Config.
+type Config = sqldb.Config
+
+// DefaultConfig returns a Config for the functions as they are named in migration with BIGINT task ids
+func DefaultConfig() Config {
+	return sqldb.DefaultConfig()
+}
+
+// DB implements lock.Database, lock.PagedWorkGetter and the optional interfaces of sqldb.DB with pgx.
+// Every function runs on the pool through a Querier, which sends task ids as binary arrays.
+type DB struct {
+	*sqldb.DB
+	pipeline bool
+}
+
+// Option changes optional behavior of a DB
+type Option func(d *DB)
+
+// WithPipelinedBump makes GetWork and GetWorkPage send bump_session and get_work to the DB together in one round trip
+func WithPipelinedBump() Option {
+	return func(d *DB) {
+		d.pipeline = true
+	}
+}
+
+// New will create a new DB
+// pool is connected to the Postgres database holding the session locking schema
+// config names the functions to call, empty names fall back to DefaultConfig
+func New(pool *pgxpool.Pool, config Config, opts ...Option) *DB {
+	d := &DB{}
+	for _, opt := range opts {
+		opt(d)
+	}
+	q := Querier(pool)
+	if d.pipeline {
+		q = pipeliner{querier: querier{conn: pool}, batcher: pool}
+	}
+	d.DB = sqldb.NewQuerier(q, config)
+	return d
+}
+
+// idArray converts task ids into a slice pgx sends in the binary format of kind
+func idArray(kind lock.IDKind, ids []string) (any, glitch.DataError) {
+	switch kind {
+	case lock.BigintID:
+		ints := make([]int64, len(ids))
+		for i, id := range ids {
+			n, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return nil, glitch.NewDataError(err, lock.ErrorInvalidTaskID, fmt.Sprintf("Task id %q is not a BIGINT", id))
+			}
+			ints[i] = n
+		}
+		return ints, nil
+	case lock.UUIDID:
+		uuids := make([][16]byte, len(ids))
+		for i, id := range ids {
+			dbErr := kind.Validate(id)
+			if dbErr != nil {
+				return nil, dbErr
+			}
+			uuids[i] = parseUUID(id)
+		}
+		return uuids, nil
+	}
+	return ids, nil
+}
+
+// parseUUID converts a validated UUID string into its 16 bytes
+func parseUUID(id string) [16]byte {
+	var u [16]byte
+	hex := strings.Replace(id, "-", "", -1)
+	for i := range u {
+		b, _ := strconv.ParseUint(hex[i*2:i*2+2], 16, 8)
+		u[i] = byte(b)
+	}
+	return u
+}
+
+// Conn is what *pgxpool.Pool, *pgxpool.Conn, *pgx.Conn and pgx.Tx have in common
+type Conn interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// Querier adapts a pgx pool, connection or transaction to a lock.Querier, such as to enqueue tasks in a pgx.Tx with EnqueueTasksTx.
+// lock.IDArray arguments are sent as binary arrays by their lock.IDKind.
+func Querier(conn Conn) lock.Querier {
+	return querier{conn: conn}
+}
+
+type querier struct {
+	conn Conn
+}
+
+// Exec runs query and discards its result
+func (q querier) Exec(ctx context.Context, query string, args ...any) error {
+	args, err := bindArgs(args)
+	if err != nil {
+		return err
+	}
+	_, err = q.conn.Exec(ctx, query, args...)
+	return err
+}
+
+// Query runs query and returns its rows, which are also pgx.CollectableRow for ScanTask
+func (q querier) Query(ctx context.Context, query string, args ...any) (lock.Rows, error) {
+	args, err := bindArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	r, err := q.conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows{Rows: r}, nil
+}
+
+// batcher is what *pgxpool.Pool, *pgx.Conn and pgx.Tx have to send a pgx.Batch
+type batcher interface {
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// pipeliner is a querier that also implements sqldb.Pipeliner with a pgx.Batch
+type pipeliner struct {
+	querier
+	batcher batcher
+}
+
+// QueryAfter sends exec and query in one batch and returns the rows of query, which close the batch when they are closed
+func (q pipeliner) QueryAfter(ctx context.Context, exec string, execArgs []any, query string, args ...any) (lock.Rows, error) {
+	execArgs, err := bindArgs(execArgs)
+	if err != nil {
+		return nil, err
+	}
+	args, err = bindArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	batch := &pgx.Batch{}
+	batch.Queue(exec, execArgs...)
+	batch.Queue(query, args...)
+	results := q.batcher.SendBatch(ctx, batch)
+
+	_, err = results.Exec()
+	if err != nil {
+		results.Close()
+		return nil, err
+	}
+	r, err := results.Query()
+	if err != nil {
+		results.Close()
+		return nil, err
+	}
+	return batchRows{rows: rows{Rows: r}, results: results}, nil
+}
+
+// batchRows are the rows of the last query of a batch
+type batchRows struct {
+	rows
+	results pgx.BatchResults
+}
+
+// Close closes the rows and then the batch, and returns the first error of either
+func (r batchRows) Close() error {
+	err := r.rows.Close()
+	closeErr := r.results.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// rows adapts pgx.Rows to lock.Rows
+type rows struct {
+	pgx.Rows
+}
+
+// Close closes the rows and returns any error reading them
+func (r rows) Close() error {
+	r.Rows.Close()
+	return r.Rows.Err()
+}
+
+// bindArgs returns a copy of args with every lock.IDArray converted by idArray
+func bindArgs(args []any) ([]any, error) {
+	bound := make([]any, len(args))
+	for i, arg := range args {
+		ids, ok := arg.(lock.IDArray)
+		if !ok {
+			bound[i] = arg
+			continue
+		}
+		array, dbErr := idArray(ids.Kind, ids.IDs)
+		if dbErr != nil {
+			return nil, dbErr
+		}
+		bound[i] = array
+	}
+	return bound, nil
+}
+
+// ScanTask adapts a pgx.RowToFunc, such as pgx.RowToAddrOfStructByName, to a lock.TypedScanTask.
+// The rows handed to it by a DB are pgx.Rows, which are also pgx.CollectableRow.
+func ScanTask[T lock.Task](rowTo pgx.RowToFunc[T]) lock.TypedScanTask[T] {
+	return func(row lock.Scanner) (T, glitch.DataError) {
+		var zero T
+		collectable, ok := row.(pgx.CollectableRow)
+		if !ok {
+			return zero, glitch.NewDataError(fmt.Errorf("row is a %T not a pgx.CollectableRow", row), lock.ErrorScanningTask, "Error scanning task")
+		}
+		task, err := rowTo(collectable)
+		if err != nil {
+			return zero, glitch.NewDataError(err, lock.ErrorScanningTask, "Error scanning task")
+		}
+		return task, nil
+	}
+}
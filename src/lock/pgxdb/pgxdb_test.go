@@ -0,0 +1,158 @@
+package pgxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/promoboxx/go-session-lock/src/lock"
+	"github.com/promoboxx/go-session-lock/src/lock/sqldb"
+)
+
+func TestIDArray(t *testing.T) {
+	ids, dbErr := idArray(lock.BigintID, []string{"1", "-2"})
+	if dbErr != nil || !reflect.DeepEqual(ids, []int64{1, -2}) {
+		t.Errorf("Got %v, %v, want the ids as int64s", ids, dbErr)
+	}
+
+	ids, dbErr = idArray(lock.UUIDID, []string{"3f2504e0-4f89-11d3-9a0c-0305e82c3301"})
+	want := [][16]byte{{0x3f, 0x25, 0x04, 0xe0, 0x4f, 0x89, 0x11, 0xd3, 0x9a, 0x0c, 0x03, 0x05, 0xe8, 0x2c, 0x33, 0x01}}
+	if dbErr != nil || !reflect.DeepEqual(ids, want) {
+		t.Errorf("Got %v, %v, want the UUID bytes", ids, dbErr)
+	}
+
+	ids, dbErr = idArray(lock.TextID, []string{"a,b"})
+	if dbErr != nil || !reflect.DeepEqual(ids, []string{"a,b"}) {
+		t.Errorf("Got %v, %v, want the text ids as is", ids, dbErr)
+	}
+
+	for kind, bad := range map[lock.IDKind]string{lock.BigintID: "two", lock.UUIDID: "not-a-uuid"} {
+		_, dbErr = idArray(kind, []string{bad})
+		if dbErr == nil || dbErr.Code() != lock.ErrorInvalidTaskID {
+			t.Errorf("Converting %q to a %s array returned %v, want %s", bad, kind, dbErr, lock.ErrorInvalidTaskID)
+		}
+	}
+}
+
+func TestSQLState(t *testing.T) {
+	err := fmt.Errorf("getting work: %w", &pgconn.PgError{Code: lock.SQLErrorSessionNotFound})
+	if state := sqldb.SQLState(err); state != lock.SQLErrorSessionNotFound {
+		t.Errorf("Got SQLSTATE %q, want %s read from the wrapped pgconn.PgError", state, lock.SQLErrorSessionNotFound)
+	}
+}
+
+func TestBindArgs(t *testing.T) {
+	args, err := bindArgs([]any{int64(7), lock.IDArray{Kind: lock.BigintID, IDs: []string{"1", "2"}}, "page"})
+	if err != nil || !reflect.DeepEqual(args, []any{int64(7), []int64{1, 2}, "page"}) {
+		t.Errorf("Got %v, %v, want only the IDArray converted", args, err)
+	}
+	_, err = bindArgs([]any{lock.IDArray{Kind: lock.BigintID, IDs: []string{"two"}}})
+	if err == nil {
+		t.Errorf("Binding an invalid task id did not return an error")
+	}
+}
+
+func TestScanTaskNeedsCollectableRow(t *testing.T) {
+	scan := ScanTask(func(row pgx.CollectableRow) (*lock.QueueTask, error) {
+		return &lock.QueueTask{}, nil
+	})
+	_, dbErr := scan(nil)
+	if dbErr == nil || dbErr.Code() != lock.ErrorScanningTask {
+		t.Errorf("Scanning a row that is not a pgx.CollectableRow returned %v, want %s", dbErr, lock.ErrorScanningTask)
+	}
+}
+
+// fakeBatch records the batch sent to it and answers with results
+type fakeBatch struct {
+	sent    *pgx.Batch
+	results *fakeResults
+}
+
+func (b *fakeBatch) SendBatch(ctx context.Context, batch *pgx.Batch) pgx.BatchResults {
+	b.sent = batch
+	return b.results
+}
+
+// fakeResults fails the first Exec with execErr and returns empty rows from Query
+type fakeResults struct {
+	execErr error
+	queried bool
+	closed  bool
+}
+
+func (r *fakeResults) Exec() (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, r.execErr
+}
+
+func (r *fakeResults) Query() (pgx.Rows, error) {
+	r.queried = true
+	return emptyRows{}, nil
+}
+
+func (r *fakeResults) QueryRow() pgx.Row {
+	return nil
+}
+
+func (r *fakeResults) Close() error {
+	r.closed = true
+	return nil
+}
+
+// emptyRows are pgx.Rows without a row
+type emptyRows struct {
+	pgx.Rows
+}
+
+func (emptyRows) Next() bool {
+	return false
+}
+
+func (emptyRows) Err() error {
+	return nil
+}
+
+func (emptyRows) Close() {}
+
+func TestPipelinerSendsOneBatch(t *testing.T) {
+	b := &fakeBatch{results: &fakeResults{}}
+	p := pipeliner{batcher: b}
+
+	rows, err := p.QueryAfter(context.Background(), "SELECT bump_session($1)", []any{int64(7)},
+		"SELECT * FROM finish($1)", lock.IDArray{Kind: lock.BigintID, IDs: []string{"1", "2"}})
+	if err != nil {
+		t.Fatalf("Error sending batch: %v", err)
+	}
+	if len(b.sent.QueuedQueries) != 2 || b.sent.QueuedQueries[0].SQL != "SELECT bump_session($1)" || b.sent.QueuedQueries[1].SQL != "SELECT * FROM finish($1)" {
+		t.Fatalf("Sent %+v, want the bump ahead of the query", b.sent.QueuedQueries)
+	}
+	if args := b.sent.QueuedQueries[1].Arguments; !reflect.DeepEqual(args, []any{[]int64{1, 2}}) {
+		t.Errorf("Sent arguments %v, want the task ids as int64s", args)
+	}
+	if b.results.closed {
+		t.Errorf("The batch was closed before its rows were read")
+	}
+	rows.Close()
+	if !b.results.closed {
+		t.Errorf("Closing the rows did not close the batch")
+	}
+}
+
+func TestPipelinerBumpError(t *testing.T) {
+	b := &fakeBatch{results: &fakeResults{execErr: &pgconn.PgError{Code: lock.SQLErrorSessionNotFound}}}
+	p := pipeliner{batcher: b}
+
+	_, err := p.QueryAfter(context.Background(), "SELECT bump_session($1)", []any{int64(7)}, "SELECT * FROM get_work($1, $2)", int64(7), int64(10))
+	if state := sqldb.SQLState(err); state != lock.SQLErrorSessionNotFound {
+		t.Errorf("Got %v, want the %s of the bump", err, lock.SQLErrorSessionNotFound)
+	}
+	if b.results.queried || !b.results.closed {
+		t.Errorf("Got queried %v and closed %v, want the batch closed without reading get_work", b.results.queried, b.results.closed)
+	}
+	if !errors.As(err, new(*pgconn.PgError)) {
+		t.Errorf("Got %T, want the *pgconn.PgError", err)
+	}
+}
@@ -0,0 +1,143 @@
+package producer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// DefaultBatchSize is how many tasks are sent to the DB at once when no batch size is given
+const DefaultBatchSize = 500
+
+// Producer adds tasks to the pool in batches
+type Producer struct {
+	db        lock.Enqueuer
+	batchSize int
+}
+
+// NewProducer will create a new Producer
+// db adds the tasks, it must also implement lock.TxEnqueuer to use EnqueueTx
+// batchSize caps how many tasks are sent to the DB at once, DefaultBatchSize is used if it is not positive
+func NewProducer(db lock.Enqueuer, batchSize int) *Producer {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	return &Producer{db: db, batchSize: batchSize}
+}
+
+// Enqueue adds tasks to the pool and returns a result per task in the same order.
+// A result is Deduplicated if its request collapsed into an existing task by DedupeKey.
+// ParentRefs are resolved to the IDs of the earlier results, a batch never holds a task and its parent.
+// If a batch fails the results of the batches already added are returned along with the error.
+func (p *Producer) Enqueue(ctx context.Context, tasks ...lock.EnqueueRequest) ([]lock.EnqueueResult, error) {
+	return p.enqueue(tasks, func(batch []lock.EnqueueRequest) ([]lock.EnqueueResult, error) {
+		results, dbErr := p.db.EnqueueTasks(ctx, batch)
+		if dbErr != nil {
+			return nil, dbErr
+		}
+		return results, nil
+	})
+}
+
+// EnqueueTx adds tasks to the pool inside tx and returns a result per task in the same order.
+// The tasks are only created if tx commits, so they can be created atomically with the caller's own writes.
+// Wrap a *sql.Tx with lock.SQLQuerier or a pgx.Tx with pgxdb.Querier.  The caller is responsible for committing or rolling back tx.
+func (p *Producer) EnqueueTx(ctx context.Context, tx lock.Querier, tasks ...lock.EnqueueRequest) ([]lock.EnqueueResult, error) {
+	txdb, ok := p.db.(lock.TxEnqueuer)
+	if !ok {
+		return nil, fmt.Errorf("Database does not implement TxEnqueuer")
+	}
+	return p.enqueue(tasks, func(batch []lock.EnqueueRequest) ([]lock.EnqueueResult, error) {
+		results, dbErr := txdb.EnqueueTasksTx(ctx, tx, batch)
+		if dbErr != nil {
+			return nil, dbErr
+		}
+		return results, nil
+	})
+}
+
+// EnqueueGraph adds a graph of tasks to the pool in a single transaction on db so either every task is added or none are.
+// Parents within the graph are given with ParentRefs and must come before their children.
+func (p *Producer) EnqueueGraph(ctx context.Context, db *sql.DB, tasks ...lock.EnqueueRequest) ([]lock.EnqueueResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error starting transaction: %v", err)
+	}
+	results, err := p.EnqueueTx(ctx, lock.SQLQuerier(tx), tasks...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("Error committing transaction: %v", err)
+	}
+	return results, nil
+}
+
+// enqueue splits tasks into batches and adds each batch with add
+func (p *Producer) enqueue(tasks []lock.EnqueueRequest, add func(batch []lock.EnqueueRequest) ([]lock.EnqueueResult, error)) ([]lock.EnqueueResult, error) {
+	for i, task := range tasks {
+		for _, ref := range task.ParentRefs {
+			if ref < 0 || ref >= i {
+				return nil, fmt.Errorf("Error enqueueing task %d: parent ref %d does not point at an earlier task", i, ref)
+			}
+		}
+	}
+
+	results := make([]lock.EnqueueResult, 0, len(tasks))
+	for start := 0; start < len(tasks); {
+		end := batchEnd(tasks, start, p.batchSize)
+		batch, err := resolveParents(tasks[start:end], results)
+		if err != nil {
+			return results, fmt.Errorf("Error enqueueing tasks %d to %d: %v", start, end-1, err)
+		}
+		batchResults, err := add(batch)
+		if err != nil {
+			return results, fmt.Errorf("Error enqueueing tasks %d to %d: %v", start, end-1, err)
+		}
+		if len(batchResults) != end-start {
+			return results, fmt.Errorf("Error enqueueing tasks %d to %d: expected %d results, got %d", start, end-1, end-start, len(batchResults))
+		}
+		results = append(results, batchResults...)
+		start = end
+	}
+	return results, nil
+}
+
+// batchEnd returns where the batch starting at start ends.
+// The batch stops before the first task with a parent in the same batch, since the parent has no ID yet.
+func batchEnd(tasks []lock.EnqueueRequest, start, batchSize int) int {
+	end := start + 1
+	for end < len(tasks) && end-start < batchSize {
+		for _, ref := range tasks[end].ParentRefs {
+			if ref >= start {
+				return end
+			}
+		}
+		end++
+	}
+	return end
+}
+
+// resolveParents returns a copy of batch with the ParentRefs of each task added to its Parents using the ids in results
+func resolveParents(batch []lock.EnqueueRequest, results []lock.EnqueueResult) ([]lock.EnqueueRequest, error) {
+	resolved := make([]lock.EnqueueRequest, len(batch))
+	for i, task := range batch {
+		if len(task.ParentRefs) > 0 {
+			parents := make([]string, 0, len(task.ParentRefs))
+			for _, ref := range task.ParentRefs {
+				if results[ref].ID == "" {
+					return nil, fmt.Errorf("parent ref %d has no ID", ref)
+				}
+				parents = append(parents, results[ref].ID)
+			}
+			task = task.After(parents...)
+			task.ParentRefs = nil
+		}
+		resolved[i] = task
+	}
+	return resolved, nil
+}
@@ -0,0 +1,186 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+type testTask struct {
+	id string
+}
+
+func (t *testTask) GetID() string {
+	return t.id
+}
+
+// enqueuer numbers the tasks it is given, collapses pending tasks with the same DedupeKey and records the size of every batch.
+// It fails the batch holding failAt.
+type enqueuer struct {
+	next     int
+	batches  []int
+	failAt   int
+	lastIDs  int
+	byDedupe map[string]string
+	parents  map[string]string
+}
+
+func (e *enqueuer) EnqueueTasks(ctx context.Context, tasks []lock.EnqueueRequest) ([]lock.EnqueueResult, glitch.DataError) {
+	e.batches = append(e.batches, len(tasks))
+	results := make([]lock.EnqueueResult, 0, len(tasks))
+	for _, task := range tasks {
+		if id, ok := e.byDedupe[task.DedupeKey]; ok {
+			results = append(results, lock.EnqueueResult{ID: id, Deduplicated: true})
+			continue
+		}
+		e.next++
+		if e.next == e.failAt {
+			return nil, glitch.NewDataError(errors.New("connection reset"), "ERROR", "Error enqueueing tasks")
+		}
+		id := strconv.Itoa(e.next)
+		if e.parents == nil {
+			e.parents = map[string]string{}
+		}
+		e.parents[id] = strings.Join(task.Parents, ",")
+		if task.DedupeKey != "" {
+			if e.byDedupe == nil {
+				e.byDedupe = map[string]string{}
+			}
+			e.byDedupe[task.DedupeKey] = id
+		}
+		results = append(results, lock.EnqueueResult{ID: id})
+	}
+	if e.lastIDs > 0 {
+		results = results[:e.lastIDs]
+	}
+	return results, nil
+}
+
+func requests(n int) []lock.EnqueueRequest {
+	reqs := make([]lock.EnqueueRequest, n)
+	for i := range reqs {
+		reqs[i] = lock.RunNow(&testTask{})
+	}
+	return reqs
+}
+
+func resultIDs(results []lock.EnqueueResult) string {
+	ids := make([]string, len(results))
+	for i, result := range results {
+		ids[i] = result.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestEnqueueBatches(t *testing.T) {
+	db := &enqueuer{}
+	p := NewProducer(db, 2)
+
+	results, err := p.Enqueue(context.Background(), requests(5)...)
+	if err != nil {
+		t.Fatalf("Error enqueueing: %v", err)
+	}
+	if got := resultIDs(results); got != "1,2,3,4,5" {
+		t.Errorf("Got ids %s, want 1 to 5 in order", got)
+	}
+	if len(db.batches) != 3 || db.batches[0] != 2 || db.batches[2] != 1 {
+		t.Errorf("Sent batches of %v, want [2 2 1]", db.batches)
+	}
+
+	if p := NewProducer(db, 0); p.batchSize != DefaultBatchSize {
+		t.Errorf("A batch size of 0 made batches of %d, want %d", p.batchSize, DefaultBatchSize)
+	}
+}
+
+func TestEnqueueDeduplicated(t *testing.T) {
+	p := NewProducer(&enqueuer{}, 2)
+
+	results, err := p.Enqueue(context.Background(),
+		lock.RunNow(&testTask{}).Dedupe("report", time.Hour),
+		lock.RunNow(&testTask{}),
+		lock.RunNow(&testTask{}).Dedupe("report", time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("Error enqueueing: %v", err)
+	}
+	if got := resultIDs(results); got != "1,2,1" {
+		t.Errorf("Got ids %s, want the third request collapsed into the first", got)
+	}
+	if results[0].Deduplicated || !results[2].Deduplicated {
+		t.Errorf("Got results %+v, want only the third deduplicated", results)
+	}
+}
+
+func TestEnqueueReturnsAddedBatchesOnError(t *testing.T) {
+	p := NewProducer(&enqueuer{failAt: 4}, 2)
+
+	results, err := p.Enqueue(context.Background(), requests(5)...)
+	if err == nil || !strings.Contains(err.Error(), "tasks 2 to 3") {
+		t.Errorf("Got error %v, want the batch of tasks 2 to 3", err)
+	}
+	if got := resultIDs(results); got != "1,2" {
+		t.Errorf("Got ids %s, want the ids of the first batch", got)
+	}
+}
+
+func TestEnqueueChecksResultCount(t *testing.T) {
+	p := NewProducer(&enqueuer{lastIDs: 1}, 2)
+
+	_, err := p.Enqueue(context.Background(), requests(2)...)
+	if err == nil || !strings.Contains(err.Error(), "expected 2 results, got 1") {
+		t.Errorf("Got error %v, want a count mismatch", err)
+	}
+}
+
+func TestEnqueueResolvesParentRefs(t *testing.T) {
+	db := &enqueuer{}
+	p := NewProducer(db, 10)
+
+	results, err := p.Enqueue(context.Background(),
+		lock.RunNow(&testTask{}),
+		lock.RunNow(&testTask{}).After("99"),
+		lock.RunNow(&testTask{}).AfterRefs(0),
+		lock.RunNow(&testTask{}).AfterRefs(0, 2).After("99"),
+	)
+	if err != nil {
+		t.Fatalf("Error enqueueing: %v", err)
+	}
+	if got := resultIDs(results); got != "1,2,3,4" {
+		t.Errorf("Got ids %s, want 1 to 4 in order", got)
+	}
+	// a batch stops before a task whose parent is in it
+	if len(db.batches) != 3 || db.batches[0] != 2 || db.batches[1] != 1 || db.batches[2] != 1 {
+		t.Errorf("Sent batches of %v, want [2 1 1]", db.batches)
+	}
+	if db.parents["3"] != "1" || db.parents["4"] != "99,1,3" {
+		t.Errorf("Enqueued with parents %v, want 3 after 1 and 4 after 99, 1 and 3", db.parents)
+	}
+}
+
+func TestEnqueueRejectsLaterParentRefs(t *testing.T) {
+	db := &enqueuer{}
+	p := NewProducer(db, 10)
+
+	_, err := p.Enqueue(context.Background(), lock.RunNow(&testTask{}).AfterRefs(1), lock.RunNow(&testTask{}))
+	if err == nil || !strings.Contains(err.Error(), "parent ref 1") {
+		t.Errorf("Got error %v, want the ref that does not point at an earlier task", err)
+	}
+	if len(db.batches) != 0 {
+		t.Errorf("Sent batches of %v, want nothing enqueued", db.batches)
+	}
+}
+
+func TestEnqueueTxWithoutTxEnqueuer(t *testing.T) {
+	p := NewProducer(&enqueuer{}, 2)
+
+	_, err := p.EnqueueTx(context.Background(), nil, requests(1)...)
+	if err == nil {
+		t.Errorf("EnqueueTx on a Database without TxEnqueuer did not return an error")
+	}
+}
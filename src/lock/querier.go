@@ -0,0 +1,51 @@
+package lock
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Querier runs SQL on a database, a connection or a transaction of any driver.
+// SQLQuerier adapts database/sql to it and pgxdb.Querier adapts pgx.
+type Querier interface {
+	Exec(ctx context.Context, query string, args ...interface{}) error
+	Query(ctx context.Context, query string, args ...interface{}) (Rows, error)
+}
+
+// Rows are the rows returned by a Querier.  *sql.Rows implements this
+type Rows interface {
+	Scanner
+	Next() bool
+	Err() error
+	Close() error
+}
+
+// SQLConn is what *sql.DB, *sql.Conn and *sql.Tx have in common
+type SQLConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// SQLQuerier adapts a *sql.DB, *sql.Conn or *sql.Tx to a Querier
+func SQLQuerier(conn SQLConn) Querier {
+	return sqlQuerier{conn: conn}
+}
+
+type sqlQuerier struct {
+	conn SQLConn
+}
+
+// Exec runs query and discards its result
+func (q sqlQuerier) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := q.conn.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Query runs query and returns its rows
+func (q sqlQuerier) Query(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	rows, err := q.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
@@ -0,0 +1,179 @@
+package lock
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// QueueTask is a task from the generic task table in migration/generic.
+// The session_task type returned by get_work and get_queue_work scans into it with ScanQueueTask.
+type QueueTask struct {
+	ID    int64
+	Queue string
+	// Type picks the handler for the task when a Mux works the queue
+	Type     string
+	Payload  json.RawMessage
+	Attempts int
+	// Checkpoint is the last state saved with SaveCheckpoint, nil if there is none
+	Checkpoint []byte
+	// ExpiresAt is when the task expires, the zero time if it never does
+	ExpiresAt time.Time
+}
+
+// NewQueueTask will create a QueueTask to enqueue on queue with payload encoded as JSON
+func NewQueueTask(queue string, payload interface{}) (*QueueTask, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding payload: %v", err)
+	}
+	return &QueueTask{Queue: queue, Payload: b}, nil
+}
+
+// NewMuxTask will create a QueueTask of taskType to enqueue on queue with payload encoded as JSON
+func NewMuxTask(queue, taskType string, payload interface{}) (*QueueTask, error) {
+	t, err := NewQueueTask(queue, payload)
+	if err != nil {
+		return nil, err
+	}
+	t.Type = taskType
+	return t, nil
+}
+
+// GetID returns the task id
+func (t *QueueTask) GetID() string {
+	return strconv.FormatInt(t.ID, 10)
+}
+
+// GetAttempts returns how many times the task was attempted before
+func (t *QueueTask) GetAttempts() int {
+	return t.Attempts
+}
+
+// GetCheckpoint returns the last checkpoint saved for the task
+func (t *QueueTask) GetCheckpoint() []byte {
+	return t.Checkpoint
+}
+
+// GetExpiresAt returns when the task expires
+func (t *QueueTask) GetExpiresAt() time.Time {
+	return t.ExpiresAt
+}
+
+// Decode unmarshals the JSON payload into v
+func (t *QueueTask) Decode(v interface{}) error {
+	return json.Unmarshal(t.Payload, v)
+}
+
+// ScanQueueTask is a ScanTask for the generic task table
+func ScanQueueTask(row Scanner) (Task, glitch.DataError) {
+	t := &QueueTask{}
+	var payload []byte
+	var expiresAt sql.NullTime
+	err := row.Scan(&t.ID, &t.Queue, &t.Type, &payload, &t.Attempts, &t.Checkpoint, &expiresAt)
+	if err != nil {
+		return nil, glitch.NewDataError(err, ErrorScanningTask, "Error scanning task")
+	}
+	t.Payload = json.RawMessage(payload)
+	if expiresAt.Valid {
+		t.ExpiresAt = expiresAt.Time
+	}
+	return t, nil
+}
+
+// PermanentError is an error that should fail a task instead of retrying it
+type PermanentError struct {
+	Err error
+}
+
+// Permanent wraps err so the task it is returned for is failed instead of retried
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return errorMessage(e.Err)
+}
+
+// Unwrap returns the wrapped error
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// isPermanent returns true if err was wrapped with Permanent
+func isPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
+
+// PayloadTasker will create a ResultTasker for tasks from the generic task table whose payloads decode into P.
+// handler is called once per task with the task's TaskContext.  A task succeeds if handler returns nil and is retried if it returns an error,
+// unless the error is wrapped with Permanent.  Tasks whose payload can not be decoded are failed.
+// Tasks that succeed are reported to the Completer right away.
+func PayloadTasker[P any](handler func(ctx context.Context, task *QueueTask, payload P) error) ResultTasker {
+	return payloadTasker(func(ctx context.Context, task *QueueTask, payload P) ([]byte, error) {
+		return nil, handler(ctx, task, payload)
+	})
+}
+
+// PayloadResultTasker is a PayloadTasker whose handler also returns a result.
+// The result of a task that succeeds is encoded as JSON and stored with the task if the Database implements ResultFinisher.
+func PayloadResultTasker[P, R any](handler func(ctx context.Context, task *QueueTask, payload P) (R, error)) ResultTasker {
+	return payloadTasker(func(ctx context.Context, task *QueueTask, payload P) ([]byte, error) {
+		result, err := handler(ctx, task, payload)
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(result)
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("Error encoding result: %v", err))
+		}
+		return b, nil
+	})
+}
+
+// payloadTasker decodes the payload of each task and calls handler with it
+func payloadTasker[P any](handler func(ctx context.Context, task *QueueTask, payload P) ([]byte, error)) ResultTasker {
+	return func(ctx context.Context, tasks []Task) ([]TaskResult, error) {
+		results := make([]TaskResult, len(tasks))
+		for i, task := range tasks {
+			results[i] = TaskResult{Task: task}
+			qt, ok := task.(*QueueTask)
+			if !ok {
+				results[i].Status = TaskFailed
+				results[i].Err = fmt.Errorf("Task %s is a %T not a *QueueTask", task.GetID(), task)
+				continue
+			}
+			var payload P
+			err := qt.Decode(&payload)
+			if err != nil {
+				results[i].Status = TaskFailed
+				results[i].Err = fmt.Errorf("Error decoding payload: %v", err)
+				continue
+			}
+			results[i].Result, results[i].Err = handler(TaskContext(ctx, task), qt, payload)
+			results[i].Status = statusFor(results[i].Err)
+			if results[i].Status == TaskSucceeded {
+				CompleterFrom(ctx).CompleteWithResult(task, results[i].Result)
+			}
+		}
+		return results, nil
+	}
+}
+
+// statusFor returns the status of a task whose work returned err
+func statusFor(err error) TaskStatus {
+	switch {
+	case err == nil:
+		return TaskSucceeded
+	case isPermanent(err):
+		return TaskFailed
+	}
+	return TaskRetry
+}
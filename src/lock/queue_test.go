@@ -0,0 +1,106 @@
+package lock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// row is a Scanner over a single row of values
+type row []interface{}
+
+func (r row) Scan(dest ...interface{}) error {
+	if len(dest) != len(r) {
+		return fmt.Errorf("Scanning %d columns into %d values", len(r), len(dest))
+	}
+	for i, v := range r {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+	}
+	return nil
+}
+
+func TestScanQueueTask(t *testing.T) {
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	task, dbErr := ScanQueueTask(row{int64(42), "email", "welcome", []byte(`{"to":"a@b.c"}`), 2, []byte("page 2"), sql.NullTime{Time: expires, Valid: true}})
+	if dbErr != nil {
+		t.Fatalf("Error scanning task: %v", dbErr)
+	}
+	qt := task.(*QueueTask)
+	if qt.GetID() != "42" || qt.Queue != "email" || qt.Type != "welcome" || qt.GetAttempts() != 2 {
+		t.Errorf("Scanned %+v, want welcome task 42 on email with 2 attempts", qt)
+	}
+	if string(qt.GetCheckpoint()) != "page 2" {
+		t.Errorf("Scanned checkpoint %q, want page 2", qt.GetCheckpoint())
+	}
+	if !qt.GetExpiresAt().Equal(expires) {
+		t.Errorf("Scanned expiry %v, want %v", qt.GetExpiresAt(), expires)
+	}
+	var payload struct{ To string }
+	err := qt.Decode(&payload)
+	if err != nil || payload.To != "a@b.c" {
+		t.Errorf("Decoded %+v, %v, want the payload", payload, err)
+	}
+
+	task, dbErr = ScanQueueTask(row{int64(43), "email", "", []byte(`{}`), 0, []byte(nil), sql.NullTime{}})
+	if dbErr != nil || !task.(*QueueTask).GetExpiresAt().IsZero() {
+		t.Errorf("Scanning a task without an expiry returned %v, want the zero time", dbErr)
+	}
+
+	_, dbErr = ScanQueueTask(row{int64(42)})
+	if dbErr == nil || dbErr.Code() != ErrorScanningTask {
+		t.Errorf("Scanning a short row returned %v, want %s", dbErr, ErrorScanningTask)
+	}
+}
+
+func TestNewQueueTask(t *testing.T) {
+	qt, err := NewQueueTask("email", map[string]string{"to": "a@b.c"})
+	if err != nil {
+		t.Fatalf("Error creating task: %v", err)
+	}
+	if qt.Queue != "email" || string(qt.Payload) != `{"to":"a@b.c"}` {
+		t.Errorf("Created %+v, want the payload as JSON", qt)
+	}
+	_, err = NewQueueTask("email", func() {})
+	if err == nil {
+		t.Errorf("Creating a task with a payload that can not be encoded did not return an error")
+	}
+}
+
+func TestPayloadTasker(t *testing.T) {
+	type payload struct {
+		Outcome string
+	}
+	tasker := PayloadTasker(func(ctx context.Context, task *QueueTask, p payload) error {
+		switch p.Outcome {
+		case "retry":
+			return errors.New("timeout")
+		case "fail":
+			return Permanent(errors.New("bad input"))
+		}
+		return nil
+	})
+
+	results, err := tasker(context.Background(), []Task{
+		&QueueTask{ID: 1, Payload: []byte(`{"Outcome":"ok"}`)},
+		&QueueTask{ID: 2, Payload: []byte(`{"Outcome":"retry"}`)},
+		&QueueTask{ID: 3, Payload: []byte(`{"Outcome":"fail"}`)},
+		&QueueTask{ID: 4, Payload: []byte(`not json`)},
+		&testTask{id: "5"},
+	})
+	if err != nil {
+		t.Fatalf("Error running tasks: %v", err)
+	}
+	want := []TaskStatus{TaskSucceeded, TaskRetry, TaskFailed, TaskFailed, TaskFailed}
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("Task %s is %s, want %s", result.Task.GetID(), result.Status, want[i])
+		}
+	}
+	if results[2].Err == nil || results[2].Err.Error() != "bad input" {
+		t.Errorf("Task 3 failed with %v, want the unwrapped message", results[2].Err)
+	}
+}
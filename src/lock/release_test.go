@@ -0,0 +1,72 @@
+package lock
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// releaseDB also implements TaskReleaser and records the task types each GetWork was limited to
+type releaseDB struct {
+	baseDB
+	released []ReleasedTask
+	types    []string
+}
+
+func (d *releaseDB) ReleaseTasks(ctx context.Context, releases []ReleasedTask) glitch.DataError {
+	d.released = append(d.released, releases...)
+	return nil
+}
+
+func (d *releaseDB) GetWork(ctx context.Context, sessionID int64, tasksPerSession int64, scanTask ScanTask) ([]Task, glitch.DataError) {
+	d.types = TaskTypesFrom(ctx)
+	return d.baseDB.GetWork(ctx, sessionID, tasksPerSession, scanTask)
+}
+
+func TestRecordResultsReleases(t *testing.T) {
+	db := &releaseDB{}
+	r := newResultTestRunner(db, nil)
+	start := time.Now()
+
+	handled, err := r.recordResults(context.Background(), db, "1", nil, []TaskResult{
+		{Task: &testTask{id: "later"}, Status: TaskRelease, RetryAfter: time.Minute},
+		{Task: &testTask{id: "now"}, Status: TaskRelease},
+	})
+	if err != nil {
+		t.Fatalf("Error recording results: %v", err)
+	}
+	if got := strings.Join(taskIDs(handled), ","); got != "later,now" {
+		t.Errorf("Handled %s, want both released tasks", got)
+	}
+	if len(db.released) != 2 || db.released[0].NotBefore.Before(start.Add(time.Minute)) || !db.released[1].NotBefore.IsZero() {
+		t.Errorf("Released %+v, want later in a minute and now right away", db.released)
+	}
+
+	// without a TaskReleaser the tasks stay with the session
+	handled, err = r.recordResults(context.Background(), &baseDB{}, "1", nil, []TaskResult{{Task: &testTask{id: "now"}, Status: TaskRelease}})
+	if err != nil || len(handled) != 0 {
+		t.Errorf("Recording a release without a TaskReleaser handled %d tasks with %v, want none", len(handled), err)
+	}
+}
+
+func TestWithTaskTypes(t *testing.T) {
+	db := &releaseDB{baseDB: baseDB{tasks: []Task{&testTask{id: "1"}}}}
+	r := NewRunner(func() (Database, error) { return db, nil }, nil, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		return tasks, nil
+	}, time.Second, 10, nil, "test", noopClient{}, WithTaskTypes(func() []string { return []string{"email", "sms"} }))
+	r.sessionID = 1
+
+	_, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if strings.Join(db.types, ",") != "email,sms" {
+		t.Errorf("GetWork was limited to %v, want email and sms", db.types)
+	}
+	if types := TaskTypesFrom(context.Background()); types != nil {
+		t.Errorf("Got task types %v from a context without them, want nil", types)
+	}
+}
@@ -0,0 +1,120 @@
+package lock
+
+import (
+	"context"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// TaskStatus is the outcome of working a single task
+type TaskStatus int
+
+// Task statuses
+const (
+	// TaskSucceeded flags the task as finished
+	TaskSucceeded TaskStatus = iota
+	// TaskFailed moves the task to the dead letter table so it is not picked up again
+	TaskFailed
+	// TaskRetry releases the task so it is picked up again, after RetryAfter if set
+	TaskRetry
+	// TaskSkip leaves the task as is.  The session keeps it and it will be returned by get_work again.
+	TaskSkip
+	// TaskRelease gives the task back to the pool without counting an attempt, after RetryAfter if set.
+	// Use it for tasks this Runner can not work, like a task type a Mux has no handler for.
+	TaskRelease
+)
+
+// String returns the name of the status
+func (s TaskStatus) String() string {
+	switch s {
+	case TaskSucceeded:
+		return "succeeded"
+	case TaskFailed:
+		return "failed"
+	case TaskRetry:
+		return "retry"
+	case TaskSkip:
+		return "skip"
+	case TaskRelease:
+		return "release"
+	}
+	return "unknown"
+}
+
+// TaskResult is the outcome of working a single task
+type TaskResult = TypedTaskResult[Task]
+
+// TypedTaskResult is the outcome of working a single task of type T
+type TypedTaskResult[T Task] struct {
+	Task   T
+	Status TaskStatus
+	// Err is why the task failed or needs to be retried
+	Err error
+	// RetryAfter is how long to wait before the task can be picked up again when Status is TaskRetry or TaskRelease
+	RetryAfter time.Duration
+	// Result is stored with the task when Status is TaskSucceeded and the Database implements ResultFinisher
+	Result []byte
+}
+
+// ResultTasker can do the work associated with the tasks passed to it.
+// It should return a result for every task it was given.  Tasks without a result are treated as TaskSkip.
+// Returning an error does not discard the results, successful tasks are still flagged as "finished".
+type ResultTasker = TypedResultTasker[Task]
+
+// TypedResultTasker is a ResultTasker for tasks of type T
+type TypedResultTasker[T Task] func(ctx context.Context, tasks []T) ([]TypedTaskResult[T], error)
+
+// TaskFailure holds the info needed to record a failed or retried task
+type TaskFailure struct {
+	TaskID string
+	Error  string
+	// NotBefore is the earliest time a retried task can be picked up again.  The zero time means right away.
+	NotBefore time.Time
+	// MaxAttempts fails a retried task instead once its attempts, counted by the DB, reach it.  0 means no limit.
+	MaxAttempts int
+}
+
+// OutcomeRecorder can be implemented by a Database to record tasks that failed or need to be retried.
+// FailTasks should call the fail_tasks plpgsql function, which dead letters the tasks,
+// and RetryTasks should call the retry_tasks plpgsql function, which fails the tasks that are out of attempts instead.
+// Without it failed and retried tasks are left with the session, the same as TaskSkip.
+type OutcomeRecorder interface {
+	FailTasks(ctx context.Context, failures []TaskFailure) glitch.DataError
+	RetryTasks(ctx context.Context, retries []TaskFailure) glitch.DataError
+}
+
+// ReleasedTask holds the info needed to give a task back to the pool
+type ReleasedTask struct {
+	TaskID string
+	// NotBefore is the earliest time the task can be picked up again.  The zero time means right away.
+	NotBefore time.Time
+}
+
+// TaskReleaser can be implemented by a Database to give tasks back to the pool without counting an attempt.
+// ReleaseTasks should call the release_tasks plpgsql function.
+// Without it released tasks are left with the session, the same as TaskSkip.
+type TaskReleaser interface {
+	ReleaseTasks(ctx context.Context, releases []ReleasedTask) glitch.DataError
+}
+
+// Results converts a Tasker into a ResultTasker.
+// Returned tasks succeeded and every other task is skipped, leaving it with the session like before.
+func (t TypedTasker[T]) Results() TypedResultTasker[T] {
+	return func(ctx context.Context, tasks []T) ([]TypedTaskResult[T], error) {
+		completed, err := t(ctx, tasks)
+		results := make([]TypedTaskResult[T], len(completed))
+		for i, task := range completed {
+			results[i] = TypedTaskResult[T]{Task: task, Status: TaskSucceeded}
+		}
+		return results, err
+	}
+}
+
+// errorMessage returns the message of err or an empty string if it is nil
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,122 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// outcomeDB also implements OutcomeRecorder
+type outcomeDB struct {
+	baseDB
+	failures []TaskFailure
+	retries  []TaskFailure
+}
+
+func (d *outcomeDB) FailTasks(ctx context.Context, failures []TaskFailure) glitch.DataError {
+	d.failures = append(d.failures, failures...)
+	return nil
+}
+
+func (d *outcomeDB) RetryTasks(ctx context.Context, retries []TaskFailure) glitch.DataError {
+	d.retries = append(d.retries, retries...)
+	return nil
+}
+
+func newResultTestRunner(db Database, tasker ResultTasker) *Runner {
+	r := NewResultRunner(func() (Database, error) { return db, nil }, nil, tasker, time.Second, 10, nil, "test", noopClient{})
+	r.sessionID = 1
+	return r
+}
+
+func taskIDs(tasks []Task) []string {
+	ids := make([]string, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.GetID()
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRecordResults(t *testing.T) {
+	db := &outcomeDB{}
+	r := newResultTestRunner(db, nil)
+	start := time.Now()
+
+	handled, err := r.recordResults(context.Background(), db, "1", nil, []TaskResult{
+		{Task: &testTask{id: "succeeded"}, Status: TaskSucceeded},
+		{Task: &testTask{id: "failed"}, Status: TaskFailed, Err: errors.New("bad input")},
+		{Task: &testTask{id: "retry"}, Status: TaskRetry, Err: errors.New("timeout"), RetryAfter: time.Minute},
+		{Task: &testTask{id: "skipped"}, Status: TaskSkip},
+	})
+	if err != nil {
+		t.Fatalf("Error recording results: %v", err)
+	}
+
+	if got := strings.Join(taskIDs(handled), ","); got != "failed,retry,succeeded" {
+		t.Errorf("Handled %s, want every task but the skipped one", got)
+	}
+	if got := strings.Join(db.finishedIDs(), ","); got != "succeeded" {
+		t.Errorf("Finished %s, want succeeded", got)
+	}
+	if len(db.failures) != 1 || db.failures[0].TaskID != "failed" || db.failures[0].Error != "bad input" {
+		t.Errorf("Failed %+v, want failed with its error", db.failures)
+	}
+	if len(db.retries) != 1 || db.retries[0].TaskID != "retry" || db.retries[0].NotBefore.Before(start.Add(time.Minute)) {
+		t.Errorf("Retried %+v, want retry a minute from now", db.retries)
+	}
+}
+
+func TestRecordResultsWithoutOutcomeRecorder(t *testing.T) {
+	db := &baseDB{}
+	r := newResultTestRunner(db, nil)
+
+	handled, err := r.recordResults(context.Background(), db, "1", nil, []TaskResult{
+		{Task: &testTask{id: "succeeded"}, Status: TaskSucceeded},
+		{Task: &testTask{id: "failed"}, Status: TaskFailed, Err: errors.New("bad input")},
+	})
+	if err != nil {
+		t.Fatalf("Error recording results: %v", err)
+	}
+	// failed tasks are left with the session
+	if got := strings.Join(taskIDs(handled), ","); got != "succeeded" {
+		t.Errorf("Handled %s, want succeeded", got)
+	}
+}
+
+func TestDoWorkRecordsResultsWhenTaskerErrors(t *testing.T) {
+	db := &outcomeDB{baseDB: baseDB{tasks: []Task{&testTask{id: "1"}, &testTask{id: "2"}}}}
+	r := newResultTestRunner(db, func(ctx context.Context, tasks []Task) ([]TaskResult, error) {
+		return []TaskResult{{Task: tasks[0], Status: TaskSucceeded}}, errors.New("lost the connection")
+	})
+
+	handled, err := r.doWork(context.Background())
+	if err == nil {
+		t.Errorf("doWork did not return the error of the Tasker")
+	}
+	if got := strings.Join(taskIDs(handled), ","); got != "1" {
+		t.Errorf("Handled %s, want the task that succeeded before the error", got)
+	}
+	if got := strings.Join(db.finishedIDs(), ","); got != "1" {
+		t.Errorf("Finished %s, want 1", got)
+	}
+}
+
+func TestTaskerResults(t *testing.T) {
+	tasker := Tasker(func(ctx context.Context, tasks []Task) ([]Task, error) {
+		return tasks[1:], nil
+	})
+
+	results, err := tasker.Results()(context.Background(), []Task{&testTask{id: "1"}, &testTask{id: "2"}})
+	if err != nil {
+		t.Fatalf("Error running tasks: %v", err)
+	}
+	if len(results) != 1 || results[0].Task.GetID() != "2" || results[0].Status != TaskSucceeded {
+		t.Errorf("Got results %+v, want only the returned task as succeeded", results)
+	}
+}
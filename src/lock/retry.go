@@ -0,0 +1,112 @@
+package lock
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides how long to wait before a task that needs to be retried is picked up again
+// and when to give up on it.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a task can be attempted before it is failed.  0 means no limit.
+	MaxAttempts int
+	// BaseDelay is the wait before the second attempt.  It doubles with every attempt after that.
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between attempts.  0 means no cap.
+	MaxDelay time.Duration
+	// Jitter randomizes each wait by up to this fraction of it, i.e. 0.2 is +/- 20%, to spread out retries.
+	Jitter float64
+}
+
+// maxRetryDelay is the longest delay a RetryPolicy returns, it leaves room in a time.Duration for jitter and the time it is added to
+const maxRetryDelay = time.Duration(math.MaxInt64 / 4)
+
+// DefaultRetryPolicy is used by Runners without WithRetryPolicy.  It fails a task after 10 attempts, about 8 minutes of backoff.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 10,
+	BaseDelay:   time.Second,
+	MaxDelay:    10 * time.Minute,
+	Jitter:      0.1,
+}
+
+// Delay returns how long to wait before the attempt after attempt number attempt (starting at 1)
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	// 2^62 already overflows any positive BaseDelay, a larger exponent only risks an infinite delay
+	exponent := attempt - 1
+	if exponent > 62 {
+		exponent = 62
+	}
+	maxDelay := maxRetryDelay
+	if p.MaxDelay > 0 && p.MaxDelay < maxDelay {
+		maxDelay = p.MaxDelay
+	}
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(exponent))
+	if delay > float64(maxDelay) {
+		delay = float64(maxDelay)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if delay < 0 {
+		return 0
+	}
+	if delay > float64(maxRetryDelay) {
+		return maxRetryDelay
+	}
+	return time.Duration(delay)
+}
+
+// exhausted returns true if a task that failed attempt number attempt should not be attempted again
+func (p RetryPolicy) exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
+
+// AttemptedTask can be implemented by a Task to report how many times it was attempted before.
+// ScanTask should fill this in from the attempts column returned by get_work.
+// The backoff of tasks that do not implement it does not grow, they always wait BaseDelay.
+// MaxAttempts holds either way since retry_tasks counts attempts from the attempts column.
+type AttemptedTask interface {
+	GetAttempts() int
+}
+
+func attempts(task Task) int {
+	if at, ok := task.(AttemptedTask); ok {
+		return at.GetAttempts()
+	}
+	return 0
+}
+
+// RetryAfterError is an error that carries a hint for when to retry, i.e. from an HTTP 429 Retry-After header.
+type RetryAfterError struct {
+	Err   error
+	After time.Duration
+}
+
+// RetryAfter wraps err with a hint to retry after d.
+// A Runner uses the hint instead of its RetryPolicy delay when the error is returned with TaskRetry.
+func RetryAfter(err error, d time.Duration) error {
+	return &RetryAfterError{Err: err, After: d}
+}
+
+func (e *RetryAfterError) Error() string {
+	return errorMessage(e.Err)
+}
+
+// Unwrap returns the wrapped error
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// retryAfterHint returns the retry after hint in err or 0 if there is none
+func retryAfterHint(err error) time.Duration {
+	var rae *RetryAfterError
+	if errors.As(err, &rae) {
+		return rae.After
+	}
+	return 0
+}
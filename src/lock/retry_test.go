@@ -0,0 +1,81 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// attemptedTask is a testTask that was attempted before
+type attemptedTask struct {
+	testTask
+	attempts int
+}
+
+func (t *attemptedTask) GetAttempts() int {
+	return t.attempts
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	for attempt, want := range map[int]time.Duration{0: time.Second, 1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 100: 10 * time.Second} {
+		if got := p.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.Delay(2); got < time.Second || got > 3*time.Second {
+			t.Fatalf("Delay(2) with 50%% jitter = %v, want between 1s and 3s", got)
+		}
+	}
+}
+
+func TestRetryPolicyExhausted(t *testing.T) {
+	if (RetryPolicy{}).exhausted(1000) {
+		t.Errorf("A policy without MaxAttempts gave up")
+	}
+	p := RetryPolicy{MaxAttempts: 3}
+	if p.exhausted(2) || !p.exhausted(3) {
+		t.Errorf("A policy with MaxAttempts 3 gave up at %v and %v, want only at attempt 3", p.exhausted(2), p.exhausted(3))
+	}
+	if !DefaultRetryPolicy.exhausted(DefaultRetryPolicy.MaxAttempts) {
+		t.Errorf("DefaultRetryPolicy never gave up, want it to fail a task after %d attempts", DefaultRetryPolicy.MaxAttempts)
+	}
+}
+
+func TestRecordResultsRetries(t *testing.T) {
+	db := &outcomeDB{}
+	r := newResultTestRunner(db, nil)
+	r.retryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute}
+	start := time.Now()
+
+	_, err := r.recordResults(context.Background(), db, "1", nil, []TaskResult{
+		{Task: &attemptedTask{testTask: testTask{id: "backoff"}, attempts: 1}, Status: TaskRetry, Err: errors.New("timeout")},
+		{Task: &testTask{id: "hinted"}, Status: TaskRetry, Err: RetryAfter(errors.New("rate limited"), time.Hour)},
+		{Task: &attemptedTask{testTask: testTask{id: "exhausted"}, attempts: 2}, Status: TaskRetry, Err: errors.New("timeout")},
+	})
+	if err != nil {
+		t.Fatalf("Error recording results: %v", err)
+	}
+
+	if len(db.retries) != 2 {
+		t.Fatalf("Retried %+v, want backoff and hinted", db.retries)
+	}
+	// the second attempt of backoff failed, so it waits BaseDelay doubled
+	if got := db.retries[0].NotBefore.Sub(start); db.retries[0].TaskID != "backoff" || got < 2*time.Minute || got > 2*time.Minute+time.Second {
+		t.Errorf("Retried %s in %v, want backoff in 2m", db.retries[0].TaskID, got)
+	}
+	if got := db.retries[1].NotBefore.Sub(start); db.retries[1].TaskID != "hinted" || got < time.Hour || got > time.Hour+time.Second {
+		t.Errorf("Retried %s in %v, want hinted in an hour", db.retries[1].TaskID, got)
+	}
+	if db.retries[1].Error != "rate limited" {
+		t.Errorf("Retried hinted with error %q, want the wrapped error", db.retries[1].Error)
+	}
+	if len(db.failures) != 1 || db.failures[0].TaskID != "exhausted" || !strings.HasPrefix(db.failures[0].Error, "gave up after 3 attempts") {
+		t.Errorf("Failed %+v, want exhausted after 3 attempts", db.failures)
+	}
+}
@@ -0,0 +1,428 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-metric-client/metrics"
+
+	otext "github.com/opentracing/opentracing-go/ext"
+)
+
+// CatchUpPolicy decides what a Scheduler does with fires that were missed, i.e. because no instance was running
+type CatchUpPolicy int
+
+// Catch up policies
+const (
+	// CatchUpSkip drops missed fires and only runs fires that are due on time
+	CatchUpSkip CatchUpPolicy = iota
+	// CatchUpOnce runs the most recent missed fire once and drops the rest
+	CatchUpOnce
+	// CatchUpAll runs every missed fire in order
+	CatchUpAll
+)
+
+// ScheduledFire is the record of a single scheduled fire of a job
+type ScheduledFire struct {
+	JobName   string
+	FireTime  time.Time
+	SessionID int64
+	Claimed   time.Time
+	Finished  time.Time // zero while the fire is running or if the session died while running it
+	Error     string
+}
+
+// ScheduleDatabase can be implemented by a Database to support scheduled jobs.
+// Each method calls the plpgsql function of the same name in 1001_sessions.alwaysup.sql.
+type ScheduleDatabase interface {
+	// ClaimScheduledFire records the fire for the session and returns false if another session already claimed it
+	// A fire that was claimed by a session that expired before finishing it can be claimed again.
+	ClaimScheduledFire(ctx context.Context, jobName string, fireTime time.Time, sessionID int64) (bool, glitch.DataError)
+	// FinishScheduledFire returns false if the session no longer holds the fire because another session claimed it again
+	FinishScheduledFire(ctx context.Context, jobName string, fireTime time.Time, sessionID int64, errMessage string) (bool, glitch.DataError)
+	// GetLastScheduledFire returns the zero time if the job has never fired
+	GetLastScheduledFire(ctx context.Context, jobName string) (time.Time, glitch.DataError)
+	GetScheduledFires(ctx context.Context, jobName string, limit int64) ([]ScheduledFire, glitch.DataError)
+	// GetOrphanedScheduledFires returns the fire times, oldest first, that were claimed by a session that expired before finishing them
+	GetOrphanedScheduledFires(ctx context.Context, jobName string) ([]time.Time, glitch.DataError)
+}
+
+// Job is something to run on a cron schedule
+type Job struct {
+	// Name must be unique across the cluster, it is used to record fires
+	Name string
+	// Schedule is a 5 field cron expression (minute hour day-of-month month day-of-week) or a descriptor like @daily
+	Schedule string
+	// Location is the time zone Schedule is evaluated in.  Defaults to UTC.
+	Location *time.Location
+	CatchUp  CatchUpPolicy
+	// Run does the work for the fire scheduled at fireTime
+	Run func(ctx context.Context, fireTime time.Time) error
+}
+
+type scheduledJob struct {
+	Job
+	schedule *cronSchedule
+	// last is the latest fire handled by this scheduler, run or not, or the latest recorded fire in the DB
+	last time.Time
+	// running is true while fires of the job are running, no more are started until they return
+	running atomic.Bool
+}
+
+// Scheduler will run jobs on cron schedules, recording each fire so exactly one session runs it at a time.
+// Each job runs on its own goroutine so a slow job does not hold up the others.
+// A fire is finished exactly once: if the session running it dies first, another session runs it again.
+type Scheduler struct {
+	stop         chan bool
+	stopGroup    *sync.WaitGroup
+	sessionMutex sync.RWMutex
+	sessionID    int64
+	dbFinder     DBFinder
+	client       metrics.Client
+	loopTick     time.Duration
+	logger       Logger
+	name         string
+	jobs         []*scheduledJob
+	jobGroup     sync.WaitGroup
+	started      time.Time
+}
+
+// NewScheduler will create a new Scheduler
+// dbFinder can get an instance of the Database interface on demand, it must also implement ScheduleDatabase
+// looptick defines how often to check for due jobs.  A fire more than one tick late counts as missed.
+// client is a go-metrics-client that will also start spans for us
+// logger is optional and will log errors if provided
+func NewScheduler(dbFinder DBFinder, loopTick time.Duration, logger Logger, name string, client metrics.Client) *Scheduler {
+	if client == nil {
+		return nil
+	}
+	if logger == nil {
+		logger = &noopLogger{}
+	}
+	var sg sync.WaitGroup
+	return &Scheduler{
+		dbFinder:  dbFinder,
+		client:    client,
+		loopTick:  loopTick,
+		logger:    logger,
+		name:      name,
+		stopGroup: &sg,
+	}
+}
+
+// Register adds a job to the scheduler.  Call this before Run.
+func (s *Scheduler) Register(job Job) error {
+	if job.Name == "" {
+		return fmt.Errorf("Job name is required")
+	}
+	if job.Run == nil {
+		return fmt.Errorf("Job %s has no Run function", job.Name)
+	}
+	for _, j := range s.jobs {
+		if j.Name == job.Name {
+			return fmt.Errorf("Job %s is already registered", job.Name)
+		}
+	}
+	schedule, err := parseCron(job.Schedule, job.Location)
+	if err != nil {
+		return fmt.Errorf("Error parsing schedule for job %s: %v", job.Name, err)
+	}
+	s.jobs = append(s.jobs, &scheduledJob{Job: job, schedule: schedule})
+	return nil
+}
+
+// History returns up to limit of the most recent fires of a job, newest first
+func (s *Scheduler) History(ctx context.Context, jobName string, limit int64) ([]ScheduledFire, error) {
+	sdb, err := s.scheduleDB()
+	if err != nil {
+		return nil, err
+	}
+	fires, dbErr := sdb.GetScheduledFires(ctx, jobName, limit)
+	if dbErr != nil {
+		return nil, fmt.Errorf("Error getting scheduled fires: %v", dbErr)
+	}
+	return fires, nil
+}
+
+// Run will start a session and begin checking for due jobs
+// dont call this more than once.
+func (s *Scheduler) Run() error {
+	db, err := s.dbFinder()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	s.sessionMutex.Lock()
+	s.sessionID, err = db.StartSession(ctx)
+	s.sessionMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.started = time.Now()
+
+	s.stop = make(chan bool)
+	s.stopGroup.Add(1)
+	go func() {
+		defer s.stopGroup.Done()
+		tick := time.NewTicker(s.loopTick)
+		defer tick.Stop()
+		// bump the session every 30 seconds so it stays alive while a job runs for longer than the session expiration
+		bump := time.NewTicker(time.Second * 30)
+		defer bump.Stop()
+		for {
+			select {
+			case <-s.stop: // if Stop() was called, exit
+				// wait for running jobs so their fires are finished before the session ends
+				s.jobGroup.Wait()
+				err := s.endSession(context.Background())
+				if err != nil {
+					s.logger.Printf("Error ending session: %v", err)
+				}
+				return
+			case <-bump.C:
+				s.bumpSession(context.Background(), db)
+			case <-tick.C:
+				for _, j := range s.jobs {
+					err := s.runDue(context.Background(), j)
+					if err != nil {
+						s.logger.Printf("Error running job %s: %v", j.Name, err)
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the scheduler from looping
+// Stop returns a WaitGroup which you can wait on to ensure all running jobs are finished
+func (s *Scheduler) Stop() *sync.WaitGroup {
+	close(s.stop)
+	return s.stopGroup
+}
+
+// runDue starts a goroutine running the fires of a job that are due according to its catch up policy,
+// after any fires orphaned by a session that died while running them.
+// Nothing is started while fires of the job are still running, they are picked up on a later tick.
+func (s *Scheduler) runDue(ctx context.Context, j *scheduledJob) error {
+	if j.running.Load() {
+		return nil
+	}
+	sdb, err := s.scheduleDB()
+	if err != nil {
+		return err
+	}
+
+	orphaned, dbErr := sdb.GetOrphanedScheduledFires(ctx, j.Name)
+	if dbErr != nil {
+		return fmt.Errorf("Error getting orphaned scheduled fires: %v", dbErr)
+	}
+	due, err := s.dueFires(ctx, sdb, j)
+	if err != nil {
+		return err
+	}
+	fires := append(orphaned, due...)
+	if len(fires) == 0 {
+		return nil
+	}
+
+	j.running.Store(true)
+	s.jobGroup.Add(1)
+	go func() {
+		defer s.jobGroup.Done()
+		defer j.running.Store(false)
+		for _, t := range fires {
+			err := s.fire(ctx, sdb, j, t)
+			if err != nil {
+				s.logger.Printf("Error firing job %s for %v: %v", j.Name, t, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// dueFires returns the fires of a job that came due since the last fire, filtered by its catch up policy
+func (s *Scheduler) dueFires(ctx context.Context, sdb ScheduleDatabase, j *scheduledJob) ([]time.Time, error) {
+	last, dbErr := sdb.GetLastScheduledFire(ctx, j.Name)
+	if dbErr != nil {
+		return nil, fmt.Errorf("Error getting last scheduled fire: %v", dbErr)
+	}
+	if last.After(j.last) {
+		j.last = last
+	}
+	if j.last.IsZero() {
+		// a job that has never fired has nothing to catch up on
+		j.last = s.started
+	}
+
+	now := time.Now()
+	var due []time.Time
+	for t := j.schedule.Next(j.last); !t.IsZero() && !t.After(now); t = j.schedule.Next(t) {
+		due = append(due, t)
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+	j.last = due[len(due)-1]
+
+	switch j.CatchUp {
+	case CatchUpSkip:
+		onTime := due[:0]
+		for _, t := range due {
+			if now.Sub(t) <= s.loopTick {
+				onTime = append(onTime, t)
+			}
+		}
+		due = onTime
+	case CatchUpOnce:
+		due = due[len(due)-1:]
+	}
+	return due, nil
+}
+
+// fire claims a single fire and runs the job if this session won the claim.
+// The fire is only finished once the job returns, so it is run again if the session dies first.
+func (s *Scheduler) fire(ctx context.Context, sdb ScheduleDatabase, j *scheduledJob, fireTime time.Time) (err error) {
+	span, spanCtx := s.client.StartSpanWithContext(ctx, "scheduler fire")
+	start := time.Now()
+	s.sessionMutex.RLock()
+	sessionID := s.sessionID
+	s.sessionMutex.RUnlock()
+	sid := strconv.FormatInt(sessionID, 10)
+	params := map[string]string{"job": j.Name}
+	span.SetTag("job", j.Name)
+	span.SetTag("fire_time", fireTime)
+	defer func() {
+		if err != nil {
+			otext.Error.Set(span, true)
+			span.SetTag("inner-error", err)
+		}
+		span.Finish()
+	}()
+
+	claimed, dbErr := sdb.ClaimScheduledFire(spanCtx, j.Name, fireTime.UTC(), sessionID)
+	if dbErr != nil && dbErr.Code() == SQLErrorSessionNotFound {
+		s.logger.Printf("Session expired. Getting new one")
+		sessionID, err = s.restartSession(spanCtx)
+		if err != nil {
+			return err
+		}
+		sid = strconv.FormatInt(sessionID, 10)
+		claimed, dbErr = sdb.ClaimScheduledFire(spanCtx, j.Name, fireTime.UTC(), sessionID)
+	}
+	if dbErr != nil {
+		s.handleError(start, sid, params, "Failed claiming scheduled fire", dbErr.Error())
+		return fmt.Errorf("Error claiming scheduled fire: %v", dbErr)
+	}
+	if !claimed {
+		return nil
+	}
+
+	s.client.BackgroundRate(sid, s.name, params, 1)
+	var errMessage string
+	runErr := j.Run(spanCtx, fireTime)
+	if runErr != nil {
+		errMessage = runErr.Error()
+		s.handleError(start, sid, params, "Error running job", errMessage)
+	} else {
+		s.client.BackgroundDuration(sid, s.name, params, time.Since(start))
+	}
+
+	finished, dbErr := sdb.FinishScheduledFire(spanCtx, j.Name, fireTime.UTC(), sessionID, errMessage)
+	if dbErr != nil {
+		return fmt.Errorf("Error finishing scheduled fire: %v", dbErr)
+	}
+	if !finished {
+		s.logger.Printf("Fire of job %s for %v was claimed again by another session before it finished", j.Name, fireTime)
+	}
+	if runErr != nil {
+		return fmt.Errorf("Error running job: %v", runErr)
+	}
+	return nil
+}
+
+func (s *Scheduler) scheduleDB() (ScheduleDatabase, error) {
+	db, err := s.dbFinder()
+	if err != nil {
+		return nil, fmt.Errorf("Error finding DB: %v", err)
+	}
+	sdb, ok := db.(ScheduleDatabase)
+	if !ok {
+		return nil, fmt.Errorf("Database does not implement ScheduleDatabase")
+	}
+	return sdb, nil
+}
+
+// bumpSession keeps the session alive between claims
+func (s *Scheduler) bumpSession(ctx context.Context, db Database) {
+	s.sessionMutex.RLock()
+	sessionID := s.sessionID
+	s.sessionMutex.RUnlock()
+	dbErr := db.BumpSession(ctx, sessionID)
+	if dbErr == nil {
+		return
+	}
+	if dbErr.Code() != SQLErrorSessionNotFound {
+		s.logger.Printf("Error bumping session: %v", dbErr)
+		return
+	}
+	// the fires of the expired session are orphaned and run again by whichever session claims them
+	s.logger.Printf("Session expired. Getting new one")
+	_, err := s.restartSession(ctx)
+	if err != nil {
+		s.logger.Printf("Error bumping session: %v", err)
+	}
+}
+
+func (s *Scheduler) restartSession(ctx context.Context) (int64, error) {
+	db, err := s.dbFinder()
+	if err != nil {
+		return 0, fmt.Errorf("Error finding DB: %v", err)
+	}
+	sessionID, dbErr := db.StartSession(ctx)
+	if dbErr != nil {
+		return 0, fmt.Errorf("Error starting new session: %v", dbErr)
+	}
+	s.sessionMutex.Lock()
+	s.sessionID = sessionID
+	s.sessionMutex.Unlock()
+	return sessionID, nil
+}
+
+func (s *Scheduler) endSession(ctx context.Context) (err error) {
+	span, spanCtx := s.client.StartSpanWithContext(ctx, "scheduler end session")
+	defer func() {
+		if err != nil {
+			otext.Error.Set(span, true)
+			span.SetTag("inner-error", err)
+		}
+		span.Finish()
+	}()
+
+	db, err := s.dbFinder()
+	if err != nil {
+		return err
+	}
+
+	s.sessionMutex.Lock()
+	err = db.EndSession(spanCtx, s.sessionID)
+	s.sessionMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("Error ending session: %v", err)
+	}
+	return
+}
+
+// Does common error stuff
+func (s *Scheduler) handleError(start time.Time, sessionID string, params map[string]string, code, message string) {
+	s.client.BackgroundDuration(sessionID, s.name, params, time.Since(start))
+	s.client.BackgroundError(sessionID, s.name, params, code, message, 1)
+}
@@ -0,0 +1,303 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// scheduleDB also implements ScheduleDatabase and keeps the fires in memory.  Sessions in expired have died.
+type scheduleDB struct {
+	baseDB
+	fires   []*ScheduledFire
+	expired map[int64]bool
+}
+
+func (d *scheduleDB) ClaimScheduledFire(ctx context.Context, jobName string, fireTime time.Time, sessionID int64) (bool, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	fire := d.fire(jobName, fireTime)
+	if fire == nil {
+		d.fires = append(d.fires, &ScheduledFire{JobName: jobName, FireTime: fireTime, SessionID: sessionID, Claimed: time.Now()})
+		return true, nil
+	}
+	if !d.orphaned(fire) {
+		return false, nil
+	}
+	fire.SessionID = sessionID
+	fire.Claimed = time.Now()
+	return true, nil
+}
+
+func (d *scheduleDB) FinishScheduledFire(ctx context.Context, jobName string, fireTime time.Time, sessionID int64, errMessage string) (bool, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	fire := d.fire(jobName, fireTime)
+	if fire == nil || fire.SessionID != sessionID || !fire.Finished.IsZero() {
+		return false, nil
+	}
+	fire.Finished = time.Now()
+	fire.Error = errMessage
+	return true, nil
+}
+
+func (d *scheduleDB) GetLastScheduledFire(ctx context.Context, jobName string) (time.Time, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var last time.Time
+	for _, fire := range d.fires {
+		if fire.JobName == jobName && fire.FireTime.After(last) {
+			last = fire.FireTime
+		}
+	}
+	return last, nil
+}
+
+func (d *scheduleDB) GetScheduledFires(ctx context.Context, jobName string, limit int64) ([]ScheduledFire, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var fires []ScheduledFire
+	for _, fire := range d.fires {
+		if fire.JobName == jobName {
+			fires = append(fires, *fire)
+		}
+	}
+	sort.Slice(fires, func(i, j int) bool { return fires[i].FireTime.After(fires[j].FireTime) })
+	if int64(len(fires)) > limit {
+		fires = fires[:limit]
+	}
+	return fires, nil
+}
+
+func (d *scheduleDB) GetOrphanedScheduledFires(ctx context.Context, jobName string) ([]time.Time, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var orphaned []time.Time
+	for _, fire := range d.fires {
+		if fire.JobName == jobName && d.orphaned(fire) {
+			orphaned = append(orphaned, fire.FireTime)
+		}
+	}
+	sort.Slice(orphaned, func(i, j int) bool { return orphaned[i].Before(orphaned[j]) })
+	return orphaned, nil
+}
+
+// orphaned returns true if the fire was claimed by a session that died before finishing it, the caller must hold the lock
+func (d *scheduleDB) orphaned(fire *ScheduledFire) bool {
+	return fire.Finished.IsZero() && d.expired[fire.SessionID]
+}
+
+// fire returns the fire of the job at fireTime or nil, the caller must hold the lock
+func (d *scheduleDB) fire(jobName string, fireTime time.Time) *ScheduledFire {
+	for _, fire := range d.fires {
+		if fire.JobName == jobName && fire.FireTime.Equal(fireTime) {
+			return fire
+		}
+	}
+	return nil
+}
+
+// jobRuns records the fire times a job was run for
+type jobRuns struct {
+	mutex sync.Mutex
+	times []time.Time
+	err   error
+}
+
+func (r *jobRuns) run(ctx context.Context, fireTime time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.times = append(r.times, fireTime)
+	return r.err
+}
+
+func (r *jobRuns) get() []time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]time.Time(nil), r.times...)
+}
+
+// newTestScheduler returns a Scheduler for session sessionID with an hourly job that last fired hoursAgo hours before the current hour
+func newTestScheduler(t *testing.T, db Database, sessionID int64, catchUp CatchUpPolicy, hoursAgo int) (*Scheduler, *scheduledJob, *jobRuns) {
+	t.Helper()
+	s := NewScheduler(func() (Database, error) { return db, nil }, time.Hour, nil, "test", noopClient{})
+	s.sessionID = sessionID
+	s.started = time.Now()
+	runs := &jobRuns{}
+	err := s.Register(Job{Name: "hourly", Schedule: "@hourly", CatchUp: catchUp, Run: runs.run})
+	if err != nil {
+		t.Fatalf("Error registering job: %v", err)
+	}
+	j := s.jobs[0]
+	if hoursAgo > 0 {
+		j.last = time.Now().Truncate(time.Hour).Add(-time.Duration(hoursAgo) * time.Hour)
+	}
+	return s, j, runs
+}
+
+func TestSchedulerCatchUp(t *testing.T) {
+	thisHour := time.Now().Truncate(time.Hour)
+	tests := []struct {
+		name    string
+		catchUp CatchUpPolicy
+		want    int
+	}{
+		// only the fire of this hour is less than a tick late
+		{"skip", CatchUpSkip, 1},
+		{"once", CatchUpOnce, 1},
+		{"all", CatchUpAll, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, j, runs := newTestScheduler(t, &scheduleDB{}, 1, tt.catchUp, 10)
+
+			err := s.runDue(context.Background(), j)
+			if err != nil {
+				t.Fatalf("Error running due fires: %v", err)
+			}
+			s.jobGroup.Wait()
+			got := runs.get()
+			if len(got) != tt.want {
+				t.Fatalf("Ran %d fires %v, want %d", len(got), got, tt.want)
+			}
+			for i, fireTime := range got {
+				if want := thisHour.Add(time.Duration(i-len(got)+1) * time.Hour); !fireTime.Equal(want) {
+					t.Errorf("Fire %d ran for %v, want %v", i, fireTime, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSchedulerNewJobDoesNotCatchUp(t *testing.T) {
+	s, j, runs := newTestScheduler(t, &scheduleDB{}, 1, CatchUpAll, 0)
+
+	err := s.runDue(context.Background(), j)
+	if err != nil {
+		t.Fatalf("Error running due fires: %v", err)
+	}
+	if got := runs.get(); len(got) != 0 {
+		t.Errorf("A job that never fired ran %v", got)
+	}
+}
+
+func TestSchedulerClaimsEachFireOnce(t *testing.T) {
+	db := &scheduleDB{}
+	first, firstJob, firstRuns := newTestScheduler(t, db, 1, CatchUpOnce, 1)
+	second, secondJob, secondRuns := newTestScheduler(t, db, 2, CatchUpOnce, 1)
+	thisHour := time.Now().Truncate(time.Hour)
+
+	err := first.runDue(context.Background(), firstJob)
+	if err != nil {
+		t.Fatalf("Error running due fires: %v", err)
+	}
+	first.jobGroup.Wait()
+	// the second session sees the recorded fire, and loses the claim if it fires anyway
+	err = second.runDue(context.Background(), secondJob)
+	if err != nil {
+		t.Fatalf("Error running due fires: %v", err)
+	}
+	second.jobGroup.Wait()
+	err = second.fire(context.Background(), db, secondJob, thisHour)
+	if err != nil {
+		t.Fatalf("Error firing: %v", err)
+	}
+
+	if len(firstRuns.get()) != 1 || len(secondRuns.get()) != 0 {
+		t.Errorf("The sessions ran %v and %v, want the fire once by the first session", firstRuns.get(), secondRuns.get())
+	}
+	fires, err := first.History(context.Background(), "hourly", 10)
+	if err != nil {
+		t.Fatalf("Error getting history: %v", err)
+	}
+	if len(fires) != 1 || fires[0].SessionID != 1 || fires[0].Finished.IsZero() {
+		t.Errorf("Got history %+v, want one finished fire by session 1", fires)
+	}
+}
+
+func TestSchedulerRecordsErrors(t *testing.T) {
+	db := &scheduleDB{}
+	s, j, runs := newTestScheduler(t, db, 1, CatchUpOnce, 1)
+	runs.err = errors.New("boom")
+
+	err := s.fire(context.Background(), db, j, time.Now().Truncate(time.Hour))
+	if err == nil {
+		t.Errorf("A failed job did not return an error")
+	}
+	fires, _ := s.History(context.Background(), "hourly", 10)
+	if len(fires) != 1 || fires[0].Error != "boom" || fires[0].Finished.IsZero() {
+		t.Errorf("Got history %+v, want a finished fire with the error", fires)
+	}
+}
+
+func TestSchedulerRerunsOrphanedFires(t *testing.T) {
+	thisHour := time.Now().Truncate(time.Hour)
+	orphan := thisHour.Add(-3 * time.Hour)
+	// session 1 died while running the fire of 3 hours ago
+	db := &scheduleDB{
+		fires:   []*ScheduledFire{{JobName: "hourly", FireTime: orphan, SessionID: 1}},
+		expired: map[int64]bool{1: true},
+	}
+	s, j, runs := newTestScheduler(t, db, 2, CatchUpSkip, 1)
+
+	err := s.runDue(context.Background(), j)
+	if err != nil {
+		t.Fatalf("Error running due fires: %v", err)
+	}
+	s.jobGroup.Wait()
+	got := runs.get()
+	if len(got) != 2 || !got[0].Equal(orphan) || !got[1].Equal(thisHour) {
+		t.Fatalf("Ran fires %v, want the orphaned fire and then this hour", got)
+	}
+	fires, _ := s.History(context.Background(), "hourly", 10)
+	for _, fire := range fires {
+		if fire.SessionID != 2 || fire.Finished.IsZero() {
+			t.Errorf("Got fire %+v, want it finished by session 2", fire)
+		}
+	}
+}
+
+func TestSchedulerDoesNotFinishReclaimedFire(t *testing.T) {
+	thisHour := time.Now().Truncate(time.Hour)
+	db := &scheduleDB{expired: map[int64]bool{}}
+	s, j, _ := newTestScheduler(t, db, 1, CatchUpOnce, 1)
+	// session 1 expires while it runs the fire and session 2 claims it again
+	j.Run = func(ctx context.Context, fireTime time.Time) error {
+		db.mutex.Lock()
+		db.expired[1] = true
+		db.mutex.Unlock()
+		claimed, _ := db.ClaimScheduledFire(ctx, "hourly", fireTime, 2)
+		if !claimed {
+			t.Errorf("Session 2 could not claim the orphaned fire")
+		}
+		return errors.New("boom")
+	}
+
+	err := s.fire(context.Background(), db, j, thisHour)
+	if err == nil {
+		t.Errorf("A failed job did not return an error")
+	}
+	fires, _ := s.History(context.Background(), "hourly", 10)
+	if len(fires) != 1 || fires[0].SessionID != 2 || !fires[0].Finished.IsZero() || fires[0].Error != "" {
+		t.Errorf("Got history %+v, want the fire still running for session 2", fires)
+	}
+}
+
+func TestSchedulerWaitsForRunningJob(t *testing.T) {
+	s, j, runs := newTestScheduler(t, &scheduleDB{}, 1, CatchUpAll, 3)
+	j.running.Store(true)
+
+	err := s.runDue(context.Background(), j)
+	if err != nil {
+		t.Fatalf("Error running due fires: %v", err)
+	}
+	s.jobGroup.Wait()
+	if got := runs.get(); len(got) != 0 {
+		t.Errorf("Ran %v while the job was still running", got)
+	}
+}
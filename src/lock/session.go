@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/promoboxx/go-glitch/glitch"
 	"github.com/promoboxx/go-metric-client/metrics"
 
 	otext "github.com/opentracing/opentracing-go/ext"
@@ -15,10 +16,19 @@ import (
 
 // Tasker can do the work associated with the tasks passed to it.
 // It should return any completed tasks so they can by flaged as "finished"
-type Tasker func(ctx context.Context, tasks []Task) ([]Task, error)
+// Use a ResultTasker to report failed and retried tasks.
+type Tasker = TypedTasker[Task]
+
+// TypedTasker is a Tasker for tasks of type T
+type TypedTasker[T Task] func(ctx context.Context, tasks []T) ([]T, error)
 
 // Runner will loop and run tasks assigned to it
-type Runner struct {
+type Runner = TypedRunner[Task]
+
+// TypedRunner is a Runner for tasks of type T.  Tasks come out of the TypedScanTask and into the Tasker as T
+// so the Tasker does not need type assertions.
+type TypedRunner[T Task] struct {
+	runnerOptions
 	stop            chan bool
 	stopGroup       *sync.WaitGroup
 	sessionMutex    sync.RWMutex
@@ -26,11 +36,12 @@ type Runner struct {
 	tasksPerSession int64
 	dbFinder        DBFinder
 	client          metrics.Client
-	scanTask        ScanTask
+	scanTask        TypedScanTask[T]
 	loopTick        time.Duration
 	logger          Logger
-	tasker          Tasker
+	tasker          TypedResultTasker[T]
 	name            string
+	lastPurge       time.Time
 }
 
 // NewRunner will create a new Runner to handle a type of task
@@ -40,7 +51,26 @@ type Runner struct {
 // looptick defines how often to check for tasks to complete
 // client is a go-metrics-client that will also start spans for us
 // logger is optional and will log errors if provided
-func NewRunner(dbFinder DBFinder, scanTask ScanTask, tasker Tasker, loopTick time.Duration, tasksPerSession int64, logger Logger, name string, client metrics.Client) *Runner {
+// opts can change optional behavior like the RetryPolicy
+func NewRunner(dbFinder DBFinder, scanTask ScanTask, tasker Tasker, loopTick time.Duration, tasksPerSession int64, logger Logger, name string, client metrics.Client, opts ...RunnerOption) *Runner {
+	return NewTypedRunner(dbFinder, scanTask, tasker, loopTick, tasksPerSession, logger, name, client, opts...)
+}
+
+// NewResultRunner will create a new Runner to handle a type of task with a ResultTasker that reports an outcome per task
+// The other arguments are the same as NewRunner
+func NewResultRunner(dbFinder DBFinder, scanTask ScanTask, tasker ResultTasker, loopTick time.Duration, tasksPerSession int64, logger Logger, name string, client metrics.Client, opts ...RunnerOption) *Runner {
+	return NewTypedResultRunner(dbFinder, scanTask, tasker, loopTick, tasksPerSession, logger, name, client, opts...)
+}
+
+// NewTypedRunner will create a new TypedRunner for tasks of type T
+// The arguments are the same as NewRunner
+func NewTypedRunner[T Task](dbFinder DBFinder, scanTask TypedScanTask[T], tasker TypedTasker[T], loopTick time.Duration, tasksPerSession int64, logger Logger, name string, client metrics.Client, opts ...RunnerOption) *TypedRunner[T] {
+	return NewTypedResultRunner(dbFinder, scanTask, tasker.Results(), loopTick, tasksPerSession, logger, name, client, opts...)
+}
+
+// NewTypedResultRunner will create a new TypedRunner for tasks of type T with a TypedResultTasker that reports an outcome per task
+// The arguments are the same as NewRunner
+func NewTypedResultRunner[T Task](dbFinder DBFinder, scanTask TypedScanTask[T], tasker TypedResultTasker[T], loopTick time.Duration, tasksPerSession int64, logger Logger, name string, client metrics.Client, opts ...RunnerOption) *TypedRunner[T] {
 	if client == nil {
 		return nil
 	}
@@ -48,7 +78,8 @@ func NewRunner(dbFinder DBFinder, scanTask ScanTask, tasker Tasker, loopTick tim
 		logger = &noopLogger{}
 	}
 	var sg sync.WaitGroup
-	return &Runner{
+	r := &TypedRunner[T]{
+		runnerOptions:   defaultRunnerOptions(),
 		dbFinder:        dbFinder,
 		client:          client,
 		scanTask:        scanTask,
@@ -59,11 +90,15 @@ func NewRunner(dbFinder DBFinder, scanTask ScanTask, tasker Tasker, loopTick tim
 		name:            name,
 		stopGroup:       &sg,
 	}
+	for _, opt := range opts {
+		opt(&r.runnerOptions)
+	}
+	return r
 }
 
 // Run will start looping and processing tasks
 // dont call this more than once.
-func (r *Runner) Run() error {
+func (r *TypedRunner[T]) Run() error {
 	db, err := r.dbFinder()
 	if err != nil {
 		return err
@@ -83,11 +118,12 @@ func (r *Runner) Run() error {
 		// sleep up to 10 seconds to break up services that start at the same time
 		time.Sleep(time.Duration(rand.Int63n(10)) * time.Second)
 
-		// setup a ticker to get and do work
-		tick := time.Tick(r.loopTick)
+		// setup a timer to get and do work
+		timer := time.NewTimer(r.loopTick)
 		for {
 			select {
 			case <-r.stop: // if Stop() was called, exit
+				timer.Stop()
 				err := r.endSession(context.Background())
 				if err != nil {
 					r.logger.Printf("Error ending session: %v", err)
@@ -97,8 +133,8 @@ func (r *Runner) Run() error {
 				// noop
 			}
 			select {
-			case <-tick:
-				// doWork until no tasks remain
+			case <-timer.C:
+				// doWork until no tasks are handled
 				for {
 					// use wait group to block while doing work.
 					r.stopGroup.Add(1)
@@ -114,6 +150,9 @@ func (r *Runner) Run() error {
 					}
 					r.stopGroup.Done()
 				}
+				r.expireTasks(context.Background())
+				r.purgeResults(context.Background())
+				timer.Reset(r.nextWait(context.Background()))
 			}
 		}
 	}()
@@ -138,7 +177,7 @@ func (r *Runner) Run() error {
 	return nil
 }
 
-func (r *Runner) startSession(ctx context.Context, db Database) (sessionID int64, err error) {
+func (r *TypedRunner[T]) startSession(ctx context.Context, db Database) (sessionID int64, err error) {
 	span, spanCtx := r.client.StartSpanWithContext(ctx, "runner start session")
 	defer func() {
 		if err != nil {
@@ -153,7 +192,7 @@ func (r *Runner) startSession(ctx context.Context, db Database) (sessionID int64
 	return sessionID, err
 }
 
-func (r *Runner) endSession(ctx context.Context) (err error) {
+func (r *TypedRunner[T]) endSession(ctx context.Context) (err error) {
 	span, spanCtx := r.client.StartSpanWithContext(ctx, "runner end session")
 	defer func() {
 		if err != nil {
@@ -177,7 +216,7 @@ func (r *Runner) endSession(ctx context.Context) (err error) {
 	return
 }
 
-func (r *Runner) doWork(ctx context.Context) (tasks []Task, err error) {
+func (r *TypedRunner[T]) doWork(ctx context.Context) (handled []T, err error) {
 	span, spanCtx := r.client.StartSpanWithContext(ctx, "doing work")
 	start := time.Now()
 	name := r.name
@@ -196,52 +235,321 @@ func (r *Runner) doWork(ctx context.Context) (tasks []Task, err error) {
 	db, err := r.dbFinder()
 	if err != nil {
 		r.handleError(start, sessionID, name, "Failed to find DB", err.Error(), params)
-		return tasks, fmt.Errorf("Error finding DB: %v", err)
+		return handled, fmt.Errorf("Error finding DB: %v", err)
+	}
+	pwg, paged := db.(PagedWorkGetter)
+	if paged && r.batchSize > 0 {
+		// read one batch at a time.  Each page starts after the last task of the one before,
+		// so tasks that are skipped or left with the session do not hide the tasks behind them.
+		afterID := ""
+		for {
+			tasks, workSessionID, err := r.getWork(spanCtx, db, pwg, afterID, start, sessionID, params)
+			if err != nil {
+				return handled, err
+			}
+			if len(tasks) == 0 {
+				break
+			}
+			batchHandled, err := r.runBatch(spanCtx, db, workSessionID, start, sessionID, params, tasks)
+			handled = append(handled, batchHandled...)
+			if err != nil {
+				return handled, err
+			}
+			if int64(len(tasks)) < r.batchSize {
+				break
+			}
+			afterID = tasks[len(tasks)-1].GetID()
+		}
+	} else {
+		tasks, workSessionID, err := r.getWork(spanCtx, db, nil, "", start, sessionID, params)
+		if err != nil {
+			return handled, err
+		}
+
+		// work the tasks in batches, recording the outcomes of each batch before starting the next
+		batchSize := int(r.batchSize)
+		if batchSize <= 0 || batchSize > len(tasks) {
+			batchSize = len(tasks)
+		}
+		for i := 0; ; i += batchSize {
+			end := i + batchSize
+			if end > len(tasks) {
+				end = len(tasks)
+			}
+			batchHandled, err := r.runBatch(spanCtx, db, workSessionID, start, sessionID, params, tasks[i:end])
+			handled = append(handled, batchHandled...)
+			if err != nil {
+				return handled, err
+			}
+			if end >= len(tasks) {
+				break
+			}
+		}
+	}
+
+	end := time.Since(start)
+	r.client.BackgroundDuration(sessionID, name, params, end)
+	return handled, nil
+}
+
+// getWork reads the tasks of the session from db, only the page after afterID if pwg is set.
+// It starts a new session if the session expired.  The tasks are returned with the session they belong to.
+func (r *TypedRunner[T]) getWork(spanCtx context.Context, db Database, pwg PagedWorkGetter, afterID string, start time.Time, sessionID string, params map[string]string) ([]T, int64, error) {
+	name := r.name
+	workCtx := spanCtx
+	if r.taskTypes != nil {
+		workCtx = withTaskTypes(spanCtx, r.taskTypes())
 	}
 	r.sessionMutex.RLock()
-	tasks, dbErr := db.GetWork(spanCtx, r.sessionID, r.tasksPerSession, r.scanTask)
+	workSessionID := r.sessionID
+	var work []Task
+	var dbErr glitch.DataError
+	if pwg != nil {
+		work, dbErr = pwg.GetWorkPage(workCtx, workSessionID, r.tasksPerSession, r.batchSize, afterID, r.scanUntyped)
+	} else {
+		work, dbErr = db.GetWork(workCtx, workSessionID, r.tasksPerSession, r.scanUntyped)
+	}
 	r.sessionMutex.RUnlock()
 	if dbErr != nil {
 		switch dbErr.Code() {
 		case SQLErrorSessionNotFound:
 			r.logger.Printf("Session expired. Getting new one")
+			var err error
 			r.sessionMutex.Lock()
 			r.sessionID, err = db.StartSession(spanCtx)
 			r.sessionMutex.Unlock()
 			if err != nil {
 				r.handleError(start, sessionID, name, "Failed to start session", err.Error()+" with dbError: "+dbErr.Error(), params)
-				return tasks, fmt.Errorf("Error starting new session: %v", dbErr)
+				return nil, 0, fmt.Errorf("Error starting new session: %v", dbErr)
 			}
 		default:
 			r.handleError(start, sessionID, name, "Failed getting work from db", "with dbError: "+dbErr.Error(), params)
-			return tasks, fmt.Errorf("Error getting work from db: %v", dbErr)
+			return nil, 0, fmt.Errorf("Error getting work from db: %v", dbErr)
+		}
+
+	}
+
+	tasks, err := typedTasks[T](work)
+	if err != nil {
+		r.handleError(start, sessionID, name, "Failed reading work from db", err.Error(), params)
+		return nil, 0, err
+	}
+	return tasks, workSessionID, nil
+}
+
+// runBatch hands tasks to the Tasker and records their outcomes
+func (r *TypedRunner[T]) runBatch(spanCtx context.Context, db Database, workSessionID int64, start time.Time, sessionID string, params map[string]string, tasks []T) (handled []T, err error) {
+	name := r.name
+
+	// expired tasks are not started, expire_tasks takes them out of the pool
+	tasks, late := splitExpired(tasks)
+	if len(late) > 0 {
+		r.logger.Printf("Not starting %d tasks that expired", len(late))
+	}
+
+	rc := &runContext{db: db, sessionID: workSessionID}
+	rc.completer = r.startCompleter(spanCtx, db)
+	runCtx := withRunContext(spanCtx, rc)
+	watch := r.watchCancellations(runCtx, db, rc, tasks)
+	results, taskErr := r.tasker(runCtx, tasks)
+	cancelled := watch.stop()
+	flushed, unflushed := rc.completer.stop(spanCtx)
+	results, completed := mergeCompletions(results, flushed, unflushed)
+	if taskErr != nil {
+		r.handleError(start, sessionID, name, "Error running tasks", taskErr.Error(), params)
+	}
+	if len(cancelled) > 0 {
+		// cancelled tasks are already out of the pool so their results are dropped
+		results = withoutTasks(results, cancelled)
+		r.client.BackgroundCustom(sessionID, name, "cancelled_tasks", params, nil, int64(len(cancelled)))
+	}
+	if expired := expiredResults(results); len(expired) > 0 {
+		// work that finished after its task expired is not recorded
+		results = withoutTasks(results, expired)
+		r.logger.Printf("Dropping results of %d tasks that expired while running", len(expired))
+	}
+
+	// record outcomes even when the tasker errored so successful work is not redone
+	handled, err = r.recordResults(spanCtx, db, sessionID, params, results)
+	handled = append(handled, completed...)
+	if err != nil {
+		r.handleError(start, sessionID, name, "Error recording task results", err.Error(), params)
+		return handled, err
+	}
+	if taskErr != nil {
+		return handled, fmt.Errorf("Error running tasks: %v", taskErr)
+	}
+	return handled, nil
+}
+
+// recordResults flags tasks as finished, failed or retried and returns the tasks that were handled
+func (r *TypedRunner[T]) recordResults(ctx context.Context, db Database, sessionID string, params map[string]string, results []TypedTaskResult[T]) ([]T, error) {
+	var handled []T
+	var finished []T
+	var finishedTasks []FinishedTask
+	var failures, retries []TaskFailure
+	var releases []ReleasedTask
+	for _, result := range results {
+		switch result.Status {
+		case TaskSucceeded:
+			finished = append(finished, result.Task)
+			finishedTasks = append(finishedTasks, FinishedTask{TaskID: result.Task.GetID(), Result: result.Result})
+		case TaskFailed:
+			failures = append(failures, TaskFailure{TaskID: result.Task.GetID(), Error: errorMessage(result.Err)})
+		case TaskRetry:
+			attempt := attempts(result.Task) + 1
+			if r.retryPolicy.exhausted(attempt) {
+				failures = append(failures, TaskFailure{TaskID: result.Task.GetID(), Error: fmt.Sprintf("gave up after %d attempts: %s", attempt, errorMessage(result.Err))})
+				continue
+			}
+			delay := result.RetryAfter
+			if delay <= 0 {
+				delay = retryAfterHint(result.Err)
+			}
+			if delay <= 0 {
+				delay = r.retryPolicy.Delay(attempt)
+			}
+			// the DB also counts attempts, so MaxAttempts holds for tasks that do not report them
+			retries = append(retries, TaskFailure{TaskID: result.Task.GetID(), Error: errorMessage(result.Err), NotBefore: time.Now().Add(delay), MaxAttempts: r.retryPolicy.MaxAttempts})
+		case TaskRelease:
+			release := ReleasedTask{TaskID: result.Task.GetID()}
+			if result.RetryAfter > 0 {
+				release.NotBefore = time.Now().Add(result.RetryAfter)
+			}
+			releases = append(releases, release)
 		}
+	}
 
+	dbErr := finishTasks(ctx, db, finishedTasks)
+	if dbErr != nil {
+		return handled, fmt.Errorf("Error finishing tasks: %v", dbErr)
 	}
+	handled = append(handled, finished...)
 
-	completedTasks, err := r.tasker(spanCtx, tasks)
+	released, err := r.releaseTasks(ctx, db, sessionID, params, releases, results)
+	handled = append(handled, released...)
 	if err != nil {
-		r.handleError(start, sessionID, name, "Error running tasks", err.Error(), params)
-		return tasks, fmt.Errorf("Error running tasks: %v", err)
+		return handled, err
 	}
 
-	taskIDs := make([]string, len(completedTasks))
-	for i, t := range completedTasks {
-		taskIDs[i] = t.GetID()
+	if len(failures) == 0 && len(retries) == 0 {
+		return handled, nil
 	}
+	recorder, ok := db.(OutcomeRecorder)
+	if !ok {
+		r.logger.Printf("Database does not implement OutcomeRecorder, leaving %d failed and %d retried tasks with the session", len(failures), len(retries))
+		return handled, nil
+	}
+	if len(failures) > 0 {
+		dbErr = recorder.FailTasks(ctx, failures)
+		if dbErr != nil {
+			return handled, fmt.Errorf("Error failing tasks: %v", dbErr)
+		}
+		r.client.BackgroundCustom(sessionID, r.name, "dead_lettered_tasks", params, nil, int64(len(failures)))
+	}
+	if len(retries) > 0 {
+		dbErr = recorder.RetryTasks(ctx, retries)
+		if dbErr != nil {
+			return handled, fmt.Errorf("Error retrying tasks: %v", dbErr)
+		}
+		r.client.BackgroundCustom(sessionID, r.name, "retried_tasks", params, nil, int64(len(retries)))
+	}
+	for _, result := range results {
+		if result.Status == TaskFailed || result.Status == TaskRetry {
+			handled = append(handled, result.Task)
+		}
+	}
+	return handled, nil
+}
 
-	dbErr = db.FinishTasks(spanCtx, taskIDs)
+// releaseTasks gives released tasks back to the pool and returns them
+func (r *TypedRunner[T]) releaseTasks(ctx context.Context, db Database, sessionID string, params map[string]string, releases []ReleasedTask, results []TypedTaskResult[T]) ([]T, error) {
+	if len(releases) == 0 {
+		return nil, nil
+	}
+	releaser, ok := db.(TaskReleaser)
+	if !ok {
+		r.logger.Printf("Database does not implement TaskReleaser, leaving %d released tasks with the session", len(releases))
+		return nil, nil
+	}
+	dbErr := releaser.ReleaseTasks(ctx, releases)
 	if dbErr != nil {
-		r.handleError(start, sessionID, name, "Error finishing tasks", dbErr.Error(), params)
-		return tasks, fmt.Errorf("Error finishing tasks: %v", dbErr)
+		return nil, fmt.Errorf("Error releasing tasks: %v", dbErr)
 	}
-	end := time.Since(start)
-	r.client.BackgroundDuration(sessionID, name, params, end)
-	return tasks, nil
+	r.client.BackgroundCustom(sessionID, r.name, "released_tasks", params, nil, int64(len(releases)))
+	var released []T
+	for _, result := range results {
+		if result.Status == TaskRelease {
+			released = append(released, result.Task)
+		}
+	}
+	return released, nil
+}
+
+// withoutTasks returns the results for tasks that are not in ids
+func withoutTasks[T Task](results []TypedTaskResult[T], ids map[string]bool) []TypedTaskResult[T] {
+	kept := make([]TypedTaskResult[T], 0, len(results))
+	for _, result := range results {
+		if !ids[result.Task.GetID()] {
+			kept = append(kept, result)
+		}
+	}
+	return kept
+}
+
+// scanUntyped adapts the TypedScanTask to the ScanTask a Database uses
+func (r *TypedRunner[T]) scanUntyped(row Scanner) (Task, glitch.DataError) {
+	task, dbErr := r.scanTask(row)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return task, nil
+}
+
+// typedTasks converts the tasks scanned by a TypedScanTask back to T
+func typedTasks[T Task](tasks []Task) ([]T, error) {
+	typed := make([]T, len(tasks))
+	for i, task := range tasks {
+		t, ok := task.(T)
+		if !ok {
+			return nil, fmt.Errorf("Error reading work from db: task %d is a %T", i, task)
+		}
+		typed[i] = t
+	}
+	return typed, nil
+}
+
+// nextWait returns how long to wait before looking for work again.
+// This is the loop tick unless a delayed task becomes due sooner.
+func (r *TypedRunner[T]) nextWait(ctx context.Context) time.Duration {
+	db, err := r.dbFinder()
+	if err != nil {
+		return r.loopTick
+	}
+	ndf, ok := db.(NextDueFinder)
+	if !ok {
+		return r.loopTick
+	}
+	due, dbErr := ndf.GetNextTaskDue(ctx)
+	if dbErr != nil {
+		r.logger.Printf("Error getting next task due: %v", dbErr)
+		return r.loopTick
+	}
+	if due.IsZero() {
+		return r.loopTick
+	}
+	wait := time.Until(due)
+	if wait < 0 {
+		wait = 0
+	}
+	if wait < r.loopTick {
+		return wait
+	}
+	return r.loopTick
 }
 
 // Does common error stuff
-func (r *Runner) handleError(start time.Time, sessionID, name, code, message string, params map[string]string) {
+func (r *TypedRunner[T]) handleError(start time.Time, sessionID, name, code, message string, params map[string]string) {
 	end := time.Since(start)
 	r.client.BackgroundDuration(sessionID, name, params, end)
 	r.client.BackgroundError(sessionID, name, params, code, message, 1)
@@ -249,7 +557,7 @@ func (r *Runner) handleError(start time.Time, sessionID, name, code, message str
 
 // Stop stops the runner from looping
 // Stop returns a WaitGroup which you can wait on to ensure all work is finished
-func (r *Runner) Stop() *sync.WaitGroup {
+func (r *TypedRunner[T]) Stop() *sync.WaitGroup {
 	close(r.stop)
 	return r.stopGroup
 }
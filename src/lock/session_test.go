@@ -0,0 +1,113 @@
+package lock
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-metric-client/metrics"
+)
+
+type testTask struct {
+	id string
+}
+
+func (t *testTask) GetID() string {
+	return t.id
+}
+
+// noopClient is a metrics.Client that records nothing, the methods a Runner does not call panic
+type noopClient struct {
+	metrics.Client
+}
+
+func (noopClient) BackgroundRate(sessionID, jobName string, params map[string]string, value int64) error {
+	return nil
+}
+
+func (noopClient) BackgroundError(sessionID, jobName string, params map[string]string, code, message string, value int64) error {
+	return nil
+}
+
+func (noopClient) BackgroundCustom(sessionID, jobName, customName string, params, other map[string]string, value int64) error {
+	return nil
+}
+
+func (noopClient) BackgroundDuration(sessionID, jobName string, params map[string]string, value time.Duration) error {
+	return nil
+}
+
+func (noopClient) StartSpanWithContext(ctx context.Context, name string) (opentracing.Span, context.Context) {
+	return opentracing.NoopTracer{}.StartSpan(name), ctx
+}
+
+// baseDB implements only Database.  It hands out its tasks to the first GetWork and records the finished tasks.
+type baseDB struct {
+	mutex    sync.Mutex
+	tasks    []Task
+	finished []string
+}
+
+func (d *baseDB) StartSession(ctx context.Context) (int64, glitch.DataError) {
+	return 1, nil
+}
+
+func (d *baseDB) EndSession(ctx context.Context, sessionID int64) glitch.DataError {
+	return nil
+}
+
+func (d *baseDB) BumpSession(ctx context.Context, sessionID int64) glitch.DataError {
+	return nil
+}
+
+func (d *baseDB) GetWork(ctx context.Context, sessionID int64, tasksPerSession int64, scanTask ScanTask) ([]Task, glitch.DataError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	tasks := d.tasks
+	d.tasks = nil
+	return tasks, nil
+}
+
+func (d *baseDB) FinishTasks(ctx context.Context, taskIDs []string) glitch.DataError {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.finished = append(d.finished, taskIDs...)
+	return nil
+}
+
+func (d *baseDB) finishedIDs() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ids := append([]string(nil), d.finished...)
+	sort.Strings(ids)
+	return ids
+}
+
+func newTestRunner(db Database, tasker Tasker) *Runner {
+	r := NewRunner(func() (Database, error) { return db, nil }, nil, tasker, time.Second, 10, nil, "test", noopClient{})
+	r.sessionID = 1
+	return r
+}
+
+func TestDoWorkFinishesCompletedTasks(t *testing.T) {
+	db := &baseDB{tasks: []Task{&testTask{id: "1"}, &testTask{id: "2"}}}
+	r := newTestRunner(db, func(ctx context.Context, tasks []Task) ([]Task, error) {
+		return tasks[:1], nil
+	})
+
+	handled, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if len(handled) != 1 {
+		t.Errorf("Handled %d tasks, want the task the Tasker completed", len(handled))
+	}
+	if got := strings.Join(db.finishedIDs(), ","); got != "1" {
+		t.Errorf("Finished %s, want only the task the Tasker completed", got)
+	}
+}
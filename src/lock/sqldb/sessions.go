@@ -0,0 +1,179 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// ClaimLeadership calls claim_leadership
+func (d *DB) ClaimLeadership(ctx context.Context, role string, sessionID int64) (bool, glitch.DataError) {
+	var isLeader bool
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.ClaimLeadership)+"($1, $2)", role, sessionID).scan(&isLeader)
+	if err != nil {
+		return false, toDataError(err, "Error claiming leadership")
+	}
+	return isLeader, nil
+}
+
+// ClaimScheduledFire calls claim_scheduled_fire
+func (d *DB) ClaimScheduledFire(ctx context.Context, jobName string, fireTime time.Time, sessionID int64) (bool, glitch.DataError) {
+	var claimed bool
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.ClaimScheduledFire)+"($1, $2, $3)", jobName, fireTime.UTC(), sessionID).scan(&claimed)
+	if err != nil {
+		return false, toDataError(err, "Error claiming scheduled fire")
+	}
+	return claimed, nil
+}
+
+// FinishScheduledFire calls finish_scheduled_fire, which stores an empty errMessage as NULL
+func (d *DB) FinishScheduledFire(ctx context.Context, jobName string, fireTime time.Time, sessionID int64, errMessage string) (bool, glitch.DataError) {
+	var finished bool
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.FinishScheduledFire)+"($1, $2, $3, $4)", jobName, fireTime.UTC(), sessionID, errMessage).scan(&finished)
+	if err != nil {
+		return false, toDataError(err, "Error finishing scheduled fire")
+	}
+	return finished, nil
+}
+
+// GetLastScheduledFire calls get_last_scheduled_fire
+func (d *DB) GetLastScheduledFire(ctx context.Context, jobName string) (time.Time, glitch.DataError) {
+	var last sql.NullTime
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.GetLastScheduledFire)+"($1)", jobName).scan(&last)
+	if err != nil {
+		return time.Time{}, toDataError(err, "Error getting last scheduled fire")
+	}
+	if !last.Valid {
+		return time.Time{}, nil
+	}
+	return last.Time, nil
+}
+
+// GetScheduledFires calls get_scheduled_fires
+func (d *DB) GetScheduledFires(ctx context.Context, jobName string, limit int64) ([]lock.ScheduledFire, glitch.DataError) {
+	rows, err := d.db.Query(ctx, "SELECT job_name, fire_time, session_id, claimed, finished, error FROM "+d.function(d.config.GetScheduledFires)+"($1, $2)", jobName, limit)
+	if err != nil {
+		return nil, toDataError(err, "Error getting scheduled fires")
+	}
+	defer rows.Close()
+
+	var fires []lock.ScheduledFire
+	for rows.Next() {
+		var fire lock.ScheduledFire
+		var finished sql.NullTime
+		var errMessage sql.NullString
+		err = rows.Scan(&fire.JobName, &fire.FireTime, &fire.SessionID, &fire.Claimed, &finished, &errMessage)
+		if err != nil {
+			return nil, toDataError(err, "Error getting scheduled fires")
+		}
+		fire.Finished = finished.Time
+		fire.Error = errMessage.String
+		fires = append(fires, fire)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, toDataError(err, "Error getting scheduled fires")
+	}
+	return fires, nil
+}
+
+// GetOrphanedScheduledFires calls get_orphaned_scheduled_fires
+func (d *DB) GetOrphanedScheduledFires(ctx context.Context, jobName string) ([]time.Time, glitch.DataError) {
+	rows, err := d.db.Query(ctx, "SELECT f FROM "+d.function(d.config.GetOrphanedScheduledFires)+"($1) AS f", jobName)
+	if err != nil {
+		return nil, toDataError(err, "Error getting orphaned scheduled fires")
+	}
+	defer rows.Close()
+
+	var fireTimes []time.Time
+	for rows.Next() {
+		var fireTime time.Time
+		err = rows.Scan(&fireTime)
+		if err != nil {
+			return nil, toDataError(err, "Error getting orphaned scheduled fires")
+		}
+		fireTimes = append(fireTimes, fireTime)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, toDataError(err, "Error getting orphaned scheduled fires")
+	}
+	return fireTimes, nil
+}
+
+// GetDeadTasks calls get_dead_tasks
+func (d *DB) GetDeadTasks(ctx context.Context, filter lock.DeadTaskFilter) ([]lock.DeadTask, glitch.DataError) {
+	query := "SELECT id, task_id, session_id, attempts, error, array_to_json(error_history)::TEXT, task::TEXT, died FROM " +
+		d.function(d.config.GetDeadTasks) + "($1::BIGINT[], $2::TEXT[], $3, $4, $5, $6)"
+	rows, err := d.db.Query(ctx, query, deadTaskFilterArgs(filter)...)
+	if err != nil {
+		return nil, toDataError(err, "Error getting dead tasks")
+	}
+	defer rows.Close()
+
+	var tasks []lock.DeadTask
+	for rows.Next() {
+		var task lock.DeadTask
+		var sessionID sql.NullInt64
+		var errMessage, snapshot sql.NullString
+		var errorHistory string
+		err = rows.Scan(&task.ID, &task.TaskID, &sessionID, &task.Attempts, &errMessage, &errorHistory, &snapshot, &task.Died)
+		if err != nil {
+			return nil, toDataError(err, "Error getting dead tasks")
+		}
+		err = json.Unmarshal([]byte(errorHistory), &task.ErrorHistory)
+		if err != nil {
+			return nil, toDataError(err, "Error getting dead tasks")
+		}
+		task.SessionID = sessionID.Int64
+		task.Error = errMessage.String
+		if snapshot.Valid {
+			task.Task = json.RawMessage(snapshot.String)
+		}
+		tasks = append(tasks, task)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, toDataError(err, "Error getting dead tasks")
+	}
+	return tasks, nil
+}
+
+// RequeueDeadTasks calls requeue_dead_tasks
+func (d *DB) RequeueDeadTasks(ctx context.Context, filter lock.DeadTaskFilter) (int64, glitch.DataError) {
+	var count int64
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.RequeueDeadTasks)+"($1::BIGINT[], $2::TEXT[], $3, $4, $5, $6)", deadTaskFilterArgs(filter)...).scan(&count)
+	if err != nil {
+		return 0, toDataError(err, "Error requeueing dead tasks")
+	}
+	return count, nil
+}
+
+// PurgeDeadTasks calls purge_dead_tasks
+func (d *DB) PurgeDeadTasks(ctx context.Context, filter lock.DeadTaskFilter) (int64, glitch.DataError) {
+	var count int64
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.PurgeDeadTasks)+"($1::BIGINT[], $2::TEXT[], $3, $4, $5, $6)", deadTaskFilterArgs(filter)...).scan(&count)
+	if err != nil {
+		return 0, toDataError(err, "Error purging dead tasks")
+	}
+	return count, nil
+}
+
+// deadTaskFilterArgs binds a filter to the parameters of the dead letter functions.  Empty fields are NULL so they do not filter.
+func deadTaskFilterArgs(filter lock.DeadTaskFilter) []interface{} {
+	args := []interface{}{nil, nil, nullString(filter.ErrorContains), nullTime(filter.DiedAfter), nullTime(filter.DiedBefore), nil}
+	if len(filter.IDs) > 0 {
+		args[0] = intArray(filter.IDs)
+	}
+	if len(filter.TaskIDs) > 0 {
+		args[1] = textArray(filter.TaskIDs)
+	}
+	if filter.Limit > 0 {
+		args[5] = filter.Limit
+	}
+	return args
+}
@@ -0,0 +1,519 @@
+// Package sqldb implements lock.Database over a *sql.DB connected to Postgres with the plpgsql functions in migration.
+// Any database/sql Postgres driver works, such as lib/pq or pgx's stdlib.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// Error codes
+const (
+	ErrorQueryingDB = "ERROR_QUERYING_DB"
+)
+
+// Config names the schema and plpgsql functions a DB calls
+type Config struct {
+	// Schema qualifies every function, empty uses the search_path
+	Schema string
+	// IDKind is the type of the task_id domain, used to bind task ids
+	IDKind lock.IDKind
+	// Queue makes the DB work a single queue of the generic task table with get_queue_work in place of get_work.
+	// Only tasks of the types from lock.TaskTypesFrom are claimed.
+	Queue string
+
+	StartSession              string
+	BumpSession               string
+	EndSession                string
+	GetWork                   string
+	FinishTasks               string
+	EnqueueTask               string
+	EnqueueTasks              string
+	GetQueueWork              string
+	GetQueueWorkPage          string
+	ReleaseTasks              string
+	ExtendTaskLease           string
+	SaveCheckpoint            string
+	GetNextTaskDue            string
+	FailTasks                 string
+	RetryTasks                string
+	CancelTasks               string
+	GetCancelledTasks         string
+	GetTaskResult             string
+	PurgeTaskResults          string
+	ExpireTasks               string
+	ClaimLeadership           string
+	ClaimScheduledFire        string
+	FinishScheduledFire       string
+	GetLastScheduledFire      string
+	GetScheduledFires         string
+	GetOrphanedScheduledFires string
+	GetDeadTasks              string
+	RequeueDeadTasks          string
+	PurgeDeadTasks            string
+}
+
+// DefaultConfig returns a Config for the functions as they are named in migration with BIGINT task ids
+func DefaultConfig() Config {
+	return Config{
+		IDKind:                    lock.BigintID,
+		StartSession:              "start_session",
+		BumpSession:               "bump_session",
+		EndSession:                "end_session",
+		GetWork:                   "get_work",
+		FinishTasks:               "finish_tasks",
+		EnqueueTask:               "enqueue_task",
+		EnqueueTasks:              "enqueue_tasks",
+		GetQueueWork:              "get_queue_work",
+		GetQueueWorkPage:          "get_queue_work_page",
+		ReleaseTasks:              "release_tasks",
+		ExtendTaskLease:           "extend_task_lease",
+		SaveCheckpoint:            "save_checkpoint",
+		GetNextTaskDue:            "get_next_task_due",
+		FailTasks:                 "fail_tasks",
+		RetryTasks:                "retry_tasks",
+		CancelTasks:               "cancel_tasks",
+		GetCancelledTasks:         "get_cancelled_tasks",
+		GetTaskResult:             "get_task_result",
+		PurgeTaskResults:          "purge_task_results",
+		ExpireTasks:               "expire_tasks",
+		ClaimLeadership:           "claim_leadership",
+		ClaimScheduledFire:        "claim_scheduled_fire",
+		FinishScheduledFire:       "finish_scheduled_fire",
+		GetLastScheduledFire:      "get_last_scheduled_fire",
+		GetScheduledFires:         "get_scheduled_fires",
+		GetOrphanedScheduledFires: "get_orphaned_scheduled_fires",
+		GetDeadTasks:              "get_dead_tasks",
+		RequeueDeadTasks:          "requeue_dead_tasks",
+		PurgeDeadTasks:            "purge_dead_tasks",
+	}
+}
+
+// WithDefaults returns a copy of c with its empty function names set from DefaultConfig
+func (c Config) WithDefaults() Config {
+	defaults := DefaultConfig()
+	c.StartSession = orDefault(c.StartSession, defaults.StartSession)
+	c.BumpSession = orDefault(c.BumpSession, defaults.BumpSession)
+	c.EndSession = orDefault(c.EndSession, defaults.EndSession)
+	c.GetWork = orDefault(c.GetWork, defaults.GetWork)
+	c.FinishTasks = orDefault(c.FinishTasks, defaults.FinishTasks)
+	c.EnqueueTask = orDefault(c.EnqueueTask, defaults.EnqueueTask)
+	c.EnqueueTasks = orDefault(c.EnqueueTasks, defaults.EnqueueTasks)
+	c.GetQueueWork = orDefault(c.GetQueueWork, defaults.GetQueueWork)
+	c.GetQueueWorkPage = orDefault(c.GetQueueWorkPage, defaults.GetQueueWorkPage)
+	c.ReleaseTasks = orDefault(c.ReleaseTasks, defaults.ReleaseTasks)
+	c.ExtendTaskLease = orDefault(c.ExtendTaskLease, defaults.ExtendTaskLease)
+	c.SaveCheckpoint = orDefault(c.SaveCheckpoint, defaults.SaveCheckpoint)
+	c.GetNextTaskDue = orDefault(c.GetNextTaskDue, defaults.GetNextTaskDue)
+	c.FailTasks = orDefault(c.FailTasks, defaults.FailTasks)
+	c.RetryTasks = orDefault(c.RetryTasks, defaults.RetryTasks)
+	c.CancelTasks = orDefault(c.CancelTasks, defaults.CancelTasks)
+	c.GetCancelledTasks = orDefault(c.GetCancelledTasks, defaults.GetCancelledTasks)
+	c.GetTaskResult = orDefault(c.GetTaskResult, defaults.GetTaskResult)
+	c.PurgeTaskResults = orDefault(c.PurgeTaskResults, defaults.PurgeTaskResults)
+	c.ExpireTasks = orDefault(c.ExpireTasks, defaults.ExpireTasks)
+	c.ClaimLeadership = orDefault(c.ClaimLeadership, defaults.ClaimLeadership)
+	c.ClaimScheduledFire = orDefault(c.ClaimScheduledFire, defaults.ClaimScheduledFire)
+	c.FinishScheduledFire = orDefault(c.FinishScheduledFire, defaults.FinishScheduledFire)
+	c.GetLastScheduledFire = orDefault(c.GetLastScheduledFire, defaults.GetLastScheduledFire)
+	c.GetScheduledFires = orDefault(c.GetScheduledFires, defaults.GetScheduledFires)
+	c.GetOrphanedScheduledFires = orDefault(c.GetOrphanedScheduledFires, defaults.GetOrphanedScheduledFires)
+	c.GetDeadTasks = orDefault(c.GetDeadTasks, defaults.GetDeadTasks)
+	c.RequeueDeadTasks = orDefault(c.RequeueDeadTasks, defaults.RequeueDeadTasks)
+	c.PurgeDeadTasks = orDefault(c.PurgeDeadTasks, defaults.PurgeDeadTasks)
+	return c
+}
+
+// orDefault returns name, or def if name is empty
+func orDefault(name, def string) string {
+	if name == "" {
+		return def
+	}
+	return name
+}
+
+// Pipeliner can be implemented by the lock.Querier of a DB to send two queries to the database in one round trip.
+// A DB on a Pipeliner sends bump_session ahead of every get_work, such as a pgxdb.DB created WithPipelinedBump.
+type Pipeliner interface {
+	// QueryAfter runs exec and then query, and returns the rows of query
+	QueryAfter(ctx context.Context, exec string, execArgs []interface{}, query string, args ...interface{}) (lock.Rows, error)
+}
+
+// DB implements lock.Database and every optional interface of the lock package on a lock.Querier, except lock.CancelNotifier.
+// The optional interfaces call the functions of the generic task table in migration/generic and of 1001_sessions.alwaysup.sql.
+type DB struct {
+	db     lock.Querier
+	config Config
+}
+
+// New will create a new DB
+// db is connected to the Postgres database holding the session locking schema
+// config names the functions to call, empty names fall back to DefaultConfig
+func New(db *sql.DB, config Config) *DB {
+	return NewQuerier(lock.SQLQuerier(db), config)
+}
+
+// NewQuerier will create a new DB that runs its queries on q, such as a pgxdb.Querier
+func NewQuerier(q lock.Querier, config Config) *DB {
+	return &DB{db: q, config: config.WithDefaults()}
+}
+
+// StartSession calls start_session and returns the new session id
+func (d *DB) StartSession(ctx context.Context) (int64, glitch.DataError) {
+	var sessionID int64
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.StartSession)+"()").scan(&sessionID)
+	if err != nil {
+		return 0, toDataError(err, "Error starting session")
+	}
+	return sessionID, nil
+}
+
+// BumpSession calls bump_session to keep the session alive
+func (d *DB) BumpSession(ctx context.Context, sessionID int64) glitch.DataError {
+	err := d.db.Exec(ctx, "SELECT "+d.function(d.config.BumpSession)+"($1)", sessionID)
+	if err != nil {
+		return toDataError(err, "Error bumping session")
+	}
+	return nil
+}
+
+// EndSession calls end_session
+func (d *DB) EndSession(ctx context.Context, sessionID int64) glitch.DataError {
+	err := d.db.Exec(ctx, "SELECT "+d.function(d.config.EndSession)+"($1)", sessionID)
+	if err != nil {
+		return toDataError(err, "Error ending session")
+	}
+	return nil
+}
+
+// GetWork calls get_work, or get_queue_work if Config.Queue is set, and scans every task it returns with scanTask
+func (d *DB) GetWork(ctx context.Context, sessionID int64, tasksPerSession int64, scanTask lock.ScanTask) ([]lock.Task, glitch.DataError) {
+	if d.config.Queue != "" {
+		return d.getWork(ctx, sessionID, scanTask, "SELECT * FROM "+d.function(d.config.GetQueueWork)+"($1, $2, $3, $4::TEXT[])",
+			sessionID, d.config.Queue, tasksPerSession, taskTypes(ctx))
+	}
+	return d.getWork(ctx, sessionID, scanTask, "SELECT * FROM "+d.function(d.config.GetWork)+"($1, $2)", sessionID, tasksPerSession)
+}
+
+// GetWorkPage calls the get_work overload, or get_queue_work_page if Config.Queue is set, that only returns the first batchSize tasks after afterID
+func (d *DB) GetWorkPage(ctx context.Context, sessionID int64, tasksPerSession int64, batchSize int64, afterID string, scanTask lock.ScanTask) ([]lock.Task, glitch.DataError) {
+	if d.config.Queue != "" {
+		return d.getWork(ctx, sessionID, scanTask, "SELECT * FROM "+d.function(d.config.GetQueueWorkPage)+"($1, $2, $3, $4, $5::TEXT[], "+d.id(6)+")",
+			sessionID, d.config.Queue, tasksPerSession, batchSize, taskTypes(ctx), nullString(afterID))
+	}
+	return d.getWork(ctx, sessionID, scanTask, "SELECT * FROM "+d.function(d.config.GetWork)+"($1, $2, $3, "+d.id(4)+")",
+		sessionID, tasksPerSession, batchSize, nullString(afterID))
+}
+
+// taskTypes binds the task types from ctx to a TEXT[] parameter, NULL if every type can be claimed
+func taskTypes(ctx context.Context) interface{} {
+	types := lock.TaskTypesFrom(ctx)
+	if types == nil {
+		return nil
+	}
+	return textArray(types)
+}
+
+// getWork runs query and scans every task it returns, after bumping the session in the same round trip if the Querier is a Pipeliner
+func (d *DB) getWork(ctx context.Context, sessionID int64, scanTask lock.ScanTask, query string, args ...interface{}) ([]lock.Task, glitch.DataError) {
+	var rows lock.Rows
+	var err error
+	if p, ok := d.db.(Pipeliner); ok {
+		rows, err = p.QueryAfter(ctx, "SELECT "+d.function(d.config.BumpSession)+"($1)", []interface{}{sessionID}, query, args...)
+	} else {
+		rows, err = d.db.Query(ctx, query, args...)
+	}
+	if err != nil {
+		return nil, toDataError(err, "Error getting work")
+	}
+	defer rows.Close()
+
+	var tasks []lock.Task
+	for rows.Next() {
+		task, dbErr := scanTask(rows)
+		if dbErr != nil {
+			return nil, dbErr
+		}
+		tasks = append(tasks, task)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, toDataError(err, "Error getting work")
+	}
+	return tasks, nil
+}
+
+// FinishTasks calls finish_tasks with the task ids bound as a task_id[]
+func (d *DB) FinishTasks(ctx context.Context, taskIDs []string) glitch.DataError {
+	err := d.db.Exec(ctx, "SELECT "+d.function(d.config.FinishTasks)+"("+d.idArray(1)+")", d.ids(taskIDs))
+	if err != nil {
+		return toDataError(err, "Error finishing tasks")
+	}
+	return nil
+}
+
+// ReleaseTasks calls release_tasks so the tasks are picked up again without counting an attempt
+func (d *DB) ReleaseTasks(ctx context.Context, releases []lock.ReleasedTask) glitch.DataError {
+	taskIDs := make([]string, len(releases))
+	notBefores := make([]time.Time, len(releases))
+	for i, release := range releases {
+		taskIDs[i] = release.TaskID
+		notBefores[i] = release.NotBefore
+	}
+	err := d.db.Exec(ctx, "SELECT "+d.function(d.config.ReleaseTasks)+"("+d.idArray(1)+", $2::TIMESTAMP[])", d.ids(taskIDs), timeArray(notBefores))
+	if err != nil {
+		return toDataError(err, "Error releasing tasks")
+	}
+	return nil
+}
+
+// EnqueueTasks calls enqueue_tasks with every request, see EnqueueTasksTx
+func (d *DB) EnqueueTasks(ctx context.Context, tasks []lock.EnqueueRequest) ([]lock.EnqueueResult, glitch.DataError) {
+	return d.EnqueueTasksTx(ctx, d.db, tasks)
+}
+
+// EnqueueTasksTx calls enqueue_tasks on tx with every request, so a batch is enqueued in one round trip.
+// enqueue_tasks takes the columns of the generic task table in migration/generic, so each Task must be a *lock.QueueTask.
+func (d *DB) EnqueueTasksTx(ctx context.Context, tx lock.Querier, tasks []lock.EnqueueRequest) ([]lock.EnqueueResult, glitch.DataError) {
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+	queues := make([]string, len(tasks))
+	types := make([]string, len(tasks))
+	payloads := make([]string, len(tasks))
+	notBefores := make([]time.Time, len(tasks))
+	dedupeKeys := make([]string, len(tasks))
+	dedupeWindows := make([]time.Duration, len(tasks))
+	onParentFailures := make([]string, len(tasks))
+	expiresAts := make([]time.Time, len(tasks))
+	var parentIndexes []int
+	var parentIDs []string
+	for i, task := range tasks {
+		qt, ok := task.Task.(*lock.QueueTask)
+		if !ok {
+			msg := fmt.Sprintf("Task %d is a %T not a *lock.QueueTask", i, task.Task)
+			return nil, glitch.NewDataError(errors.New(msg), ErrorQueryingDB, msg)
+		}
+		queues[i] = qt.Queue
+		types[i] = qt.Type
+		payloads[i] = string(qt.Payload)
+		notBefores[i] = task.NotBefore
+		dedupeKeys[i] = task.DedupeKey
+		dedupeWindows[i] = task.DedupeWindow
+		onParentFailures[i] = string(task.OnParentFailure)
+		expiresAts[i] = task.ExpiresAt
+		for _, parentID := range task.Parents {
+			// the index of the request in enqueue_tasks is 1 based
+			parentIndexes = append(parentIndexes, i+1)
+			parentIDs = append(parentIDs, parentID)
+		}
+	}
+
+	query := fmt.Sprintf("SELECT task_id::TEXT, deduplicated FROM %s($1::TEXT[], $2::TEXT[], $3::JSONB[], $4::TIMESTAMP[], $5::TEXT[], $6::INTERVAL[], $7::INTEGER[], %s, $9::TEXT[], $10::TIMESTAMP[])",
+		d.function(d.config.EnqueueTasks), d.idArray(8))
+	rows, err := tx.Query(ctx, query,
+		textArray(queues), textArray(types), textArray(payloads), timeArray(notBefores), textArray(dedupeKeys), intervalArray(dedupeWindows),
+		intArray(parentIndexes), d.ids(parentIDs), textArray(onParentFailures), timeArray(expiresAts))
+	if err != nil {
+		return nil, toDataError(err, "Error enqueueing tasks")
+	}
+	defer rows.Close()
+
+	results := make([]lock.EnqueueResult, 0, len(tasks))
+	for rows.Next() {
+		var result lock.EnqueueResult
+		err = rows.Scan(&result.ID, &result.Deduplicated)
+		if err != nil {
+			return nil, toDataError(err, "Error enqueueing tasks")
+		}
+		results = append(results, result)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, toDataError(err, "Error enqueueing tasks")
+	}
+	if len(results) != len(tasks) {
+		msg := fmt.Sprintf("Enqueued %d tasks, want %d", len(results), len(tasks))
+		return nil, glitch.NewDataError(errors.New(msg), ErrorQueryingDB, msg)
+	}
+	return results, nil
+}
+
+// ids binds task ids to a task_id[] parameter
+func (d *DB) ids(taskIDs []string) lock.IDArray {
+	return lock.IDArray{Kind: d.config.IDKind, IDs: taskIDs}
+}
+
+// id returns parameter n cast to the IDKind so a task id bound as a string is compared as its type
+func (d *DB) id(n int) string {
+	return fmt.Sprintf("$%d::%s", n, d.config.IDKind)
+}
+
+// idArray returns parameter n cast to an array of the IDKind so drivers that bind binary arrays know its type
+func (d *DB) idArray(n int) string {
+	return fmt.Sprintf("$%d::%s[]", n, d.config.IDKind)
+}
+
+// function returns the quoted and schema qualified name of a function
+func (d *DB) function(name string) string {
+	if d.config.Schema == "" {
+		return quoteIdentifier(name)
+	}
+	return quoteIdentifier(d.config.Schema) + "." + quoteIdentifier(name)
+}
+
+// row is the first row of a query, like *sql.Row for a lock.Querier
+type row struct {
+	rows lock.Rows
+	err  error
+}
+
+// queryRow runs query on q and returns its first row
+func queryRow(ctx context.Context, q lock.Querier, query string, args ...interface{}) row {
+	rows, err := q.Query(ctx, query, args...)
+	return row{rows: rows, err: err}
+}
+
+// scan scans the row into dest and closes the rows.  It returns sql.ErrNoRows if there is no row.
+func (r row) scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close()
+	if !r.rows.Next() {
+		err := r.rows.Err()
+		if err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	err := r.rows.Scan(dest...)
+	if err != nil {
+		return err
+	}
+	return r.rows.Close()
+}
+
+// nullString binds an empty string as NULL
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullTime binds the zero time as NULL and any other time as UTC, the columns are TIMESTAMP in UTC
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// textArray returns values as a Postgres array literal that can be bound to a TEXT[] parameter
+func textArray(values []string) string {
+	literal, _ := lock.TextID.ArrayLiteral(values)
+	return literal
+}
+
+// timeArray returns times in UTC as a Postgres array literal that can be bound to a TIMESTAMP[] parameter.  The zero time is NULL.
+func timeArray(times []time.Time) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, t := range times {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if t.IsZero() {
+			b.WriteString("NULL")
+			continue
+		}
+		b.WriteString(`"` + t.UTC().Format("2006-01-02 15:04:05.999999") + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// intArray returns values as a Postgres array literal that can be bound to an INTEGER[] or BIGINT[] parameter
+func intArray[N int | int64](values []N) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// intervalArray returns durations as a Postgres array literal that can be bound to an INTERVAL[] parameter
+func intervalArray(durations []time.Duration) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, d := range durations {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(`"` + strconv.FormatInt(d.Microseconds(), 10) + ` microseconds"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// bytesArray returns values as a Postgres array literal that can be bound to a BYTEA[] parameter.  nil is NULL.
+func bytesArray(values [][]byte) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if v == nil {
+			b.WriteString("NULL")
+			continue
+		}
+		// the array literal unescapes \\x to \x, the hex format of BYTEA
+		b.WriteString(`"\\x` + hex.EncodeToString(v) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// quoteIdentifier quotes name so it is used as is
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// toDataError wraps err in a glitch.DataError.  The session locking SQLSTATEs, such as lock.SQLErrorSessionNotFound, become its code.
+func toDataError(err error, msg string) glitch.DataError {
+	var dbErr glitch.DataError
+	if errors.As(err, &dbErr) {
+		return dbErr
+	}
+	state := SQLState(err)
+	if strings.HasPrefix(state, "SL") {
+		return glitch.NewDataError(err, state, msg)
+	}
+	return glitch.NewDataError(err, ErrorQueryingDB, msg)
+}
+
+// SQLState returns the SQLSTATE of a Postgres error, or an empty string if err does not have one.
+// It reads the SQLState method of the driver's error, which pgx's *pgconn.PgError and lib/pq's *pq.Error both have.
+func SQLState(err error) string {
+	var stater interface{ SQLState() string }
+	if errors.As(err, &stater) {
+		return stater.SQLState()
+	}
+	return ""
+}
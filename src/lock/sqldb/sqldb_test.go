@@ -0,0 +1,190 @@
+package sqldb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// pgError has a SQLState method like the errors of pgx and lib/pq
+type pgError struct {
+	code string
+}
+
+func (e *pgError) Error() string {
+	return "pq: " + e.code
+}
+
+func (e *pgError) SQLState() string {
+	return e.code
+}
+
+// query is a query run on a recordingQuerier
+type query struct {
+	sql  string
+	args []interface{}
+}
+
+// recordingQuerier records the queries run on it and answers every Query with rows
+type recordingQuerier struct {
+	queries []query
+	rows    [][]interface{}
+}
+
+func (q *recordingQuerier) Exec(ctx context.Context, sql string, args ...interface{}) error {
+	q.queries = append(q.queries, query{sql: sql, args: args})
+	return nil
+}
+
+func (q *recordingQuerier) Query(ctx context.Context, sql string, args ...interface{}) (lock.Rows, error) {
+	q.queries = append(q.queries, query{sql: sql, args: args})
+	return &fakeRows{rows: q.rows}, nil
+}
+
+// pipeliningQuerier also implements Pipeliner
+type pipeliningQuerier struct {
+	recordingQuerier
+}
+
+func (q *pipeliningQuerier) QueryAfter(ctx context.Context, exec string, execArgs []interface{}, sql string, args ...interface{}) (lock.Rows, error) {
+	q.queries = append(q.queries, query{sql: exec, args: execArgs})
+	return q.Query(ctx, sql, args...)
+}
+
+// fakeRows scans each of rows in turn
+type fakeRows struct {
+	rows [][]interface{}
+	next int
+}
+
+func (r *fakeRows) Next() bool {
+	r.next++
+	return r.next <= len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	row := r.rows[r.next-1]
+	if len(dest) != len(row) {
+		return fmt.Errorf("Scanning %d columns into %d values", len(row), len(dest))
+	}
+	for i, v := range row {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+	}
+	return nil
+}
+
+func (r *fakeRows) Err() error {
+	return nil
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func TestToDataError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{&pgError{code: lock.SQLErrorSessionNotFound}, lock.SQLErrorSessionNotFound},
+		{fmt.Errorf("wrapped: %w", &pgError{code: lock.SQLErrorLeaseNotFound}), lock.SQLErrorLeaseNotFound},
+		// only the session locking SQLSTATEs become the code
+		{&pgError{code: "23505"}, ErrorQueryingDB},
+		{errors.New("connection reset"), ErrorQueryingDB},
+		{glitch.NewDataError(nil, lock.ErrorScanningTask, "Error scanning task"), lock.ErrorScanningTask},
+	}
+	for _, test := range tests {
+		dbErr := toDataError(test.err, "Error getting work")
+		if dbErr.Code() != test.code {
+			t.Errorf("toDataError(%v) has code %s, want %s", test.err, dbErr.Code(), test.code)
+		}
+	}
+}
+
+func TestSQLState(t *testing.T) {
+	if state := SQLState(fmt.Errorf("wrapped: %w", &pgError{code: "40001"})); state != "40001" {
+		t.Errorf("Got SQLSTATE %q, want 40001", state)
+	}
+	if state := SQLState(errors.New("connection reset")); state != "" {
+		t.Errorf("Got SQLSTATE %q from an error without one, want none", state)
+	}
+}
+
+func TestConfigFunctionNames(t *testing.T) {
+	d := New(nil, Config{GetWork: "get_report_work"})
+	if d.config.StartSession != "start_session" || d.config.FinishTasks != "finish_tasks" {
+		t.Errorf("Got config %+v, want the default names filled in", d.config)
+	}
+	if got := d.function(d.config.GetWork); got != `"get_report_work"` {
+		t.Errorf("Got function %s, want the given name quoted", got)
+	}
+
+	d = New(nil, Config{Schema: "jobs", GetWork: `odd"name`})
+	if got := d.function(d.config.GetWork); got != `"jobs"."odd""name"` {
+		t.Errorf("Got function %s, want the schema and name quoted", got)
+	}
+}
+
+func TestGetWorkPipelinesBump(t *testing.T) {
+	q := &recordingQuerier{}
+	_, dbErr := NewQuerier(q, Config{}).GetWork(context.Background(), 7, 10, nil)
+	if dbErr != nil {
+		t.Fatalf("Error getting work: %v", dbErr)
+	}
+	if len(q.queries) != 1 || q.queries[0].sql != `SELECT * FROM "get_work"($1, $2)` {
+		t.Errorf("Ran %+v, want only get_work without a Pipeliner", q.queries)
+	}
+
+	p := &pipeliningQuerier{}
+	_, dbErr = NewQuerier(p, Config{}).GetWorkPage(context.Background(), 7, 10, 5, "3", nil)
+	if dbErr != nil {
+		t.Fatalf("Error getting work: %v", dbErr)
+	}
+	if len(p.queries) != 2 || p.queries[0].sql != `SELECT "bump_session"($1)` || !reflect.DeepEqual(p.queries[0].args, []interface{}{int64(7)}) {
+		t.Fatalf("Ran %+v, want bump_session of session 7 ahead of get_work", p.queries)
+	}
+	if p.queries[1].sql != `SELECT * FROM "get_work"($1, $2, $3, $4::BIGINT)` {
+		t.Errorf("Ran %s after the bump, want the paged get_work", p.queries[1].sql)
+	}
+}
+
+func TestGetQueueWorkPage(t *testing.T) {
+	q := &recordingQuerier{}
+	_, dbErr := NewQuerier(q, Config{Queue: "emails"}).GetWorkPage(context.Background(), 7, 10, 5, "", nil)
+	if dbErr != nil {
+		t.Fatalf("Error getting work: %v", dbErr)
+	}
+	if len(q.queries) != 1 || q.queries[0].sql != `SELECT * FROM "get_queue_work_page"($1, $2, $3, $4, $5::TEXT[], $6::BIGINT)` {
+		t.Errorf("Ran %+v, want get_queue_work_page", q.queries)
+	}
+}
+
+func TestEnqueueTasksOneQuery(t *testing.T) {
+	q := &recordingQuerier{rows: [][]interface{}{{"1", false}, {"2", true}}}
+	results, dbErr := NewQuerier(q, Config{}).EnqueueTasks(context.Background(), []lock.EnqueueRequest{
+		lock.RunNow(&lock.QueueTask{Queue: "q", Payload: []byte(`{}`)}),
+		lock.RunNow(&lock.QueueTask{Queue: "q", Type: "t", Payload: []byte(`{"a":1}`)}).Dedupe("key", time.Second).After("5", "6"),
+	})
+	if dbErr != nil {
+		t.Fatalf("Error enqueueing tasks: %v", dbErr)
+	}
+	if len(q.queries) != 1 {
+		t.Fatalf("Ran %d queries, want the batch in one", len(q.queries))
+	}
+	args := q.queries[0].args
+	if args[2] != `{"{}","{\"a\":1}"}` || args[4] != `{"","key"}` || args[5] != `{"0 microseconds","1000000 microseconds"}` {
+		t.Errorf("Got args %v, want the fields of each request at its index", args)
+	}
+	if args[6] != "{2,2}" || !reflect.DeepEqual(args[7], lock.IDArray{Kind: lock.BigintID, IDs: []string{"5", "6"}}) {
+		t.Errorf("Got parents %v and %v, want 5 and 6 for request 2", args[6], args[7])
+	}
+	if len(results) != 2 || results[0].ID != "1" || results[1].ID != "2" || !results[1].Deduplicated {
+		t.Errorf("Got results %+v, want the rows in order", results)
+	}
+}
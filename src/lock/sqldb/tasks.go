@@ -0,0 +1,172 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// ExtendLease calls extend_task_lease.  It returns lock.SQLErrorLeaseNotFound if the session no longer holds the task.
+func (d *DB) ExtendLease(ctx context.Context, sessionID int64, taskID string, duration time.Duration) glitch.DataError {
+	err := d.db.Exec(ctx, "SELECT "+d.function(d.config.ExtendTaskLease)+"($1, "+d.id(2)+", $3::BIGINT * INTERVAL '1 microsecond')",
+		sessionID, taskID, duration.Microseconds())
+	if err != nil {
+		return toDataError(err, "Error extending lease")
+	}
+	return nil
+}
+
+// SaveCheckpoint calls save_checkpoint.  It returns lock.SQLErrorLeaseNotFound if the session no longer holds the task.
+func (d *DB) SaveCheckpoint(ctx context.Context, sessionID int64, taskID string, state []byte) glitch.DataError {
+	err := d.db.Exec(ctx, "SELECT "+d.function(d.config.SaveCheckpoint)+"($1, "+d.id(2)+", $3)", sessionID, taskID, state)
+	if err != nil {
+		return toDataError(err, "Error saving checkpoint")
+	}
+	return nil
+}
+
+// GetNextTaskDue calls get_next_task_due, for Config.Queue if it is set
+func (d *DB) GetNextTaskDue(ctx context.Context) (time.Time, glitch.DataError) {
+	var due sql.NullTime
+	var err error
+	if d.config.Queue != "" {
+		err = queryRow(ctx, d.db, "SELECT "+d.function(d.config.GetNextTaskDue)+"($1)", d.config.Queue).scan(&due)
+	} else {
+		err = queryRow(ctx, d.db, "SELECT "+d.function(d.config.GetNextTaskDue)+"()").scan(&due)
+	}
+	if err != nil {
+		return time.Time{}, toDataError(err, "Error getting next task due")
+	}
+	if !due.Valid {
+		return time.Time{}, nil
+	}
+	return due.Time, nil
+}
+
+// FinishTasksWithResults calls the finish_tasks overload that takes in_results
+func (d *DB) FinishTasksWithResults(ctx context.Context, tasks []lock.FinishedTask) glitch.DataError {
+	taskIDs := make([]string, len(tasks))
+	results := make([][]byte, len(tasks))
+	for i, task := range tasks {
+		taskIDs[i] = task.TaskID
+		results[i] = task.Result
+	}
+	err := d.db.Exec(ctx, "SELECT "+d.function(d.config.FinishTasks)+"("+d.idArray(1)+", $2::BYTEA[])", d.ids(taskIDs), bytesArray(results))
+	if err != nil {
+		return toDataError(err, "Error finishing tasks")
+	}
+	return nil
+}
+
+// GetTaskResult calls get_task_result and returns nil if there is no such task
+func (d *DB) GetTaskResult(ctx context.Context, taskID string) (*lock.StoredResult, glitch.DataError) {
+	result := &lock.StoredResult{TaskID: taskID}
+	var state string
+	var finished sql.NullTime
+	err := queryRow(ctx, d.db, "SELECT task_status, task_result, task_finished FROM "+d.function(d.config.GetTaskResult)+"("+d.id(1)+")", taskID).
+		scan(&state, &result.Result, &finished)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, toDataError(err, "Error getting task result")
+	}
+	result.State = lock.TaskState(state)
+	if finished.Valid {
+		result.Finished = finished.Time
+	}
+	return result, nil
+}
+
+// PurgeTaskResults calls purge_task_results and returns how many results were removed
+func (d *DB) PurgeTaskResults(ctx context.Context, finishedBefore time.Time) (int64, glitch.DataError) {
+	var count int64
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.PurgeTaskResults)+"($1)", finishedBefore.UTC()).scan(&count)
+	if err != nil {
+		return 0, toDataError(err, "Error purging task results")
+	}
+	return count, nil
+}
+
+// ExpireTasks calls expire_tasks and returns how many tasks expired
+func (d *DB) ExpireTasks(ctx context.Context) (int64, glitch.DataError) {
+	var count int64
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.ExpireTasks)+"()").scan(&count)
+	if err != nil {
+		return 0, toDataError(err, "Error expiring tasks")
+	}
+	return count, nil
+}
+
+// CancelTasks calls cancel_tasks and returns how many tasks were cancelled
+func (d *DB) CancelTasks(ctx context.Context, taskIDs []string) (int64, glitch.DataError) {
+	var count int64
+	err := queryRow(ctx, d.db, "SELECT "+d.function(d.config.CancelTasks)+"("+d.idArray(1)+")", d.ids(taskIDs)).scan(&count)
+	if err != nil {
+		return 0, toDataError(err, "Error cancelling tasks")
+	}
+	return count, nil
+}
+
+// GetCancelledTasks calls get_cancelled_tasks and returns the ids of the cancelled tasks the session holds
+func (d *DB) GetCancelledTasks(ctx context.Context, sessionID int64) ([]string, glitch.DataError) {
+	rows, err := d.db.Query(ctx, "SELECT t::TEXT FROM "+d.function(d.config.GetCancelledTasks)+"($1) AS t", sessionID)
+	if err != nil {
+		return nil, toDataError(err, "Error getting cancelled tasks")
+	}
+	defer rows.Close()
+
+	var taskIDs []string
+	for rows.Next() {
+		var taskID string
+		err = rows.Scan(&taskID)
+		if err != nil {
+			return nil, toDataError(err, "Error getting cancelled tasks")
+		}
+		taskIDs = append(taskIDs, taskID)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, toDataError(err, "Error getting cancelled tasks")
+	}
+	return taskIDs, nil
+}
+
+// FailTasks calls fail_tasks, which dead letters the tasks
+func (d *DB) FailTasks(ctx context.Context, failures []lock.TaskFailure) glitch.DataError {
+	taskIDs := make([]string, len(failures))
+	errs := make([]string, len(failures))
+	for i, failure := range failures {
+		taskIDs[i] = failure.TaskID
+		errs[i] = failure.Error
+	}
+	err := d.db.Exec(ctx, "SELECT "+d.function(d.config.FailTasks)+"("+d.idArray(1)+", $2::TEXT[])", d.ids(taskIDs), textArray(errs))
+	if err != nil {
+		return toDataError(err, "Error failing tasks")
+	}
+	return nil
+}
+
+// RetryTasks calls retry_tasks, which fails the tasks that are out of attempts instead
+func (d *DB) RetryTasks(ctx context.Context, retries []lock.TaskFailure) glitch.DataError {
+	taskIDs := make([]string, len(retries))
+	errs := make([]string, len(retries))
+	notBefores := make([]time.Time, len(retries))
+	maxAttempts := make([]int, len(retries))
+	for i, retry := range retries {
+		taskIDs[i] = retry.TaskID
+		errs[i] = retry.Error
+		notBefores[i] = retry.NotBefore
+		maxAttempts[i] = retry.MaxAttempts
+	}
+	err := d.db.Exec(ctx, "SELECT "+d.function(d.config.RetryTasks)+"("+d.idArray(1)+", $2::TEXT[], $3::TIMESTAMP[], $4::INTEGER[])",
+		d.ids(taskIDs), textArray(errs), timeArray(notBefores), intArray(maxAttempts))
+	if err != nil {
+		return toDataError(err, "Error retrying tasks")
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+package sqlitedb
+
+// sqlitedb works with any database/sql SQLite driver, the tests register mattn/go-sqlite3
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
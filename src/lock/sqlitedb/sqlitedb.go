@@ -0,0 +1,368 @@
+// Package sqlitedb implements lock.Database over a *sql.DB connected to SQLite with the schema in migration/sqlite.
+// Any database/sql SQLite driver works, such as mattn/go-sqlite3 or modernc.org/sqlite.
+// SQLite has no plpgsql or FOR UPDATE, so the session and claim logic of the plpgsql functions lives here
+// and runs in BEGIN IMMEDIATE transactions, which hold SQLite's single write lock like get_work holds work_lock.
+package sqlitedb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// Defaults match start_session, bump_session and pickup_tasks_for_session
+const (
+	DefaultSessionTTL    = 2 * time.Minute
+	DefaultLeaseDuration = 5 * time.Minute
+)
+
+// Error codes
+const (
+	ErrorQueryingDB = "ERROR_QUERYING_DB"
+)
+
+// DB implements lock.Database, lock.PagedWorkGetter and lock.LeaseExtender with SQLite
+type DB struct {
+	db            *sql.DB
+	now           func() time.Time
+	sessionTTL    time.Duration
+	leaseDuration time.Duration
+}
+
+// Option changes optional behavior of a DB
+type Option func(d *DB)
+
+// WithClock makes the DB read the time from now in place of time.Now
+func WithClock(now func() time.Time) Option {
+	return func(d *DB) {
+		d.now = now
+	}
+}
+
+// WithSessionTTL sets how long a session lives after it is started or bumped.  The default is DefaultSessionTTL.
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(d *DB) {
+		d.sessionTTL = ttl
+	}
+}
+
+// WithLeaseDuration sets how long a session holds a task it picks up.  The default is DefaultLeaseDuration.
+func WithLeaseDuration(lease time.Duration) Option {
+	return func(d *DB) {
+		d.leaseDuration = lease
+	}
+}
+
+// New will create a new DB
+// db is connected to the SQLite file holding the schema in migration/sqlite, opened with whichever driver the caller registered
+func New(db *sql.DB, opts ...Option) *DB {
+	d := &DB{
+		db:            db,
+		now:           time.Now,
+		sessionTTL:    DefaultSessionTTL,
+		leaseDuration: DefaultLeaseDuration,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// StartSession starts a new session that expires after the session TTL unless it is bumped
+func (d *DB) StartSession(ctx context.Context) (int64, glitch.DataError) {
+	now := d.now()
+	res, err := d.db.ExecContext(ctx, "INSERT INTO session (created, expires) VALUES (?, ?)", millis(now), millis(now.Add(d.sessionTTL)))
+	if err != nil {
+		return 0, toDataError(err, "Error starting session")
+	}
+	sessionID, err := res.LastInsertId()
+	if err != nil {
+		return 0, toDataError(err, "Error starting session")
+	}
+	return sessionID, nil
+}
+
+// BumpSession extends the session.  It returns lock.SQLErrorSessionNotFound if the session is unknown or expired.
+func (d *DB) BumpSession(ctx context.Context, sessionID int64) glitch.DataError {
+	return bump(ctx, d.db, sessionID, d.now(), d.sessionTTL)
+}
+
+// EndSession expires the session so its tasks go back to the pool
+func (d *DB) EndSession(ctx context.Context, sessionID int64) glitch.DataError {
+	_, err := d.db.ExecContext(ctx, "UPDATE session SET expires = ? WHERE id = ?", int64(-1), sessionID)
+	if err != nil {
+		return toDataError(err, "Error ending session")
+	}
+	return nil
+}
+
+// GetWork bumps the session, renews the leases it holds, balances the pending tasks across the active sessions
+// and returns the tasks this session holds
+func (d *DB) GetWork(ctx context.Context, sessionID int64, tasksPerSession int64, scanTask lock.ScanTask) ([]lock.Task, glitch.DataError) {
+	return d.GetWorkPage(ctx, sessionID, tasksPerSession, 0, "", scanTask)
+}
+
+// GetWorkPage does the same as GetWork but only returns the first batchSize tasks with an id after afterID.
+// A batchSize of 0 returns every task and an empty afterID starts from the first task.
+// The rows handed to scanTask hold the id, queue, task_type, payload and attempts of a task, see ScanQueueTask.
+func (d *DB) GetWorkPage(ctx context.Context, sessionID int64, tasksPerSession int64, batchSize int64, afterID string, scanTask lock.ScanTask) ([]lock.Task, glitch.DataError) {
+	var after int64
+	if afterID != "" {
+		var dbErr glitch.DataError
+		after, dbErr = parseID(afterID)
+		if dbErr != nil {
+			return nil, dbErr
+		}
+	}
+	var tasks []lock.Task
+	err := d.immediate(ctx, func(conn *sql.Conn) error {
+		now := d.now()
+		dbErr := bump(ctx, conn, sessionID, now, d.sessionTTL)
+		if dbErr != nil {
+			return dbErr
+		}
+
+		// only the first page picks up tasks, the pages after it read on through the tasks the session already holds
+		if afterID == "" {
+			err := balance(ctx, conn, sessionID, tasksPerSession, now, d.leaseDuration)
+			if err != nil {
+				return err
+			}
+		}
+
+		limit := int64(-1)
+		if batchSize > 0 {
+			limit = batchSize
+		}
+		// the session keeps the tasks it is handed, so a task is only given to another session once this one stops getting it.
+		// Tasks further down that are not returned keep their lease and are picked up by another session if it runs out.
+		_, err := conn.ExecContext(ctx, `UPDATE task
+			SET lease_expires = ?
+			  , updated = ?
+			WHERE id IN (`+pageQuery+`)`, millis(now.Add(d.leaseDuration)), millis(now), sessionID, millis(now), millis(now), after, limit)
+		if err != nil {
+			return err
+		}
+
+		rows, err := conn.QueryContext(ctx, `SELECT id, queue, task_type, payload, attempts
+			FROM task
+			WHERE id IN (`+pageQuery+`)
+			ORDER BY id`, sessionID, millis(now), millis(now), after, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			task, dbErr := scanTask(rows)
+			if dbErr != nil {
+				return dbErr
+			}
+			tasks = append(tasks, task)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, toDataError(err, "Error getting work")
+	}
+	return tasks, nil
+}
+
+// pageQuery selects the ids of a page of the tasks a session holds that are ready to run
+const pageQuery = `SELECT id
+	FROM task
+	WHERE session_id = ?
+	AND status = 'pending'
+	AND lease_expires >= ?
+	AND (not_before IS NULL OR not_before <= ?)
+	AND id > ?
+	ORDER BY id
+	LIMIT ?`
+
+// balance picks up the session's share of the pending tasks inside the transaction on conn
+func balance(ctx context.Context, conn *sql.Conn, sessionID int64, tasksPerSession int64, now time.Time, leaseDuration time.Duration) error {
+	var sessions, taskCount, sessionCount int64
+	err := conn.QueryRowContext(ctx, "SELECT count(*) FROM session WHERE expires >= ?", millis(now)).Scan(&sessions)
+	if err != nil {
+		return err
+	}
+	err = conn.QueryRowContext(ctx, `SELECT count(*) FROM task
+		WHERE status = 'pending'
+		AND (not_before IS NULL OR not_before <= ?)`, millis(now)).Scan(&taskCount)
+	if err != nil {
+		return err
+	}
+	err = conn.QueryRowContext(ctx, `SELECT count(*) FROM task
+		WHERE session_id = ?
+		AND status = 'pending'
+		AND lease_expires >= ?`, sessionID, millis(now)).Scan(&sessionCount)
+	if err != nil {
+		return err
+	}
+
+	// the ideal count is the pending tasks split across the sessions, rounded up, and capped at tasksPerSession
+	idealCount := (taskCount + sessions - 1) / sessions
+	if tasksPerSession < idealCount {
+		idealCount = tasksPerSession
+	}
+
+	if sessionCount < idealCount {
+		_, err = conn.ExecContext(ctx, `UPDATE task
+			SET session_id = ?
+			  , lease_expires = ?
+			  , updated = ?
+			WHERE id IN (
+				SELECT t.id
+				FROM task t
+				LEFT OUTER JOIN session s ON t.session_id = s.id
+				WHERE t.status = 'pending'
+				AND (t.session_id IS NULL OR s.expires < ? OR t.lease_expires < ?)
+				AND (t.not_before IS NULL OR t.not_before <= ?)
+				ORDER BY t.id
+				LIMIT ?
+			)`, sessionID, millis(now.Add(leaseDuration)), millis(now), millis(now), millis(now), millis(now), idealCount-sessionCount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FinishTasks flags the pending tasks with taskIDs as finished so they are never picked up again
+func (d *DB) FinishTasks(ctx context.Context, taskIDs []string) glitch.DataError {
+	if len(taskIDs) == 0 {
+		return nil
+	}
+	now := millis(d.now())
+	args := []interface{}{now, now}
+	for _, id := range taskIDs {
+		n, dbErr := parseID(id)
+		if dbErr != nil {
+			return dbErr
+		}
+		args = append(args, n)
+	}
+	query := "UPDATE task SET status = 'finished', finished = ?, updated = ? WHERE status = 'pending' AND id IN (?" + strings.Repeat(", ?", len(taskIDs)-1) + ")"
+	_, err := d.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return toDataError(err, "Error finishing tasks")
+	}
+	return nil
+}
+
+// ExtendLease extends the lease the session holds on the task.  It returns lock.SQLErrorLeaseNotFound if the session no longer holds it.
+func (d *DB) ExtendLease(ctx context.Context, sessionID int64, taskID string, duration time.Duration) glitch.DataError {
+	id, dbErr := parseID(taskID)
+	if dbErr != nil {
+		return dbErr
+	}
+	now := d.now()
+	res, err := d.db.ExecContext(ctx, `UPDATE task
+		SET lease_expires = ?
+		  , updated = ?
+		WHERE id = ?
+		AND session_id = ?
+		AND status = 'pending'
+		AND lease_expires >= ?`, millis(now.Add(duration)), millis(now), id, sessionID, millis(now))
+	if err != nil {
+		return toDataError(err, "Error extending lease")
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return toDataError(err, "Error extending lease")
+	}
+	if count == 0 {
+		return glitch.NewDataError(errors.New("Lease not found."), lock.SQLErrorLeaseNotFound, "Error extending lease")
+	}
+	return nil
+}
+
+// ScanQueueTask scans a row returned by GetWork into a *lock.QueueTask
+func ScanQueueTask(row lock.Scanner) (lock.Task, glitch.DataError) {
+	t := &lock.QueueTask{}
+	var payload []byte
+	err := row.Scan(&t.ID, &t.Queue, &t.Type, &payload, &t.Attempts)
+	if err != nil {
+		return nil, glitch.NewDataError(err, lock.ErrorScanningTask, "Error scanning task")
+	}
+	t.Payload = json.RawMessage(payload)
+	return t, nil
+}
+
+// parseID parses a task id, which is an INTEGER in the schema
+func parseID(id string) (int64, glitch.DataError) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, glitch.NewDataError(err, lock.ErrorInvalidTaskID, fmt.Sprintf("Task id %q is not an INTEGER", id))
+	}
+	return n, nil
+}
+
+// execer is a *sql.DB or a *sql.Conn
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// bump is bump_session, it extends the session if it has not expired
+func bump(ctx context.Context, db execer, sessionID int64, now time.Time, ttl time.Duration) glitch.DataError {
+	res, err := db.ExecContext(ctx, "UPDATE session SET expires = ? WHERE id = ? AND expires >= ?", millis(now.Add(ttl)), sessionID, millis(now))
+	if err != nil {
+		return toDataError(err, "Error bumping session")
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return toDataError(err, "Error bumping session")
+	}
+	if count == 0 {
+		return glitch.NewDataError(errors.New("Session not found."), lock.SQLErrorSessionNotFound, "Error bumping session")
+	}
+	return nil
+}
+
+// immediate runs fn in a BEGIN IMMEDIATE transaction on a single connection so no other writer can claim tasks until it commits.
+// The transaction is rolled back if fn returns an error.
+func (d *DB) immediate(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE")
+	if err != nil {
+		return fmt.Errorf("Error starting transaction: %v", err)
+	}
+	err = fn(conn)
+	if err != nil {
+		// the caller's context may be done, so roll back without it
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	if err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		return fmt.Errorf("Error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// millis returns t as unix milliseconds, the format of every time in the schema
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// toDataError wraps err in a glitch.DataError unless it already is one
+func toDataError(err error, msg string) glitch.DataError {
+	var dbErr glitch.DataError
+	if errors.As(err, &dbErr) {
+		return dbErr
+	}
+	return glitch.NewDataError(err, ErrorQueryingDB, msg)
+}
@@ -0,0 +1,309 @@
+package sqlitedb
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-session-lock/src/lock"
+)
+
+// clock is a time source tests move forward by hand
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+// openTestDB opens a new SQLite file with the schema in migration/sqlite, using the driver registered in driver_test.go
+func openTestDB(t *testing.T, tasks int, opts ...Option) (*DB, *clock) {
+	t.Helper()
+	sqlDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	schema, err := os.ReadFile(filepath.Join("..", "..", "..", "migration", "sqlite", "0001_sessions.up.sql"))
+	if err != nil {
+		t.Fatalf("Error reading schema: %v", err)
+	}
+	for _, stmt := range strings.Split(stripComments(string(schema)), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		_, err = sqlDB.Exec(stmt)
+		if err != nil {
+			t.Fatalf("Error running %q: %v", stmt, err)
+		}
+	}
+
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for i := 0; i < tasks; i++ {
+		_, err = sqlDB.Exec("INSERT INTO task (queue, payload, created, updated) VALUES ('q', '{}', ?, ?)", millis(c.now), millis(c.now))
+		if err != nil {
+			t.Fatalf("Error adding task: %v", err)
+		}
+	}
+	return New(sqlDB, append([]Option{WithClock(c.Now)}, opts...)...), c
+}
+
+func stripComments(schema string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(schema, "\n") {
+		if i := strings.Index(line, "--"); i >= 0 {
+			line = line[:i]
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+func mustStart(t *testing.T, db *DB) int64 {
+	t.Helper()
+	sessionID, dbErr := db.StartSession(context.Background())
+	if dbErr != nil {
+		t.Fatalf("Error starting session: %v", dbErr)
+	}
+	return sessionID
+}
+
+func mustGetWork(t *testing.T, db *DB, sessionID int64) []string {
+	t.Helper()
+	tasks, dbErr := db.GetWork(context.Background(), sessionID, 100, ScanQueueTask)
+	if dbErr != nil {
+		t.Fatalf("Error getting work for session %d: %v", sessionID, dbErr)
+	}
+	ids := make([]string, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.GetID()
+	}
+	return ids
+}
+
+func TestGetWorkBalancesSessions(t *testing.T) {
+	db, _ := openTestDB(t, 10)
+	first := mustStart(t, db)
+	second := mustStart(t, db)
+	third := mustStart(t, db)
+
+	// 10 tasks split across 3 sessions rounds up to 4 each, the last session gets what is left
+	seen := make(map[string]int64)
+	for _, tt := range []struct {
+		sessionID int64
+		want      int
+	}{{first, 4}, {second, 4}, {third, 2}} {
+		got := mustGetWork(t, db, tt.sessionID)
+		if len(got) != tt.want {
+			t.Errorf("Session %d got %d tasks %v, want %d", tt.sessionID, len(got), got, tt.want)
+		}
+		for _, id := range got {
+			if other, ok := seen[id]; ok {
+				t.Errorf("Task %s was handed to sessions %d and %d", id, other, tt.sessionID)
+			}
+			seen[id] = tt.sessionID
+		}
+	}
+}
+
+func TestGetWorkExpiredSession(t *testing.T) {
+	db, c := openTestDB(t, 1)
+	sessionID := mustStart(t, db)
+	c.now = c.now.Add(DefaultSessionTTL + time.Second)
+
+	_, dbErr := db.GetWork(context.Background(), sessionID, 100, ScanQueueTask)
+	if dbErr == nil || dbErr.Code() != lock.SQLErrorSessionNotFound {
+		t.Fatalf("GetWork on an expired session returned %v, want %s", dbErr, lock.SQLErrorSessionNotFound)
+	}
+}
+
+func TestGetWorkEndedSession(t *testing.T) {
+	db, _ := openTestDB(t, 1)
+	first := mustStart(t, db)
+	second := mustStart(t, db)
+	mustGetWork(t, db, first)
+
+	dbErr := db.EndSession(context.Background(), first)
+	if dbErr != nil {
+		t.Fatalf("Error ending session: %v", dbErr)
+	}
+	_, dbErr = db.GetWork(context.Background(), first, 100, ScanQueueTask)
+	if dbErr == nil || dbErr.Code() != lock.SQLErrorSessionNotFound {
+		t.Fatalf("GetWork on an ended session returned %v, want %s", dbErr, lock.SQLErrorSessionNotFound)
+	}
+	if got := mustGetWork(t, db, second); len(got) != 1 {
+		t.Errorf("Got tasks %v, want the task of the ended session", got)
+	}
+}
+
+func TestGetWorkTakesOverExpiredSession(t *testing.T) {
+	db, c := openTestDB(t, 2)
+	first := mustStart(t, db)
+	if got := mustGetWork(t, db, first); len(got) != 2 {
+		t.Fatalf("Got tasks %v, want 2", got)
+	}
+
+	c.now = c.now.Add(DefaultSessionTTL / 2)
+	second := mustStart(t, db)
+	c.now = c.now.Add(DefaultSessionTTL/2 + time.Second)
+
+	if got := mustGetWork(t, db, second); len(got) != 2 {
+		t.Errorf("Got tasks %v, want the 2 tasks of the expired session", got)
+	}
+}
+
+func TestGetWorkRenewsLeases(t *testing.T) {
+	db, c := openTestDB(t, 1, WithSessionTTL(time.Hour))
+	first := mustStart(t, db)
+	second := mustStart(t, db)
+	if got := mustGetWork(t, db, first); len(got) != 1 {
+		t.Fatalf("Got tasks %v, want 1", got)
+	}
+
+	// the first session keeps getting its task, so the lease outlives the lease duration it was picked up with
+	for i := 0; i < 3; i++ {
+		c.now = c.now.Add(DefaultLeaseDuration - time.Minute)
+		if got := mustGetWork(t, db, first); len(got) != 1 {
+			t.Fatalf("The first session got tasks %v after %v, want 1", got, c.now)
+		}
+		if got := mustGetWork(t, db, second); len(got) != 0 {
+			t.Fatalf("The second session got tasks %v held by the first session", got)
+		}
+	}
+
+	// once the first session stops calling GetWork the lease runs out and the second session takes the task
+	c.now = c.now.Add(DefaultLeaseDuration + time.Second)
+	if got := mustGetWork(t, db, second); len(got) != 1 {
+		t.Errorf("The second session got tasks %v after the lease expired, want 1", got)
+	}
+}
+
+func TestGetWorkPageRenewsOnlyReturnedLeases(t *testing.T) {
+	db, c := openTestDB(t, 2, WithSessionTTL(time.Hour))
+	ctx := context.Background()
+	first := mustStart(t, db)
+	page, dbErr := db.GetWorkPage(ctx, first, 100, 1, "", ScanQueueTask)
+	if dbErr != nil || len(page) != 1 || page[0].GetID() != "1" {
+		t.Fatalf("Got page %v, %v, want task 1", page, dbErr)
+	}
+	second := mustStart(t, db)
+
+	// the first session holds both tasks but only renews task 1, which it keeps getting
+	c.now = c.now.Add(DefaultLeaseDuration - time.Minute)
+	page, dbErr = db.GetWorkPage(ctx, first, 100, 1, "", ScanQueueTask)
+	if dbErr != nil || len(page) != 1 || page[0].GetID() != "1" {
+		t.Fatalf("Got page %v, %v, want task 1", page, dbErr)
+	}
+	c.now = c.now.Add(2 * time.Minute)
+	if got := mustGetWork(t, db, second); strings.Join(got, ",") != "2" {
+		t.Errorf("The second session got tasks %v, want task 2 whose lease ran out", got)
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	db, c := openTestDB(t, 1, WithSessionTTL(time.Hour))
+	ctx := context.Background()
+	first := mustStart(t, db)
+	second := mustStart(t, db)
+	got := mustGetWork(t, db, first)
+	if len(got) != 1 {
+		t.Fatalf("Got tasks %v, want 1", got)
+	}
+
+	dbErr := db.ExtendLease(ctx, first, got[0], time.Hour)
+	if dbErr != nil {
+		t.Fatalf("Error extending lease: %v", dbErr)
+	}
+	c.now = c.now.Add(DefaultLeaseDuration + time.Minute)
+	if got := mustGetWork(t, db, second); len(got) != 0 {
+		t.Errorf("The second session got tasks %v with an extended lease", got)
+	}
+
+	dbErr = db.ExtendLease(ctx, second, got[0], time.Hour)
+	if dbErr == nil || dbErr.Code() != lock.SQLErrorLeaseNotFound {
+		t.Errorf("ExtendLease by another session returned %v, want %s", dbErr, lock.SQLErrorLeaseNotFound)
+	}
+}
+
+func TestGetWorkPage(t *testing.T) {
+	db, _ := openTestDB(t, 5)
+	sessionID := mustStart(t, db)
+
+	var got []string
+	afterID := ""
+	for {
+		tasks, dbErr := db.GetWorkPage(context.Background(), sessionID, 100, 2, afterID, ScanQueueTask)
+		if dbErr != nil {
+			t.Fatalf("Error getting page after %q: %v", afterID, dbErr)
+		}
+		if len(tasks) == 0 {
+			break
+		}
+		for _, task := range tasks {
+			got = append(got, task.GetID())
+		}
+		afterID = tasks[len(tasks)-1].GetID()
+	}
+	if strings.Join(got, ",") != "1,2,3,4,5" {
+		t.Errorf("Paged through %v, want every task once in id order", got)
+	}
+}
+
+func TestGetWorkPageOnlyFirstPagePicksUp(t *testing.T) {
+	db, _ := openTestDB(t, 5)
+	sessionID := mustStart(t, db)
+	ctx := context.Background()
+
+	first, dbErr := db.GetWorkPage(ctx, sessionID, 2, 2, "", ScanQueueTask)
+	if dbErr != nil {
+		t.Fatalf("Error getting the first page: %v", dbErr)
+	}
+	if len(first) != 2 || first[0].GetID() != "1" || first[1].GetID() != "2" {
+		t.Fatalf("Got first page %v, want tasks 1 and 2", first)
+	}
+	dbErr = db.FinishTasks(ctx, []string{"1", "2"})
+	if dbErr != nil {
+		t.Fatalf("Error finishing tasks: %v", dbErr)
+	}
+
+	// the session has room for more tasks but only the first page picks them up
+	next, dbErr := db.GetWorkPage(ctx, sessionID, 2, 2, "2", ScanQueueTask)
+	if dbErr != nil {
+		t.Fatalf("Error getting the next page: %v", dbErr)
+	}
+	if len(next) != 0 {
+		t.Errorf("Got next page %v, want no tasks picked up after the first page", next)
+	}
+	again, dbErr := db.GetWorkPage(ctx, sessionID, 2, 2, "", ScanQueueTask)
+	if dbErr != nil {
+		t.Fatalf("Error getting the first page again: %v", dbErr)
+	}
+	if len(again) != 2 || again[0].GetID() != "3" || again[1].GetID() != "4" {
+		t.Errorf("Got first page %v, want tasks 3 and 4", again)
+	}
+}
+
+func TestFinishTasks(t *testing.T) {
+	db, _ := openTestDB(t, 2)
+	sessionID := mustStart(t, db)
+	got := mustGetWork(t, db, sessionID)
+
+	dbErr := db.FinishTasks(context.Background(), got[:1])
+	if dbErr != nil {
+		t.Fatalf("Error finishing tasks: %v", dbErr)
+	}
+	if after := mustGetWork(t, db, sessionID); len(after) != 1 || after[0] != got[1] {
+		t.Errorf("Got tasks %v after finishing %s, want [%s]", after, got[0], got[1])
+	}
+
+	dbErr = db.FinishTasks(context.Background(), []string{"abc"})
+	if dbErr == nil || dbErr.Code() != lock.ErrorInvalidTaskID {
+		t.Errorf("FinishTasks with a bad id returned %v, want %s", dbErr, lock.ErrorInvalidTaskID)
+	}
+}
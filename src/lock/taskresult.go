@@ -0,0 +1,107 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// TaskState is the status column of a task
+type TaskState string
+
+// Task states
+const (
+	TaskPending   TaskState = "pending"
+	TaskFinished  TaskState = "finished"
+	TaskDead      TaskState = "dead"
+	TaskCancelled TaskState = "cancelled"
+	TaskExpired   TaskState = "expired"
+)
+
+// FinishedTask is a task that succeeded along with what it produced
+type FinishedTask struct {
+	TaskID string
+	// Result is stored with the task until it is purged.  nil stores nothing.
+	Result []byte
+}
+
+// StoredResult is the state of a task as seen by a producer waiting on its result
+type StoredResult struct {
+	TaskID string
+	State  TaskState
+	// Result is what the task produced, nil until it finishes or once it is purged
+	Result []byte
+	// Finished is when the task finished, the zero time if it has not
+	Finished time.Time
+}
+
+// Done returns true once the task will not run again
+func (r *StoredResult) Done() bool {
+	return r.State != TaskPending
+}
+
+// Decode unmarshals the JSON result into v
+func (r *StoredResult) Decode(v interface{}) error {
+	return json.Unmarshal(r.Result, v)
+}
+
+// ResultFinisher can be implemented by a Database to store what succeeded tasks produced.
+// FinishTasksWithResults should call the finish_tasks plpgsql function that takes in_results.
+// A Runner uses it in place of FinishTasks whenever a TaskResult has a Result.
+type ResultFinisher interface {
+	FinishTasksWithResults(ctx context.Context, tasks []FinishedTask) glitch.DataError
+}
+
+// ResultStore can be implemented by a Database to read and purge stored task results.
+// GetTaskResult should call the get_task_result plpgsql function and return nil if there is no such task.
+// PurgeTaskResults should call the purge_task_results plpgsql function and return how many results were removed.
+type ResultStore interface {
+	GetTaskResult(ctx context.Context, taskID string) (*StoredResult, glitch.DataError)
+	PurgeTaskResults(ctx context.Context, finishedBefore time.Time) (int64, glitch.DataError)
+}
+
+// finishTasks flags tasks as finished, storing their results if any were given and db supports it
+func finishTasks(ctx context.Context, db Database, tasks []FinishedTask) glitch.DataError {
+	rf, ok := db.(ResultFinisher)
+	if ok {
+		for _, t := range tasks {
+			if t.Result != nil {
+				return rf.FinishTasksWithResults(ctx, tasks)
+			}
+		}
+	}
+	taskIDs := make([]string, len(tasks))
+	for i, t := range tasks {
+		taskIDs[i] = t.TaskID
+	}
+	return db.FinishTasks(ctx, taskIDs)
+}
+
+// purgeResults removes results older than the retention if it has been long enough since the last purge
+func (r *TypedRunner[T]) purgeResults(ctx context.Context) {
+	if r.resultRetention <= 0 || time.Since(r.lastPurge) < r.resultRetention/10 {
+		return
+	}
+	db, err := r.dbFinder()
+	if err != nil {
+		r.logger.Printf("Error finding DB: %v", err)
+		return
+	}
+	rs, ok := db.(ResultStore)
+	if !ok {
+		return
+	}
+	r.lastPurge = time.Now()
+	count, dbErr := rs.PurgeTaskResults(ctx, r.lastPurge.Add(-r.resultRetention))
+	if dbErr != nil {
+		r.logger.Printf("Error purging task results: %v", dbErr)
+		return
+	}
+	r.sessionMutex.RLock()
+	sessionID := r.sessionID
+	r.sessionMutex.RUnlock()
+	r.client.BackgroundCustom(strconv.FormatInt(sessionID, 10), r.name, "purged_task_results", map[string]string{}, nil, count)
+}
@@ -0,0 +1,113 @@
+package lock
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promoboxx/go-glitch/glitch"
+)
+
+// resultDB also implements ResultFinisher and ResultStore
+type resultDB struct {
+	baseDB
+	results      map[string][]byte
+	purges       int
+	purgedBefore time.Time
+}
+
+func (d *resultDB) FinishTasksWithResults(ctx context.Context, tasks []FinishedTask) glitch.DataError {
+	for _, task := range tasks {
+		d.finished = append(d.finished, task.TaskID)
+		d.results[task.TaskID] = task.Result
+	}
+	return nil
+}
+
+func (d *resultDB) GetTaskResult(ctx context.Context, taskID string) (*StoredResult, glitch.DataError) {
+	result, ok := d.results[taskID]
+	if !ok {
+		return nil, nil
+	}
+	return &StoredResult{TaskID: taskID, State: TaskFinished, Result: result}, nil
+}
+
+func (d *resultDB) PurgeTaskResults(ctx context.Context, finishedBefore time.Time) (int64, glitch.DataError) {
+	d.purges++
+	d.purgedBefore = finishedBefore
+	return 0, nil
+}
+
+func TestRecordResultsStoresResults(t *testing.T) {
+	db := &resultDB{results: make(map[string][]byte)}
+	r := newResultTestRunner(db, nil)
+
+	_, err := r.recordResults(context.Background(), db, "1", nil, []TaskResult{
+		{Task: &testTask{id: "1"}, Status: TaskSucceeded, Result: []byte(`{"sent":3}`)},
+		{Task: &testTask{id: "2"}, Status: TaskSucceeded},
+	})
+	if err != nil {
+		t.Fatalf("Error recording results: %v", err)
+	}
+	if got := strings.Join(db.finishedIDs(), ","); got != "1,2" {
+		t.Errorf("Finished %s, want 1,2", got)
+	}
+	if string(db.results["1"]) != `{"sent":3}` || db.results["2"] != nil {
+		t.Errorf("Stored results %q, want only the result of task 1", db.results)
+	}
+
+	// without a result the plain FinishTasks is used
+	_, err = r.recordResults(context.Background(), db, "1", nil, []TaskResult{{Task: &testTask{id: "3"}, Status: TaskSucceeded}})
+	if err != nil {
+		t.Fatalf("Error recording results: %v", err)
+	}
+	if _, ok := db.results["3"]; ok {
+		t.Errorf("Task 3 finished with FinishTasksWithResults, want FinishTasks")
+	}
+}
+
+func TestPurgeResults(t *testing.T) {
+	db := &resultDB{}
+	r := newResultTestRunner(db, nil)
+
+	r.purgeResults(context.Background())
+	if db.purges != 0 {
+		t.Errorf("Purged %d times without a retention, want 0", db.purges)
+	}
+
+	r.resultRetention = time.Hour
+	before := time.Now()
+	r.purgeResults(context.Background())
+	r.purgeResults(context.Background())
+	after := time.Now()
+	if db.purges != 1 {
+		t.Errorf("Purged %d times, want once per tenth of the retention", db.purges)
+	}
+	if db.purgedBefore.Before(before.Add(-time.Hour)) || db.purgedBefore.After(after.Add(-time.Hour)) {
+		t.Errorf("Purged results finished before %v, want an hour ago", db.purgedBefore)
+	}
+}
+
+func TestPayloadResultTasker(t *testing.T) {
+	tasker := PayloadResultTasker(func(ctx context.Context, task *QueueTask, to string) (map[string]int, error) {
+		return map[string]int{"sent": len(to)}, nil
+	})
+
+	results, err := tasker(context.Background(), []Task{&QueueTask{ID: 1, Payload: []byte(`"abc"`)}})
+	if err != nil {
+		t.Fatalf("Error running tasks: %v", err)
+	}
+	if results[0].Status != TaskSucceeded || string(results[0].Result) != `{"sent":3}` {
+		t.Errorf("Got result %s %s, want the encoded result", results[0].Status, results[0].Result)
+	}
+
+	stored := &StoredResult{State: TaskFinished, Result: results[0].Result}
+	var decoded map[string]int
+	if !stored.Done() || stored.Decode(&decoded) != nil || decoded["sent"] != 3 {
+		t.Errorf("Decoded %v from a finished result, want sent 3", decoded)
+	}
+	if (&StoredResult{State: TaskPending}).Done() {
+		t.Errorf("A pending task is done")
+	}
+}
@@ -0,0 +1,38 @@
+package lock
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTypedRunner(t *testing.T) {
+	db := &baseDB{tasks: []Task{&testTask{id: "1"}, &testTask{id: "2"}}}
+	var got []string
+	r := NewTypedRunner(func() (Database, error) { return db, nil }, nil, func(ctx context.Context, tasks []*testTask) ([]*testTask, error) {
+		for _, task := range tasks {
+			got = append(got, task.id)
+		}
+		return tasks, nil
+	}, time.Second, 10, nil, "test", noopClient{})
+	r.sessionID = 1
+
+	handled, err := r.doWork(context.Background())
+	if err != nil {
+		t.Fatalf("Error doing work: %v", err)
+	}
+	if len(handled) != 2 || strings.Join(got, ",") != "1,2" {
+		t.Errorf("Worked %v and handled %d tasks, want 1 and 2", got, len(handled))
+	}
+	if ids := strings.Join(db.finishedIDs(), ","); ids != "1,2" {
+		t.Errorf("Finished %s, want 1,2", ids)
+	}
+}
+
+func TestTypedTasksRejectsOtherTypes(t *testing.T) {
+	_, err := typedTasks[*QueueTask]([]Task{&QueueTask{ID: 1}, &testTask{id: "2"}})
+	if err == nil || !strings.Contains(err.Error(), "task 1 is a *lock.testTask") {
+		t.Errorf("Got error %v, want the task that is not a *QueueTask", err)
+	}
+}